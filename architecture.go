@@ -0,0 +1,60 @@
+package msi
+
+import "strings"
+
+type Architecture int
+
+const (
+	// 32-bit x86.
+	ArchitectureIntel Architecture = iota
+	// 64-bit x86, also written as AMD64 by older tools.
+	ArchitectureX64
+	// 64-bit ARM.
+	ArchitectureArm64
+	// 64-bit Itanium.
+	ArchitectureIntel64
+	// 32-bit ARM.
+	ArchitectureArm
+)
+
+// Returns the architecture with the given Template platform name (if any).
+// The comparison is case-insensitive, and an empty platform means Intel.
+func ArchitectureFromString(name string) Architecture {
+	switch strings.ToLower(name) {
+	case "", "intel":
+		return ArchitectureIntel
+	case "x64", "amd64":
+		return ArchitectureX64
+	case "arm64":
+		return ArchitectureArm64
+	case "intel64":
+		return ArchitectureIntel64
+	case "arm":
+		return ArchitectureArm
+	default:
+		return -1
+	}
+}
+
+// Returns the platform name used in the Template summary property.
+func (a Architecture) String() string {
+	switch a {
+	case ArchitectureIntel:
+		return "Intel"
+	case ArchitectureX64:
+		return "x64"
+	case ArchitectureArm64:
+		return "Arm64"
+	case ArchitectureIntel64:
+		return "Intel64"
+	case ArchitectureArm:
+		return "Arm"
+	default:
+		return "Unknown"
+	}
+}
+
+// Returns true if the architecture is a 64-bit one.
+func (a Architecture) Is64Bit() bool {
+	return a == ArchitectureX64 || a == ArchitectureArm64 || a == ArchitectureIntel64
+}
@@ -0,0 +1,615 @@
+package msi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	CABINET_SIGNATURE = "MSCF"
+
+	cabFlagPrevCabinet    uint16 = 0x0001
+	cabFlagNextCabinet    uint16 = 0x0002
+	cabFlagReservePresent uint16 = 0x0004
+
+	cabFolderContinuedFromPrev    uint16 = 0xfffd
+	cabFolderContinuedToNext      uint16 = 0xfffe
+	cabFolderContinuedPrevAndNext uint16 = 0xffff
+
+	cabAttributeNameIsUTF uint16 = 0x80
+
+	// Every data block holds at most this many uncompressed bytes.
+	cabMaxBlockSize = 32768
+)
+
+type CabinetCompression int
+
+const (
+	CabinetCompressionNone CabinetCompression = iota
+	CabinetCompressionMSZIP
+	CabinetCompressionQuantum
+	CabinetCompressionLZX
+)
+
+func (c CabinetCompression) String() string {
+	switch c {
+	case CabinetCompressionNone:
+		return "None"
+	case CabinetCompressionMSZIP:
+		return "MSZIP"
+	case CabinetCompressionQuantum:
+		return "Quantum"
+	case CabinetCompressionLZX:
+		return "LZX"
+	default:
+		return "Unknown"
+	}
+}
+
+// A cabinet (.cab) archive, as used for the payload of MSI packages. A
+// cabinet may be one of a set, in which case its last folder can continue
+// into the next cabinet.
+type Cabinet struct {
+	SetID        uint16
+	Index        uint16
+	PrevCabinet  string
+	PrevDisk     string
+	NextCabinet  string
+	NextDisk     string
+	Folders      []*CabinetFolder
+	Files        []*CabinetFile
+	dataReserved int
+	rdr          io.ReadSeeker
+}
+
+// A folder is a run of data blocks compressed as a single stream.
+type CabinetFolder struct {
+	Compression CabinetCompression
+	// The LZX window size as a power of two, or zero for other methods.
+	WindowBits int
+	offset     uint32
+	numBlocks  uint16
+	cabinet    *Cabinet
+}
+
+type CabinetFile struct {
+	Name       string
+	Size       uint32
+	Modified   time.Time
+	Attributes uint16
+	// The uncompressed offset of the file within its folder.
+	Offset      uint32
+	FolderIndex uint16
+}
+
+// Returns true if the file started in a previous cabinet of the set, in
+// which case the same file is also listed by that cabinet.
+func (f *CabinetFile) IsContinuedFromPrev() bool {
+	return f.FolderIndex == cabFolderContinuedFromPrev || f.FolderIndex == cabFolderContinuedPrevAndNext
+}
+
+// Returns true if the file's data continues into the next cabinet.
+func (f *CabinetFile) IsContinuedToNext() bool {
+	return f.FolderIndex == cabFolderContinuedToNext || f.FolderIndex == cabFolderContinuedPrevAndNext
+}
+
+// Opens a cabinet and reads its folder and file lists.
+func OpenCabinet(rdr io.ReadSeeker) (*Cabinet, error) {
+	_, err := rdr.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		Signature    [4]byte
+		Reserved1    uint32
+		Size         uint32
+		Reserved2    uint32
+		FilesOffset  uint32
+		Reserved3    uint32
+		VersionMinor uint8
+		VersionMajor uint8
+		NumFolders   uint16
+		NumFiles     uint16
+		Flags        uint16
+		SetID        uint16
+		Index        uint16
+	}
+	err = binary.Read(rdr, binary.LittleEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(header.Signature[:]) != CABINET_SIGNATURE {
+		return nil, fmt.Errorf("invalid cabinet signature")
+	}
+
+	if header.VersionMajor != 1 || header.VersionMinor != 3 {
+		return nil, fmt.Errorf("unsupported cabinet version: %d.%d", header.VersionMajor, header.VersionMinor)
+	}
+
+	cab := &Cabinet{
+		SetID:   header.SetID,
+		Index:   header.Index,
+		Folders: make([]*CabinetFolder, 0, header.NumFolders),
+		Files:   make([]*CabinetFile, 0, header.NumFiles),
+		rdr:     rdr,
+	}
+
+	folderReserved := 0
+	if header.Flags&cabFlagReservePresent != 0 {
+		var reserve struct {
+			Header uint16
+			Folder uint8
+			Data   uint8
+		}
+		err = binary.Read(rdr, binary.LittleEndian, &reserve)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = rdr.Seek(int64(reserve.Header), io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		folderReserved = int(reserve.Folder)
+		cab.dataReserved = int(reserve.Data)
+	}
+
+	if header.Flags&cabFlagPrevCabinet != 0 {
+		cab.PrevCabinet, err = readCString(rdr)
+		if err != nil {
+			return nil, err
+		}
+		cab.PrevDisk, err = readCString(rdr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if header.Flags&cabFlagNextCabinet != 0 {
+		cab.NextCabinet, err = readCString(rdr)
+		if err != nil {
+			return nil, err
+		}
+		cab.NextDisk, err = readCString(rdr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i < int(header.NumFolders); i++ {
+		var entry struct {
+			Offset      uint32
+			NumBlocks   uint16
+			Compression uint16
+		}
+		err = binary.Read(rdr, binary.LittleEndian, &entry)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = rdr.Seek(int64(folderReserved), io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		folder := &CabinetFolder{
+			Compression: CabinetCompression(entry.Compression & 0x000f),
+			offset:      entry.Offset,
+			numBlocks:   entry.NumBlocks,
+			cabinet:     cab,
+		}
+		if folder.Compression == CabinetCompressionLZX {
+			folder.WindowBits = int(entry.Compression>>8) & 0x1f
+		}
+		cab.Folders = append(cab.Folders, folder)
+	}
+
+	_, err = rdr.Seek(int64(header.FilesOffset), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < int(header.NumFiles); i++ {
+		var entry struct {
+			Size        uint32
+			Offset      uint32
+			FolderIndex uint16
+			Date        uint16
+			Time        uint16
+			Attributes  uint16
+		}
+		err = binary.Read(rdr, binary.LittleEndian, &entry)
+		if err != nil {
+			return nil, err
+		}
+
+		name, err := readCString(rdr)
+		if err != nil {
+			return nil, err
+		}
+
+		// Names not flagged as UTF-8 use the system code page.
+		if entry.Attributes&cabAttributeNameIsUTF == 0 {
+			name, err = Windows1252.Decode([]byte(name))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if entry.FolderIndex < cabFolderContinuedFromPrev && int(entry.FolderIndex) >= len(cab.Folders) {
+			return nil, fmt.Errorf("file %s has invalid folder index %d", name, entry.FolderIndex)
+		}
+
+		cab.Files = append(cab.Files, &CabinetFile{
+			Name:        name,
+			Size:        entry.Size,
+			Modified:    timeFromDosDateTime(entry.Date, entry.Time),
+			Attributes:  entry.Attributes,
+			Offset:      entry.Offset,
+			FolderIndex: entry.FolderIndex,
+		})
+	}
+
+	return cab, nil
+}
+
+// Extracts the files of a cabinet set, starting from the given cabinet and
+// following the chain of next cabinets, which are located with the open
+// function. Files spanning cabinets are reported once, and fn receives the
+// files in the order they are stored. Readers returned by open that
+// implement io.Closer are closed before ExtractCabinet returns.
+func ExtractCabinet(cab *Cabinet, open func(name string) (io.ReadSeeker, error), fn func(file *CabinetFile, data io.Reader) error) error {
+	opened := make([]io.ReadSeeker, 0)
+	defer func() {
+		for _, rdr := range opened {
+			if closer, ok := rdr.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	}()
+
+	folders, err := collectCabinetFolders(cab, func(name string) (io.ReadSeeker, error) {
+		rdr, err := open(name)
+		if err == nil {
+			opened = append(opened, rdr)
+		}
+		return rdr, err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, folder := range folders {
+		err = folder.extract(fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A folder as seen by the decompressor, made of one folder from each
+// cabinet it spans.
+type cabLogicalFolder struct {
+	segments []*CabinetFolder
+	files    []*CabinetFile
+}
+
+func collectCabinetFolders(cab *Cabinet, open func(name string) (io.ReadSeeker, error)) ([]*cabLogicalFolder, error) {
+	folders := make([]*cabLogicalFolder, 0)
+	var continuing *cabLogicalFolder
+	visited := make(map[string]struct{})
+
+	for cab != nil {
+		logical := make([]*cabLogicalFolder, len(cab.Folders))
+		for i, folder := range cab.Folders {
+			if i == 0 && continuing != nil {
+				continuing.segments = append(continuing.segments, folder)
+				logical[i] = continuing
+				continue
+			}
+
+			logical[i] = &cabLogicalFolder{segments: []*CabinetFolder{folder}}
+			folders = append(folders, logical[i])
+		}
+
+		hasNext := false
+		for _, file := range cab.Files {
+			if file.IsContinuedToNext() {
+				hasNext = true
+			}
+
+			switch file.FolderIndex {
+			case cabFolderContinuedFromPrev, cabFolderContinuedPrevAndNext:
+				// Already listed by the cabinet the file started in.
+			case cabFolderContinuedToNext:
+				if len(logical) == 0 {
+					return nil, fmt.Errorf("cabinet has files but no folders")
+				}
+				last := logical[len(logical)-1]
+				last.files = append(last.files, file)
+			default:
+				logical[file.FolderIndex].files = append(logical[file.FolderIndex].files, file)
+			}
+		}
+
+		// The last folder continues into the next cabinet when one of its
+		// files does.
+		continuing = nil
+		if hasNext {
+			continuing = logical[len(logical)-1]
+		}
+
+		if cab.NextCabinet == "" {
+			if hasNext {
+				return nil, fmt.Errorf("cabinet continues but names no next cabinet")
+			}
+			break
+		}
+
+		if _, ok := visited[cab.NextCabinet]; ok {
+			return nil, fmt.Errorf("cabinet set has a cycle")
+		}
+		visited[cab.NextCabinet] = struct{}{}
+
+		if open == nil {
+			return nil, fmt.Errorf("cabinet %s is required but no resolver was given", cab.NextCabinet)
+		}
+
+		rdr, err := open(cab.NextCabinet)
+		if err != nil {
+			return nil, err
+		}
+
+		next, err := OpenCabinet(rdr)
+		if err != nil {
+			return nil, fmt.Errorf("cabinet %s: %v", cab.NextCabinet, err)
+		}
+
+		if next.SetID != cab.SetID {
+			return nil, fmt.Errorf("cabinet %s is not part of the same set", cab.NextCabinet)
+		}
+
+		if continuing != nil && !next.startsWithContinuedFolder() {
+			return nil, fmt.Errorf("cabinet %s does not continue the previous folder", cab.NextCabinet)
+		}
+
+		cab = next
+	}
+
+	return folders, nil
+}
+
+func (c *Cabinet) startsWithContinuedFolder() bool {
+	for _, file := range c.Files {
+		if file.IsContinuedFromPrev() {
+			return len(c.Folders) > 0
+		}
+	}
+
+	return false
+}
+
+func (l *cabLogicalFolder) extract(fn func(file *CabinetFile, data io.Reader) error) error {
+	if len(l.files) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(l.files, func(i, j int) bool {
+		return l.files[i].Offset < l.files[j].Offset
+	})
+
+	rdr, err := newCabFolderReader(l.segments)
+	if err != nil {
+		return err
+	}
+
+	var position int64
+	for _, file := range l.files {
+		if int64(file.Offset) < position {
+			return fmt.Errorf("file %s overlaps the previous file", file.Name)
+		}
+
+		_, err = io.CopyN(io.Discard, rdr, int64(file.Offset)-position)
+		if err != nil {
+			return fmt.Errorf("file %s: %v", file.Name, err)
+		}
+
+		data := &io.LimitedReader{R: rdr, N: int64(file.Size)}
+		err = fn(file, data)
+		if err != nil {
+			return err
+		}
+
+		// Skip whatever the callback did not read.
+		_, err = io.Copy(io.Discard, data)
+		if err != nil {
+			return fmt.Errorf("file %s: %v", file.Name, err)
+		}
+		if data.N != 0 {
+			return fmt.Errorf("file %s: unexpected end of folder", file.Name)
+		}
+
+		position = int64(file.Offset) + int64(file.Size)
+	}
+
+	return nil
+}
+
+// Decompresses the data blocks of a folder, possibly spanning cabinets.
+type cabFolderReader struct {
+	segments     []*CabinetFolder
+	segmentIndex int
+	blockIndex   int
+	nextOffset   int64
+	decompressor cabDecompressor
+	pending      []byte
+}
+
+type cabDecompressor interface {
+	// Decompresses one data block into the given number of bytes.
+	decompress(data []byte, size int) ([]byte, error)
+}
+
+func newCabFolderReader(segments []*CabinetFolder) (*cabFolderReader, error) {
+	first := segments[0]
+	for _, segment := range segments[1:] {
+		if segment.Compression != first.Compression || segment.WindowBits != first.WindowBits {
+			return nil, fmt.Errorf("continued folder uses a different compression method")
+		}
+	}
+
+	var decompressor cabDecompressor
+	switch first.Compression {
+	case CabinetCompressionNone:
+		decompressor = storedDecompressor{}
+	case CabinetCompressionMSZIP:
+		decompressor = newMSZIPDecompressor()
+	case CabinetCompressionLZX:
+		lzx, err := newLZXDecompressor(first.WindowBits)
+		if err != nil {
+			return nil, err
+		}
+		decompressor = lzx
+	default:
+		return nil, fmt.Errorf("unsupported cabinet compression: %s", first.Compression)
+	}
+
+	return &cabFolderReader{
+		segments:     segments,
+		nextOffset:   int64(first.offset),
+		decompressor: decompressor,
+	}, nil
+}
+
+func (r *cabFolderReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		compressed, size, err := r.readBlock()
+		if err != nil {
+			return 0, err
+		}
+
+		r.pending, err = r.decompressor.decompress(compressed, size)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+
+	return n, nil
+}
+
+// Reads the next data block, joining blocks split across cabinets.
+func (r *cabFolderReader) readBlock() ([]byte, int, error) {
+	compressed := make([]byte, 0)
+	for {
+		if r.segmentIndex >= len(r.segments) {
+			if len(compressed) > 0 {
+				return nil, 0, fmt.Errorf("data block continues past the last cabinet")
+			}
+			return nil, 0, io.EOF
+		}
+
+		segment := r.segments[r.segmentIndex]
+		if r.blockIndex >= int(segment.numBlocks) {
+			r.segmentIndex++
+			r.blockIndex = 0
+			if r.segmentIndex < len(r.segments) {
+				r.nextOffset = int64(r.segments[r.segmentIndex].offset)
+			}
+			continue
+		}
+
+		rdr := segment.cabinet.rdr
+		_, err := rdr.Seek(r.nextOffset, io.SeekStart)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var header struct {
+			Checksum         uint32
+			CompressedSize   uint16
+			UncompressedSize uint16
+		}
+		err = binary.Read(rdr, binary.LittleEndian, &header)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		_, err = rdr.Seek(int64(segment.cabinet.dataReserved), io.SeekCurrent)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		data := make([]byte, header.CompressedSize)
+		_, err = io.ReadFull(rdr, data)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		r.nextOffset += int64(8+segment.cabinet.dataReserved) + int64(header.CompressedSize)
+		r.blockIndex++
+		compressed = append(compressed, data...)
+
+		// A block with no uncompressed size continues in the next cabinet.
+		if header.UncompressedSize != 0 {
+			if header.UncompressedSize > cabMaxBlockSize {
+				return nil, 0, fmt.Errorf("data block is too large: %d", header.UncompressedSize)
+			}
+			return compressed, int(header.UncompressedSize), nil
+		}
+	}
+}
+
+type storedDecompressor struct{}
+
+func (storedDecompressor) decompress(data []byte, size int) ([]byte, error) {
+	if len(data) != size {
+		return nil, fmt.Errorf("stored block has %d bytes, expected %d", len(data), size)
+	}
+
+	return data, nil
+}
+
+func readCString(rdr io.Reader) (string, error) {
+	buf := new(bytes.Buffer)
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(rdr, b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return buf.String(), nil
+		}
+		if buf.Len() >= 256 {
+			return "", fmt.Errorf("string is too long")
+		}
+		buf.WriteByte(b[0])
+	}
+}
+
+// Converts an MS-DOS date and time into a time, in local time as the
+// cabinet format stores no time zone.
+func timeFromDosDateTime(date uint16, tm uint16) time.Time {
+	return time.Date(
+		int(date>>9)+1980,
+		time.Month((date>>5)&0x0f),
+		int(date&0x1f),
+		int(tm>>11),
+		int((tm>>5)&0x3f),
+		int(tm&0x1f)*2,
+		0,
+		time.Local,
+	)
+}
@@ -0,0 +1,129 @@
+package msi
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The golden cabinets are written by testdata/gencab.go, along with the
+// files they hold. The makecab-*.cab cabinets hold the same files but are
+// built by Windows' makecab from the makecab-*.ddf directive files next to
+// them.
+var cabinetTestFiles = []string{"readme.txt", "data.bin", "empty.txt"}
+
+func readCabinetTestData(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "cabinet", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestExtractCabinet(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression CabinetCompression
+		windowBits  int
+	}{
+		{"stored.cab", CabinetCompressionNone, 0},
+		{"mszip.cab", CabinetCompressionMSZIP, 0},
+		{"lzx.cab", CabinetCompressionLZX, 16},
+		{"makecab-mszip.cab", CabinetCompressionMSZIP, 0},
+		{"makecab-lzx21.cab", CabinetCompressionLZX, 21},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := os.Stat(filepath.Join("testdata", "cabinet", tt.name)); os.IsNotExist(err) && strings.HasPrefix(tt.name, "makecab-") {
+				t.Skipf("%s has not been built with makecab yet", tt.name)
+			}
+
+			cab, err := OpenCabinet(bytes.NewReader(readCabinetTestData(t, tt.name)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(cab.Folders) != 1 {
+				t.Fatalf("got %d folders, want 1", len(cab.Folders))
+			}
+			if cab.Folders[0].Compression != tt.compression || cab.Folders[0].WindowBits != tt.windowBits {
+				t.Errorf("got compression %v with window bits %d, want %v with %d",
+					cab.Folders[0].Compression, cab.Folders[0].WindowBits, tt.compression, tt.windowBits)
+			}
+
+			// Cabinets store local MS-DOS times.
+			modified := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+			names := make([]string, 0)
+			err = ExtractCabinet(cab, nil, func(file *CabinetFile, data io.Reader) error {
+				names = append(names, file.Name)
+
+				got, err := io.ReadAll(data)
+				if err != nil {
+					return err
+				}
+				if want := readCabinetTestData(t, file.Name); !bytes.Equal(got, want) {
+					t.Errorf("%s: got %d bytes that differ from the %d expected", file.Name, len(got), len(want))
+				}
+				if !file.Modified.Equal(modified) {
+					t.Errorf("%s: got modification time %v, want %v", file.Name, file.Modified, modified)
+				}
+
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(names) != len(cabinetTestFiles) {
+				t.Fatalf("got files %v, want %v", names, cabinetTestFiles)
+			}
+			for i, name := range cabinetTestFiles {
+				if names[i] != name {
+					t.Errorf("got files %v, want %v", names, cabinetTestFiles)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestExtractCabinetTruncated(t *testing.T) {
+	for _, name := range []string{"stored.cab", "mszip.cab", "lzx.cab"} {
+		data := readCabinetTestData(t, name)
+
+		tests := []struct {
+			name string
+			size int
+		}{
+			{"header", 20},
+			{"file list", 60},
+			{"data", len(data) / 2},
+			{"last block", len(data) - 1},
+		}
+
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				cab, err := OpenCabinet(bytes.NewReader(data[:tt.size]))
+				if err != nil {
+					return
+				}
+
+				err = ExtractCabinet(cab, nil, func(file *CabinetFile, data io.Reader) error {
+					_, err := io.ReadAll(data)
+					return err
+				})
+				if err == nil {
+					t.Errorf("extracting a cabinet truncated to %d of %d bytes succeeded", tt.size, len(data))
+				}
+			})
+		}
+	}
+}
@@ -1,5 +1,11 @@
 package msi
 
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
 type Category int
 
 const (
@@ -313,3 +319,244 @@ func CategoryFromString(str string) Category {
 		return -1
 	}
 }
+
+// Returns true if the string is a valid value for this category. Integer
+// values are checked in their decimal form. Categories whose values are
+// only checked at install time, such as Text and Binary, accept anything.
+func (c Category) Validate(str string) bool {
+	switch c {
+	case CategoryUpperCase:
+		return strings.IndexFunc(str, func(ch rune) bool { return ch >= 'a' && ch <= 'z' }) == -1
+	case CategoryLowerCase:
+		return strings.IndexFunc(str, func(ch rune) bool { return ch >= 'A' && ch <= 'Z' }) == -1
+	case CategoryInteger:
+		_, err := strconv.ParseInt(str, 10, 16)
+		return err == nil
+	case CategoryDoubleInteger:
+		_, err := strconv.ParseInt(str, 10, 32)
+		return err == nil
+	case CategoryTimeDate:
+		num, err := strconv.ParseInt(str, 10, 32)
+		return err == nil && isValidTimeDate(uint32(num))
+	case CategoryIdentifier, CategoryCustomSource:
+		return isIdentifier(str)
+	case CategoryProperty:
+		return isIdentifier(strings.TrimPrefix(str, "%"))
+	case CategoryFilename:
+		return isValidFilename(str, false)
+	case CategoryWildCardFilename:
+		return isValidFilename(str, true)
+	case CategoryPath:
+		return isValidPath(str)
+	case CategoryPaths:
+		for _, path := range strings.Split(str, ";") {
+			if !isValidPath(path) {
+				return false
+			}
+		}
+		return true
+	case CategoryAnyPath:
+		stripped := stripPropertyReferences(str)
+		return !strings.ContainsAny(stripped, `<>"*?`) && strings.Count(stripped, "|") <= 1
+	case CategoryDefaultDir:
+		target, source := SplitDefaultDir(str)
+		return isValidDefaultDirPart(target) && isValidDefaultDirPart(source)
+	case CategoryRegPath:
+		return !strings.HasPrefix(str, `\`)
+	case CategoryFormatted, CategoryFormattedSddlText, CategoryTemplate:
+		return isValidFormatted(str)
+	case CategoryCondition:
+		_, err := ParseCondition(str)
+		return err == nil
+	case CategoryGuid:
+		return isValidGUID(str)
+	case CategoryVersion:
+		parts := strings.Split(str, ".")
+		if len(parts) > 4 {
+			return false
+		}
+		for _, part := range parts {
+			if !isDecimal(part) {
+				return false
+			}
+			if _, err := strconv.ParseUint(part, 10, 16); err != nil {
+				return false
+			}
+		}
+		return true
+	case CategoryLanguage:
+		for _, part := range strings.Split(str, ",") {
+			if !isDecimal(part) {
+				return false
+			}
+			if _, err := strconv.ParseUint(part, 10, 16); err != nil {
+				return false
+			}
+		}
+		return true
+	case CategoryCabinet:
+		if strings.HasPrefix(str, "#") {
+			return isIdentifier(str[1:])
+		}
+		return isValidShortName(str, false)
+	case CategoryShortcut:
+		if strings.Contains(str, "[") {
+			return isValidFormatted(str)
+		}
+		return isIdentifier(str)
+	default:
+		return true
+	}
+}
+
+// Returns true if the string is a short file name, or a "short|long" pair.
+func isValidFilename(str string, wildcards bool) bool {
+	idx := strings.Index(str, "|")
+	if idx == -1 {
+		return isValidShortName(str, wildcards)
+	}
+
+	return isValidShortName(str[:idx], wildcards) && isValidLongName(str[idx+1:], wildcards)
+}
+
+// Returns true if the string is an 8.3 file name.
+func isValidShortName(str string, wildcards bool) bool {
+	invalid := `\?|><:/*"+,;=[] ` + "\t"
+	if wildcards {
+		invalid = `\|><:/"+,;=[] ` + "\t"
+	}
+	if str == "" || strings.ContainsAny(str, invalid) {
+		return false
+	}
+
+	parts := strings.Split(str, ".")
+	switch len(parts) {
+	case 1:
+		return len(parts[0]) <= 8
+	case 2:
+		return parts[0] != "" && len(parts[0]) <= 8 && len(parts[1]) <= 3
+	default:
+		return false
+	}
+}
+
+func isValidLongName(str string, wildcards bool) bool {
+	invalid := `\?|><:/*"`
+	if wildcards {
+		invalid = `\|><:/"`
+	}
+
+	return str != "" && utf8.RuneCountInString(str) <= 255 && !strings.ContainsAny(str, invalid) &&
+		strings.Trim(str, ". ") != ""
+}
+
+// Each part of a DefaultDir is a file name, "." for the parent directory,
+// or, for root directories, an identifier such as SourceDir.
+func isValidDefaultDirPart(str string) bool {
+	if str == "." || isIdentifier(str) || isValidFilename(str, false) {
+		return true
+	}
+
+	idx := strings.Index(str, "|")
+	return idx != -1 && str[:idx] == "." && isValidLongName(str[idx+1:], false)
+}
+
+// A full path is rooted at a drive or a UNC share, or starts with a
+// property reference that resolves to one.
+func isValidPath(str string) bool {
+	rooted := strings.HasPrefix(str, "[") || strings.HasPrefix(str, `\\`) ||
+		(len(str) >= 3 && isASCIILetter(rune(str[0])) && str[1] == ':' && str[2] == '\\')
+	if !rooted {
+		return false
+	}
+
+	return !strings.ContainsAny(stripPropertyReferences(str), `<>"|*?`)
+}
+
+// Returns true if every opening bracket of a formatted string is closed.
+func isValidFormatted(str string) bool {
+	var check func(segments []*FormattedSegment) bool
+	check = func(segments []*FormattedSegment) bool {
+		for _, segment := range segments {
+			if segment.Kind == FormattedLiteral && strings.Contains(segment.Text, "[") {
+				return false
+			}
+			if !check(segment.Children) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return check(TokenizeFormatted(str))
+}
+
+// Removes [...] references, which may expand to anything.
+func stripPropertyReferences(str string) string {
+	out := strings.Builder{}
+	for _, segment := range TokenizeFormatted(str) {
+		if segment.Kind == FormattedLiteral {
+			out.WriteString(segment.Text)
+		}
+	}
+
+	return out.String()
+}
+
+// Returns true for an uppercase GUID enclosed in braces.
+func isValidGUID(str string) bool {
+	if len(str) != 38 || str[0] != '{' || str[37] != '}' {
+		return false
+	}
+
+	for i, ch := range str[1:37] {
+		switch i {
+		case 8, 13, 18, 23:
+			if ch != '-' {
+				return false
+			}
+		default:
+			if !(ch >= '0' && ch <= '9') && !(ch >= 'A' && ch <= 'F') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// The date is in the high word, as days, months and years since 1980, and
+// the time in the low word, as two-second units, minutes and hours.
+func isValidTimeDate(value uint32) bool {
+	if value == 0 {
+		return true
+	}
+
+	date := value >> 16
+	day := date & 0x1f
+	month := (date >> 5) & 0xf
+	clock := value & 0xffff
+	seconds := (clock & 0x1f) * 2
+	minutes := (clock >> 5) & 0x3f
+	hours := clock >> 11
+
+	return day >= 1 && month >= 1 && month <= 12 && hours < 24 && minutes < 60 && seconds < 60
+}
+
+func isDecimal(str string) bool {
+	if str == "" {
+		return false
+	}
+
+	for _, ch := range str {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isASCIILetter(ch rune) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
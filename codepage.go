@@ -9,6 +9,7 @@ import (
 	"golang.org/x/text/encoding/korean"
 	"golang.org/x/text/encoding/simplifiedchinese"
 	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
 )
 
 type CodePage int
@@ -67,6 +68,9 @@ const (
 	Iso88598
 	/// [UTF-8](https://en.wikipedia.org/wiki/UTF-8)
 	Utf8
+	/// [UTF-16 (little endian)](https://en.wikipedia.org/wiki/UTF-16), which
+	/// only property sets use
+	Utf16
 )
 
 // Returns the code page (if any) with the given ID number.
@@ -126,6 +130,8 @@ func CodePageFromID(id int) CodePage {
 		return Iso88598
 	case 65001:
 		return Utf8
+	case 1200:
+		return Utf16
 	default:
 		return -1
 	}
@@ -190,12 +196,18 @@ func (c CodePage) ID() int {
 		return 28598
 	case Utf8:
 		return 65001
+	case Utf16:
+		return 1200
 	default:
 		return -1
 	}
 }
 
 func (c CodePage) Decode(data []byte) (string, error) {
+	if c == Utf8 || c == UsAscii {
+		return string(data), nil
+	}
+
 	enc := c.Encoding()
 	if enc == nil {
 		return "", fmt.Errorf("unsupported code page: %d", c)
@@ -210,11 +222,30 @@ func (c CodePage) Decode(data []byte) (string, error) {
 	return string(result), nil
 }
 
+func (c CodePage) Encode(str string) ([]byte, error) {
+	if c == Utf8 || c == UsAscii {
+		return []byte(str), nil
+	}
+
+	enc := c.Encoding()
+	if enc == nil {
+		return nil, fmt.Errorf("unsupported code page: %d", c)
+	}
+
+	enco := enc.NewEncoder()
+	result, err := enco.Bytes([]byte(str))
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func (c CodePage) Encoding() encoding.Encoding {
 
 	switch c {
 	case Windows932:
-		return japanese.EUCJP
+		return japanese.ShiftJIS
 	case Windows936:
 		return simplifiedchinese.GBK
 	case Windows949:
@@ -265,6 +296,8 @@ func (c CodePage) Encoding() encoding.Encoding {
 		return charmap.ISO8859_8
 	case Utf8:
 		return nil
+	case Utf16:
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
 	default:
 		return nil
 	}
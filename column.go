@@ -3,8 +3,9 @@ package msi
 import (
 	"encoding/binary"
 	"fmt"
-
-	"github.com/asalih/go-mscfb"
+	"io"
+	"strconv"
+	"unicode/utf8"
 )
 
 const (
@@ -57,7 +58,7 @@ func (c ColumnType) Width(longStringRefs bool) uint64 {
 	return 0
 }
 
-func (c ColumnType) ReadValue(stream *mscfb.Stream, longStringRefs bool) (*ValueRef, error) {
+func (c ColumnType) ReadValue(stream io.Reader, longStringRefs bool) (*ValueRef, error) {
 	switch c {
 	case ColumnTypeInt16:
 		var value int16
@@ -107,6 +108,50 @@ func (c ColumnType) ReadValue(stream *mscfb.Stream, longStringRefs bool) (*Value
 	return nil, nil
 }
 
+func (c ColumnType) WriteValue(w io.Writer, value *ValueRef, longStringRefs bool) error {
+	switch c {
+	case ColumnTypeInt16:
+		var stored int16
+		if !value.IsNull {
+			stored = int16(value.Value.(int)) ^ -0x8000
+		}
+		return binary.Write(w, binary.LittleEndian, stored)
+	case ColumnTypeInt32:
+		var stored int32
+		if !value.IsNull {
+			stored = int32(value.Value.(int)) ^ -0x8000_0000
+		}
+		return binary.Write(w, binary.LittleEndian, stored)
+	case ColumnTypeStr:
+		var ref StringRef
+		if !value.IsNull {
+			ref = value.Value.(StringRef)
+		}
+		return ref.Write(w, longStringRefs)
+	}
+
+	return fmt.Errorf("invalid column type: %d", c)
+}
+
+// Returns the type bits stored in the _Columns table for this column type.
+func (c ColumnType) BitField(size int, isBinary bool) int32 {
+	switch c {
+	case ColumnTypeInt16:
+		// Windows Installer marks short integer columns as non-binary.
+		return COL_VALID_BIT | COL_NONBINARY_BIT | 2
+	case ColumnTypeInt32:
+		return COL_VALID_BIT | 4
+	case ColumnTypeStr:
+		bits := COL_VALID_BIT | COL_STRING_BIT | (int32(size) & COL_FIELD_SIZE_MASK)
+		if !isBinary {
+			bits |= COL_NONBINARY_BIT
+		}
+		return bits
+	}
+
+	return 0
+}
+
 type valueRange struct {
 	Min int32
 	Max int32
@@ -124,8 +169,81 @@ type Column struct {
 	IsLocalizable    bool
 	IsNullable       bool
 	IsPrimarykey     bool
-	ValueRange       valueRange
+	ValueRange       *valueRange
 	ForeignKey       foreignKey
 	Category         Category
 	EnumValues       []string
 }
+
+// Returns the type bits stored in the _Columns table for this column.
+func (c *Column) BitField() int32 {
+	bits := c.ColumnType.BitField(c.ColumnStringSize, c.Category == CategoryBinary)
+	if c.IsPrimarykey {
+		bits |= COL_PRIMARY_KEY_BIT
+	}
+	if c.IsNullable {
+		bits |= COL_NULLABLE_BIT
+	}
+	if c.IsLocalizable {
+		bits |= COL_LOCALIZABLE_BIT
+	}
+
+	return bits
+}
+
+// Returns true if the given value can be stored in this column. Integer
+// values must be within the column's type and range, strings must fit the
+// column's size, and both must match the column's enum values, if any.
+func (c *Column) IsValidValue(value Value) bool {
+	if value == nil {
+		return c.IsNullable
+	}
+
+	switch v := value.(type) {
+	case int:
+		switch c.ColumnType {
+		case ColumnTypeInt16:
+			if v < -0x7fff || v > 0x7fff {
+				return false
+			}
+		case ColumnTypeInt32:
+			if v < -0x7fff_ffff || v > 0x7fff_ffff {
+				return false
+			}
+		default:
+			return false
+		}
+
+		if c.ValueRange != nil && (v < int(c.ValueRange.Min) || v > int(c.ValueRange.Max)) {
+			return false
+		}
+
+		return c.isEnumValue(strconv.Itoa(v))
+	case string:
+		if c.ColumnType != ColumnTypeStr {
+			return false
+		}
+
+		if c.ColumnStringSize > 0 && utf8.RuneCountInString(v) > c.ColumnStringSize {
+			return false
+		}
+
+		return c.isEnumValue(v)
+	}
+
+	return false
+}
+
+func (c *Column) isEnumValue(value string) bool {
+	if len(c.EnumValues) == 0 {
+		return true
+	}
+
+	for _, enumValue := range c.EnumValues {
+		if enumValue == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,11 +1,16 @@
 package msi
 
+import (
+	"fmt"
+	"strings"
+)
+
 type ColumnBuilder struct {
 	Name          string
 	IsLocalizable bool
 	IsNullable    bool
 	IsPrimarykey  bool
-	ValueRange    valueRange
+	ValueRange    *valueRange
 	ForeignKey    foreignKey
 	Category      Category
 	EnumValues    []string
@@ -38,7 +43,7 @@ func (b *ColumnBuilder) SetPrimaryKey() *ColumnBuilder {
 
 // Makes the column only permit values in the given range.
 func (b *ColumnBuilder) SetRange(min, max int32) *ColumnBuilder {
-	b.ValueRange = valueRange{Min: min, Max: max}
+	b.ValueRange = &valueRange{Min: min, Max: max}
 	return b
 }
 
@@ -126,6 +131,17 @@ func (b *ColumnBuilder) withBitFields(typeBits int32) (*Column, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Only string columns have a size; the field size of integer columns
+	// is implied by their type, as for columns made by the builder.
+	if colType != ColumnTypeStr {
+		size = 0
+	}
+
+	// String columns without the non-binary bit refer to binary streams.
+	category := b.Category
+	if colType == ColumnTypeStr && typeBits&COL_NONBINARY_BIT == 0 {
+		category = CategoryBinary
+	}
 
 	return &Column{
 		Name:             b.Name,
@@ -136,7 +152,42 @@ func (b *ColumnBuilder) withBitFields(typeBits int32) (*Column, error) {
 		IsPrimarykey:     typeBits&COL_PRIMARY_KEY_BIT != 0,
 		ValueRange:       b.ValueRange,
 		ForeignKey:       b.ForeignKey,
-		Category:         b.Category,
+		Category:         category,
 		EnumValues:       b.EnumValues,
 	}, nil
 }
+
+// Applies the Nullable, MinValue, MaxValue, KeyTable, KeyColumn, Category
+// and Set columns of a _Validation row.
+func (b *ColumnBuilder) applyValidationRow(values []Value) error {
+	if nullable, _ := values[2].(string); nullable == "Y" {
+		b.SetNullable()
+	}
+
+	minValue, minOk := values[3].(int)
+	maxValue, maxOk := values[4].(int)
+	if minOk && maxOk {
+		b.SetRange(int32(minValue), int32(maxValue))
+	}
+
+	keyTable, tableOk := values[5].(string)
+	keyColumn, columnOk := values[6].(int)
+	if tableOk && columnOk {
+		b.SetForeignKey(keyTable, int32(keyColumn))
+	}
+
+	if categoryValue, ok := values[7].(string); ok {
+		c := CategoryFromString(categoryValue)
+		if c == -1 {
+			return fmt.Errorf("invalid category value: %s", categoryValue)
+		}
+
+		b.SetCategory(c)
+	}
+
+	if enumValues, ok := values[8].(string); ok {
+		b.SetEnumValues(strings.Split(enumValues, ";")...)
+	}
+
+	return nil
+}
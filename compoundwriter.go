@@ -0,0 +1,504 @@
+package msi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/asalih/go-mscfb"
+	"github.com/google/uuid"
+)
+
+const (
+	cfbVersion            uint16 = 3
+	cfbSectorShift        uint16 = 9
+	cfbSectorLen          int    = 1 << cfbSectorShift
+	cfbEntriesPerSector   int    = cfbSectorLen / 4
+	cfbDirEntriesPerSect  int    = cfbSectorLen / 128
+	cfbMaxNameLen         int    = 31
+	cfbDifatEntriesPerSec int    = cfbEntriesPerSector - 1
+)
+
+type compoundNode struct {
+	Name     string
+	IsStream bool
+	CLSID    uuid.UUID
+	Data     []byte
+	Children []*compoundNode
+}
+
+// Builds a version 3 compound file from in-memory streams and storages. The
+// go-mscfb reader has no write support, so packages are always serialized as
+// a whole.
+type compoundWriter struct {
+	root *compoundNode
+}
+
+func newCompoundWriter(rootCLSID uuid.UUID) *compoundWriter {
+	return &compoundWriter{
+		root: &compoundNode{
+			Name:  mscfb.ROOT_DIR_NAME,
+			CLSID: rootCLSID,
+		},
+	}
+}
+
+// Adds a storage at the given path, creating any missing parent storages.
+func (c *compoundWriter) AddStorage(path string, clsid uuid.UUID) error {
+	node, err := c.node(mscfb.NameChainFromPath(path), true)
+	if err != nil {
+		return err
+	}
+
+	if node.IsStream {
+		return fmt.Errorf("%s is a stream", path)
+	}
+	node.CLSID = clsid
+
+	return nil
+}
+
+// Adds a stream at the given path, creating any missing parent storages. An
+// existing stream at the same path is replaced.
+func (c *compoundWriter) AddStream(path string, data []byte) error {
+	names := mscfb.NameChainFromPath(path)
+	if len(names) == 0 {
+		return fmt.Errorf("invalid stream path: %s", path)
+	}
+
+	parent, err := c.node(names[:len(names)-1], true)
+	if err != nil {
+		return err
+	}
+	if parent.IsStream {
+		return fmt.Errorf("%s is a stream", mscfb.PathFromNameChain(names[:len(names)-1]))
+	}
+
+	name := names[len(names)-1]
+	if len(utf16.Encode([]rune(name))) > cfbMaxNameLen {
+		return fmt.Errorf("stream name is too long: %s", name)
+	}
+
+	for _, child := range parent.Children {
+		if strings.EqualFold(child.Name, name) {
+			if !child.IsStream {
+				return fmt.Errorf("%s is a storage", path)
+			}
+			child.Data = data
+			return nil
+		}
+	}
+
+	parent.Children = append(parent.Children, &compoundNode{
+		Name:     name,
+		IsStream: true,
+		Data:     data,
+	})
+
+	return nil
+}
+
+func (c *compoundWriter) node(names []string, create bool) (*compoundNode, error) {
+	current := c.root
+	for _, name := range names {
+		var next *compoundNode
+		for _, child := range current.Children {
+			if strings.EqualFold(child.Name, name) {
+				next = child
+				break
+			}
+		}
+
+		if next == nil {
+			if !create {
+				return nil, fmt.Errorf("storage not found: %s", name)
+			}
+			if len(utf16.Encode([]rune(name))) > cfbMaxNameLen {
+				return nil, fmt.Errorf("storage name is too long: %s", name)
+			}
+
+			next = &compoundNode{Name: name}
+			current.Children = append(current.Children, next)
+		} else if next.IsStream {
+			return nil, fmt.Errorf("%s is a stream", name)
+		}
+
+		current = next
+	}
+
+	return current, nil
+}
+
+type compoundDirEntry struct {
+	node           *compoundNode
+	objType        mscfb.ObjectType
+	color          mscfb.Color
+	left           uint32
+	right          uint32
+	child          uint32
+	startingSector uint32
+	streamSize     uint64
+}
+
+// Writes the complete compound file to the given writer.
+func (c *compoundWriter) WriteTo(w io.Writer) (int64, error) {
+	entries := []*compoundDirEntry{{
+		node:    c.root,
+		objType: mscfb.ObjRoot,
+		color:   mscfb.Black,
+		left:    mscfb.NO_STREAM,
+		right:   mscfb.NO_STREAM,
+	}}
+	entries[0].child = addDirTree(&entries, c.root.Children)
+
+	// Lay out the mini stream.
+	miniStream := new(bytes.Buffer)
+	miniFat := make([]uint32, 0)
+	regular := make([]*compoundDirEntry, 0)
+	for _, entry := range entries {
+		if entry.objType != mscfb.ObjStream {
+			continue
+		}
+
+		size := len(entry.node.Data)
+		entry.streamSize = uint64(size)
+		if size == 0 {
+			entry.startingSector = mscfb.END_OF_CHAIN
+			continue
+		}
+		if size >= int(mscfb.MINI_STREAM_CUTOFF) {
+			regular = append(regular, entry)
+			continue
+		}
+
+		start := uint32(len(miniFat))
+		numMini := (size + mscfb.MINI_SECTOR_LEN - 1) / mscfb.MINI_SECTOR_LEN
+		for i := 0; i < numMini; i++ {
+			next := start + uint32(i) + 1
+			if i == numMini-1 {
+				next = mscfb.END_OF_CHAIN
+			}
+			miniFat = append(miniFat, next)
+		}
+
+		entry.startingSector = start
+		miniStream.Write(entry.node.Data)
+		miniStream.Write(make([]byte, numMini*mscfb.MINI_SECTOR_LEN-size))
+	}
+
+	numDirSectors := sectorsFor(len(entries)*mscfb.DIR_ENTRY_LEN, cfbSectorLen)
+	numMiniFatSectors := sectorsFor(len(miniFat)*4, cfbSectorLen)
+	numMiniStreamSectors := sectorsFor(miniStream.Len(), cfbSectorLen)
+
+	numDataSectors := numDirSectors + numMiniFatSectors + numMiniStreamSectors
+	for _, entry := range regular {
+		numDataSectors += sectorsFor(len(entry.node.Data), cfbSectorLen)
+	}
+
+	// The go-mscfb reader treats unused DIFAT slots in the header as
+	// references to sector 0, so sector 0 is left free and zero-filled to
+	// keep those phantom FAT sectors empty.
+	numReservedSectors := 1
+
+	numFatSectors, numDifatSectors := 0, 0
+	for {
+		total := numReservedSectors + numDataSectors + numFatSectors + numDifatSectors
+		needFat := sectorsFor(total, cfbEntriesPerSector)
+		needDifat := 0
+		if needFat > mscfb.NUM_DIFAT_ENTRIES_IN_HEADER {
+			needDifat = sectorsFor(needFat-mscfb.NUM_DIFAT_ENTRIES_IN_HEADER, cfbDifatEntriesPerSec)
+		}
+		if needFat == numFatSectors && needDifat == numDifatSectors {
+			break
+		}
+		numFatSectors, numDifatSectors = needFat, needDifat
+	}
+
+	totalSectors := numReservedSectors + numFatSectors + numDifatSectors + numDataSectors
+	fat := make([]uint32, numFatSectors*cfbEntriesPerSector)
+	for i := range fat {
+		fat[i] = mscfb.FREE_SECTOR
+	}
+
+	next := numReservedSectors
+	allocate := func(count int) uint32 {
+		if count == 0 {
+			return mscfb.END_OF_CHAIN
+		}
+
+		start := next
+		for i := 0; i < count; i++ {
+			if i == count-1 {
+				fat[start+i] = mscfb.END_OF_CHAIN
+			} else {
+				fat[start+i] = uint32(start + i + 1)
+			}
+		}
+		next += count
+
+		return uint32(start)
+	}
+
+	fatSectorIds := make([]uint32, numFatSectors)
+	for i := range fatSectorIds {
+		fatSectorIds[i] = uint32(next)
+		fat[next] = mscfb.FAT_SECTOR
+		next++
+	}
+
+	difatSectorIds := make([]uint32, numDifatSectors)
+	for i := range difatSectorIds {
+		difatSectorIds[i] = uint32(next)
+		fat[next] = mscfb.DIFAT_SECTOR
+		next++
+	}
+
+	firstDirSector := allocate(numDirSectors)
+	firstMiniFatSector := allocate(numMiniFatSectors)
+	entries[0].startingSector = allocate(numMiniStreamSectors)
+	entries[0].streamSize = uint64(miniStream.Len())
+	for _, entry := range regular {
+		entry.startingSector = allocate(sectorsFor(len(entry.node.Data), cfbSectorLen))
+	}
+
+	if next != totalSectors {
+		return 0, fmt.Errorf("compound file layout mismatch: %d of %d sectors", next, totalSectors)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Grow((totalSectors + 1) * cfbSectorLen)
+
+	// Header
+	header := make([]uint32, mscfb.NUM_DIFAT_ENTRIES_IN_HEADER)
+	for i := range header {
+		header[i] = mscfb.FREE_SECTOR
+		if i < len(fatSectorIds) {
+			header[i] = fatSectorIds[i]
+		}
+	}
+
+	firstDifatSector := mscfb.END_OF_CHAIN
+	if numDifatSectors > 0 {
+		firstDifatSector = difatSectorIds[0]
+	}
+
+	numMiniFat := uint32(numMiniFatSectors)
+	buf.Write(mscfb.MAGIC_NUMBER)
+	buf.Write(make([]byte, 16))
+	writeLE(buf,
+		uint16(mscfb.MINOR_VERSION),
+		cfbVersion,
+		mscfb.BYTE_ORDER_MARK,
+		cfbSectorShift,
+		mscfb.MINI_SECTOR_SHIFT,
+		[6]byte{},
+		uint32(0),
+		uint32(numFatSectors),
+		firstDirSector,
+		uint32(0),
+		mscfb.MINI_STREAM_CUTOFF,
+		firstMiniFatSector,
+		numMiniFat,
+		firstDifatSector,
+		uint32(numDifatSectors),
+		header,
+	)
+
+	buf.Write(make([]byte, numReservedSectors*cfbSectorLen))
+
+	// FAT sectors
+	writeLE(buf, fat)
+
+	// DIFAT sectors
+	remaining := fatSectorIds
+	if len(remaining) > mscfb.NUM_DIFAT_ENTRIES_IN_HEADER {
+		remaining = remaining[mscfb.NUM_DIFAT_ENTRIES_IN_HEADER:]
+	} else {
+		remaining = nil
+	}
+	for i := range difatSectorIds {
+		sector := make([]uint32, cfbEntriesPerSector)
+		for j := 0; j < cfbDifatEntriesPerSec; j++ {
+			sector[j] = mscfb.FREE_SECTOR
+			if len(remaining) > 0 {
+				sector[j] = remaining[0]
+				remaining = remaining[1:]
+			}
+		}
+
+		sector[cfbDifatEntriesPerSec] = mscfb.END_OF_CHAIN
+		if i+1 < len(difatSectorIds) {
+			sector[cfbDifatEntriesPerSec] = difatSectorIds[i+1]
+		}
+		writeLE(buf, sector)
+	}
+
+	// Directory
+	for _, entry := range entries {
+		writeDirEntry(buf, entry)
+	}
+	for i := len(entries); i < numDirSectors*cfbDirEntriesPerSect; i++ {
+		writeDirEntry(buf, &compoundDirEntry{
+			objType: mscfb.ObjUnallocated,
+			color:   mscfb.Red,
+			left:    mscfb.NO_STREAM,
+			right:   mscfb.NO_STREAM,
+			child:   mscfb.NO_STREAM,
+		})
+	}
+
+	// MiniFAT
+	if numMiniFatSectors > 0 {
+		padded := make([]uint32, numMiniFatSectors*cfbEntriesPerSector)
+		for i := range padded {
+			padded[i] = mscfb.FREE_SECTOR
+		}
+		copy(padded, miniFat)
+		writeLE(buf, padded)
+	}
+
+	// Mini stream and regular streams
+	writePadded(buf, miniStream.Bytes())
+	for _, entry := range regular {
+		writePadded(buf, entry.node.Data)
+	}
+
+	return buf.WriteTo(w)
+}
+
+// Appends the given siblings to the entry list as a balanced red-black tree
+// and returns the ID of its root.
+func addDirTree(entries *[]*compoundDirEntry, nodes []*compoundNode) uint32 {
+	if len(nodes) == 0 {
+		return mscfb.NO_STREAM
+	}
+
+	sorted := make([]*compoundNode, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return compareEntryNames(sorted[i].Name, sorted[j].Name) < 0
+	})
+
+	maxDepth := 0
+	for n := len(sorted); n > 1; n /= 2 {
+		maxDepth++
+	}
+
+	var build func(nodes []*compoundNode, depth int) uint32
+	build = func(nodes []*compoundNode, depth int) uint32 {
+		if len(nodes) == 0 {
+			return mscfb.NO_STREAM
+		}
+
+		mid := len(nodes) / 2
+		node := nodes[mid]
+
+		entry := &compoundDirEntry{
+			node:    node,
+			objType: mscfb.ObjStorage,
+			color:   mscfb.Black,
+			child:   mscfb.NO_STREAM,
+		}
+		if node.IsStream {
+			entry.objType = mscfb.ObjStream
+		}
+		// Nodes on the bottom level are red so that every path holds the
+		// same number of black nodes.
+		if depth > 0 && depth == maxDepth {
+			entry.color = mscfb.Red
+		}
+
+		id := uint32(len(*entries))
+		*entries = append(*entries, entry)
+
+		entry.left = build(nodes[:mid], depth+1)
+		entry.right = build(nodes[mid+1:], depth+1)
+		if !node.IsStream {
+			entry.child = addDirTree(entries, node.Children)
+		}
+
+		return id
+	}
+
+	return build(sorted, 0)
+}
+
+// Compares directory entry names the way the compound file format orders
+// them: shorter names first, then by uppercased UTF-16 code units.
+func compareEntryNames(left, right string) int {
+	l := utf16.Encode([]rune(strings.ToUpper(left)))
+	r := utf16.Encode([]rune(strings.ToUpper(right)))
+	if len(l) != len(r) {
+		return len(l) - len(r)
+	}
+
+	for i := range l {
+		if l[i] != r[i] {
+			return int(l[i]) - int(r[i])
+		}
+	}
+
+	return 0
+}
+
+func writeDirEntry(buf *bytes.Buffer, entry *compoundDirEntry) {
+	name := make([]uint16, 32)
+	var nameLen uint16
+	clsid := uuid.Nil
+	if entry.node != nil {
+		encoded := utf16.Encode([]rune(entry.node.Name))
+		copy(name, encoded)
+		nameLen = uint16((len(encoded) + 1) * 2)
+		clsid = entry.node.CLSID
+	}
+
+	writeLE(buf,
+		name,
+		nameLen,
+		entry.objType.AsByte(),
+		entry.color.AsByte(),
+		entry.left,
+		entry.right,
+		entry.child,
+	)
+	writeCLSID(buf, clsid)
+	writeLE(buf,
+		uint32(0),
+		uint64(0),
+		uint64(0),
+		entry.startingSector,
+		entry.streamSize,
+	)
+}
+
+// Writes a CLSID in the mixed-endian layout used by compound files.
+func writeCLSID(buf *bytes.Buffer, clsid uuid.UUID) {
+	writeLE(buf,
+		binary.BigEndian.Uint32(clsid[0:4]),
+		binary.BigEndian.Uint16(clsid[4:6]),
+		binary.BigEndian.Uint16(clsid[6:8]),
+	)
+	buf.Write(clsid[8:])
+}
+
+func writeLE(buf *bytes.Buffer, values ...interface{}) {
+	for _, value := range values {
+		// Writing fixed-size values to a bytes.Buffer cannot fail.
+		_ = binary.Write(buf, binary.LittleEndian, value)
+	}
+}
+
+func writePadded(buf *bytes.Buffer, data []byte) {
+	buf.Write(data)
+	if rem := len(data) % cfbSectorLen; rem != 0 {
+		buf.Write(make([]byte, cfbSectorLen-rem))
+	}
+}
+
+func sectorsFor(size, sectorLen int) int {
+	return (size + sectorLen - 1) / sectorLen
+}
@@ -0,0 +1,685 @@
+package msi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The installation state of a component or feature, as used by the $, ?,
+// & and ! operators of conditions.
+type InstallState int
+
+const (
+	InstallStateUnknown    InstallState = -1
+	InstallStateAdvertised InstallState = 1
+	InstallStateAbsent     InstallState = 2
+	InstallStateLocal      InstallState = 3
+	InstallStateSource     InstallState = 4
+)
+
+// The values a condition is evaluated against. Undefined properties and
+// environment variables are empty, and components and features with no
+// state are in InstallStateUnknown.
+type ConditionEnvironment struct {
+	Properties  map[string]string
+	Environment map[string]string
+	// Action states, for $Component and &Feature.
+	ComponentActions map[string]InstallState
+	FeatureActions   map[string]InstallState
+	// Installed states, for ?Component and !Feature.
+	ComponentStates map[string]InstallState
+	FeatureStates   map[string]InstallState
+}
+
+// A node of a parsed condition: a *ConditionValue, *ConditionNot,
+// *ConditionLogical or *ConditionComparison.
+type ConditionNode interface {
+	String() string
+	evaluate(env *ConditionEnvironment) bool
+}
+
+type ConditionValueKind int
+
+const (
+	ConditionValueProperty ConditionValueKind = iota
+	ConditionValueEnvironment
+	ConditionValueComponentAction
+	ConditionValueComponentState
+	ConditionValueFeatureAction
+	ConditionValueFeatureState
+	ConditionValueInteger
+	ConditionValueString
+)
+
+// A property, environment variable, component or feature state, or literal.
+type ConditionValue struct {
+	Kind    ConditionValueKind
+	Name    string
+	Integer int
+	Str     string
+}
+
+type ConditionNot struct {
+	Operand ConditionNode
+}
+
+type ConditionLogicalOperator int
+
+const (
+	ConditionAnd ConditionLogicalOperator = iota
+	ConditionOr
+	ConditionXor
+	ConditionEqv
+	ConditionImp
+)
+
+type ConditionLogical struct {
+	Operator    ConditionLogicalOperator
+	Left, Right ConditionNode
+}
+
+type ConditionComparisonOperator int
+
+const (
+	ConditionEqual ConditionComparisonOperator = iota
+	ConditionNotEqual
+	ConditionGreater
+	ConditionGreaterEqual
+	ConditionLess
+	ConditionLessEqual
+	// Substring for strings, bitwise AND for integers.
+	ConditionContains
+	// Prefix for strings, high 16 bits for integers.
+	ConditionStartsWith
+	// Suffix for strings, low 16 bits for integers.
+	ConditionEndsWith
+)
+
+type ConditionComparison struct {
+	Operator ConditionComparisonOperator
+	// Set by the ~ prefix, which makes string comparisons case-insensitive.
+	IgnoreCase  bool
+	Left, Right *ConditionValue
+}
+
+// A parsed condition. An empty condition is always true.
+type Condition struct {
+	Root ConditionNode
+}
+
+// Parses a condition, as found in columns of CategoryCondition.
+func ParseCondition(condition string) (*Condition, error) {
+	tokens, err := tokenizeCondition(condition)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return &Condition{}, nil
+	}
+
+	parser := &conditionParser{tokens: tokens, condition: condition}
+	root, err := parser.parseImp()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.pos < len(tokens) {
+		return nil, parser.errorf("unexpected %s", tokens[parser.pos].text)
+	}
+
+	return &Condition{Root: root}, nil
+}
+
+// Parses and evaluates a condition.
+func EvaluateCondition(condition string, env *ConditionEnvironment) (bool, error) {
+	parsed, err := ParseCondition(condition)
+	if err != nil {
+		return false, err
+	}
+
+	return parsed.Evaluate(env), nil
+}
+
+func (c *Condition) Evaluate(env *ConditionEnvironment) bool {
+	if c.Root == nil {
+		return true
+	}
+
+	if env == nil {
+		env = &ConditionEnvironment{}
+	}
+
+	return c.Root.evaluate(env)
+}
+
+func (c *Condition) String() string {
+	if c.Root == nil {
+		return ""
+	}
+
+	return c.Root.String()
+}
+
+// A value used on its own is true if it is a non-empty string or a
+// non-zero integer.
+func (v *ConditionValue) evaluate(env *ConditionEnvironment) bool {
+	str, num, isInt := v.resolve(env)
+	if isInt {
+		return num != 0
+	}
+
+	return str != ""
+}
+
+// Returns the value as a string, and as an integer if it is one. Property
+// and environment values that hold an integer are treated as integers.
+func (v *ConditionValue) resolve(env *ConditionEnvironment) (string, int, bool) {
+	switch v.Kind {
+	case ConditionValueInteger:
+		return strconv.Itoa(v.Integer), v.Integer, true
+	case ConditionValueString:
+		return v.Str, 0, false
+	case ConditionValueProperty, ConditionValueEnvironment:
+		var value string
+		if v.Kind == ConditionValueProperty {
+			value = env.Properties[v.Name]
+		} else {
+			value, _ = lookupEnvironment(env.Environment, v.Name)
+		}
+		num, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32)
+		if err == nil {
+			return value, int(num), true
+		}
+		return value, 0, false
+	default:
+		var states map[string]InstallState
+		switch v.Kind {
+		case ConditionValueComponentAction:
+			states = env.ComponentActions
+		case ConditionValueComponentState:
+			states = env.ComponentStates
+		case ConditionValueFeatureAction:
+			states = env.FeatureActions
+		case ConditionValueFeatureState:
+			states = env.FeatureStates
+		}
+		state, ok := states[v.Name]
+		if !ok {
+			state = InstallStateUnknown
+		}
+		return strconv.Itoa(int(state)), int(state), true
+	}
+}
+
+func (v *ConditionValue) String() string {
+	switch v.Kind {
+	case ConditionValueEnvironment:
+		return "%" + v.Name
+	case ConditionValueComponentAction:
+		return "$" + v.Name
+	case ConditionValueComponentState:
+		return "?" + v.Name
+	case ConditionValueFeatureAction:
+		return "&" + v.Name
+	case ConditionValueFeatureState:
+		return "!" + v.Name
+	case ConditionValueInteger:
+		return strconv.Itoa(v.Integer)
+	case ConditionValueString:
+		return `"` + v.Str + `"`
+	default:
+		return v.Name
+	}
+}
+
+func (n *ConditionNot) evaluate(env *ConditionEnvironment) bool {
+	return !n.Operand.evaluate(env)
+}
+
+func (n *ConditionNot) String() string {
+	return "NOT " + n.Operand.String()
+}
+
+func (l *ConditionLogical) evaluate(env *ConditionEnvironment) bool {
+	left := l.Left.evaluate(env)
+	switch l.Operator {
+	case ConditionAnd:
+		return left && l.Right.evaluate(env)
+	case ConditionOr:
+		return left || l.Right.evaluate(env)
+	case ConditionXor:
+		return left != l.Right.evaluate(env)
+	case ConditionEqv:
+		return left == l.Right.evaluate(env)
+	case ConditionImp:
+		return !left || l.Right.evaluate(env)
+	default:
+		return false
+	}
+}
+
+func (l *ConditionLogical) String() string {
+	return "(" + l.Left.String() + " " + l.Operator.String() + " " + l.Right.String() + ")"
+}
+
+func (o ConditionLogicalOperator) String() string {
+	switch o {
+	case ConditionAnd:
+		return "AND"
+	case ConditionOr:
+		return "OR"
+	case ConditionXor:
+		return "XOR"
+	case ConditionEqv:
+		return "EQV"
+	case ConditionImp:
+		return "IMP"
+	default:
+		return "Unknown"
+	}
+}
+
+// Integers are compared as integers. Comparing an integer with a string
+// that is not one is false, except for <> which is true.
+func (c *ConditionComparison) evaluate(env *ConditionEnvironment) bool {
+	leftStr, leftNum, leftIsInt := c.Left.resolve(env)
+	rightStr, rightNum, rightIsInt := c.Right.resolve(env)
+
+	if leftIsInt && rightIsInt {
+		return compareIntegers(c.Operator, leftNum, rightNum)
+	}
+
+	// Properties and environment variables may be compared as strings even
+	// when they hold an integer; literals and states may not.
+	if !c.Left.isInteger() && !c.Right.isInteger() {
+		if c.IgnoreCase {
+			leftStr = strings.ToLower(leftStr)
+			rightStr = strings.ToLower(rightStr)
+		}
+		return compareStrings(c.Operator, leftStr, rightStr)
+	}
+
+	return c.Operator == ConditionNotEqual
+}
+
+// Returns true for integer literals and component and feature states,
+// which are always integers.
+func (v *ConditionValue) isInteger() bool {
+	switch v.Kind {
+	case ConditionValueProperty, ConditionValueEnvironment, ConditionValueString:
+		return false
+	default:
+		return true
+	}
+}
+
+func compareIntegers(op ConditionComparisonOperator, left int, right int) bool {
+	switch op {
+	case ConditionEqual:
+		return left == right
+	case ConditionNotEqual:
+		return left != right
+	case ConditionGreater:
+		return left > right
+	case ConditionGreaterEqual:
+		return left >= right
+	case ConditionLess:
+		return left < right
+	case ConditionLessEqual:
+		return left <= right
+	case ConditionContains:
+		return left&right != 0
+	case ConditionStartsWith:
+		return int(uint32(left)>>16) == right
+	case ConditionEndsWith:
+		return int(uint32(left)&0xffff) == right
+	default:
+		return false
+	}
+}
+
+func compareStrings(op ConditionComparisonOperator, left string, right string) bool {
+	switch op {
+	case ConditionEqual:
+		return left == right
+	case ConditionNotEqual:
+		return left != right
+	case ConditionGreater:
+		return left > right
+	case ConditionGreaterEqual:
+		return left >= right
+	case ConditionLess:
+		return left < right
+	case ConditionLessEqual:
+		return left <= right
+	case ConditionContains:
+		return strings.Contains(left, right)
+	case ConditionStartsWith:
+		return strings.HasPrefix(left, right)
+	case ConditionEndsWith:
+		return strings.HasSuffix(left, right)
+	default:
+		return false
+	}
+}
+
+func (c *ConditionComparison) String() string {
+	op := c.Operator.String()
+	if c.IgnoreCase {
+		op = "~" + op
+	}
+
+	return c.Left.String() + " " + op + " " + c.Right.String()
+}
+
+func (o ConditionComparisonOperator) String() string {
+	switch o {
+	case ConditionEqual:
+		return "="
+	case ConditionNotEqual:
+		return "<>"
+	case ConditionGreater:
+		return ">"
+	case ConditionGreaterEqual:
+		return ">="
+	case ConditionLess:
+		return "<"
+	case ConditionLessEqual:
+		return "<="
+	case ConditionContains:
+		return "><"
+	case ConditionStartsWith:
+		return "<<"
+	case ConditionEndsWith:
+		return ">>"
+	default:
+		return "?"
+	}
+}
+
+// Environment variable names are not case-sensitive on Windows.
+func lookupEnvironment(environment map[string]string, name string) (string, bool) {
+	if value, ok := environment[name]; ok {
+		return value, true
+	}
+
+	for key, value := range environment {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+type conditionTokenKind int
+
+const (
+	conditionTokenValue conditionTokenKind = iota
+	conditionTokenOperator
+	conditionTokenKeyword
+	conditionTokenOpen
+	conditionTokenClose
+)
+
+type conditionToken struct {
+	kind  conditionTokenKind
+	text  string
+	pos   int
+	value *ConditionValue
+}
+
+var conditionComparisonOperators = map[string]ConditionComparisonOperator{
+	"=":  ConditionEqual,
+	"<>": ConditionNotEqual,
+	">":  ConditionGreater,
+	">=": ConditionGreaterEqual,
+	"<":  ConditionLess,
+	"<=": ConditionLessEqual,
+	"><": ConditionContains,
+	"<<": ConditionStartsWith,
+	">>": ConditionEndsWith,
+}
+
+func tokenizeCondition(condition string) ([]*conditionToken, error) {
+	tokens := make([]*conditionToken, 0)
+	runes := []rune(condition)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, &conditionToken{kind: conditionTokenOpen, text: "(", pos: start})
+			i++
+		case r == ')':
+			tokens = append(tokens, &conditionToken{kind: conditionTokenClose, text: ")", pos: start})
+			i++
+		case r == '~' || r == '=' || r == '<' || r == '>':
+			op := ""
+			if r == '~' {
+				op = "~"
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("condition %q: missing operator after ~", condition)
+			}
+			if i+1 < len(runes) {
+				if _, ok := conditionComparisonOperators[string(runes[i:i+2])]; ok {
+					op += string(runes[i : i+2])
+					i += 2
+					tokens = append(tokens, &conditionToken{kind: conditionTokenOperator, text: op, pos: start})
+					continue
+				}
+			}
+			if _, ok := conditionComparisonOperators[string(runes[i])]; !ok {
+				return nil, fmt.Errorf("condition %q: invalid operator at %d", condition, start)
+			}
+			op += string(runes[i])
+			i++
+			tokens = append(tokens, &conditionToken{kind: conditionTokenOperator, text: op, pos: start})
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("condition %q: unterminated string at %d", condition, start)
+			}
+			str := string(runes[i+1 : end])
+			i = end + 1
+			tokens = append(tokens, &conditionToken{
+				kind:  conditionTokenValue,
+				text:  string(runes[start:i]),
+				pos:   start,
+				value: &ConditionValue{Kind: ConditionValueString, Str: str},
+			})
+		case r == '-' || unicode.IsDigit(r):
+			i++
+			for i < len(runes) && unicode.IsDigit(runes[i]) {
+				i++
+			}
+			text := string(runes[start:i])
+			num, err := strconv.ParseInt(text, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("condition %q: invalid integer %s", condition, text)
+			}
+			tokens = append(tokens, &conditionToken{
+				kind:  conditionTokenValue,
+				text:  text,
+				pos:   start,
+				value: &ConditionValue{Kind: ConditionValueInteger, Integer: int(num)},
+			})
+		case r == '%' || r == '$' || r == '?' || r == '&' || r == '!':
+			i++
+			end := scanConditionIdentifier(runes, i)
+			if end == i {
+				return nil, fmt.Errorf("condition %q: missing name after %c", condition, r)
+			}
+			kind := map[rune]ConditionValueKind{
+				'%': ConditionValueEnvironment,
+				'$': ConditionValueComponentAction,
+				'?': ConditionValueComponentState,
+				'&': ConditionValueFeatureAction,
+				'!': ConditionValueFeatureState,
+			}[r]
+			tokens = append(tokens, &conditionToken{
+				kind:  conditionTokenValue,
+				text:  string(runes[start:end]),
+				pos:   start,
+				value: &ConditionValue{Kind: kind, Name: string(runes[i:end])},
+			})
+			i = end
+		default:
+			end := scanConditionIdentifier(runes, i)
+			if end == i {
+				return nil, fmt.Errorf("condition %q: unexpected character %q at %d", condition, r, start)
+			}
+			text := string(runes[i:end])
+			i = end
+			switch strings.ToUpper(text) {
+			case "NOT", "AND", "OR", "XOR", "EQV", "IMP":
+				tokens = append(tokens, &conditionToken{kind: conditionTokenKeyword, text: strings.ToUpper(text), pos: start})
+			default:
+				tokens = append(tokens, &conditionToken{
+					kind:  conditionTokenValue,
+					text:  text,
+					pos:   start,
+					value: &ConditionValue{Kind: ConditionValueProperty, Name: text},
+				})
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+func scanConditionIdentifier(runes []rune, start int) int {
+	i := start
+	for i < len(runes) {
+		r := runes[i]
+		if r == '_' || unicode.IsLetter(r) || (i > start && (unicode.IsDigit(r) || r == '.')) {
+			i++
+			continue
+		}
+		break
+	}
+
+	return i
+}
+
+// A recursive descent parser. From lowest to highest precedence the
+// operators are IMP, EQV, XOR, OR, AND and NOT, followed by comparisons.
+type conditionParser struct {
+	tokens    []*conditionToken
+	pos       int
+	condition string
+}
+
+func (p *conditionParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("condition %q: %s", p.condition, fmt.Sprintf(format, args...))
+}
+
+func (p *conditionParser) peekKeyword(keyword string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == conditionTokenKeyword && p.tokens[p.pos].text == keyword
+}
+
+func (p *conditionParser) parseBinary(keyword string, operator ConditionLogicalOperator, next func() (ConditionNode, error)) (ConditionNode, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekKeyword(keyword) {
+		p.pos++
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = &ConditionLogical{Operator: operator, Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *conditionParser) parseImp() (ConditionNode, error) {
+	return p.parseBinary("IMP", ConditionImp, p.parseEqv)
+}
+
+func (p *conditionParser) parseEqv() (ConditionNode, error) {
+	return p.parseBinary("EQV", ConditionEqv, p.parseXor)
+}
+
+func (p *conditionParser) parseXor() (ConditionNode, error) {
+	return p.parseBinary("XOR", ConditionXor, p.parseOr)
+}
+
+func (p *conditionParser) parseOr() (ConditionNode, error) {
+	return p.parseBinary("OR", ConditionOr, p.parseAnd)
+}
+
+func (p *conditionParser) parseAnd() (ConditionNode, error) {
+	return p.parseBinary("AND", ConditionAnd, p.parseNot)
+}
+
+func (p *conditionParser) parseNot() (ConditionNode, error) {
+	if p.peekKeyword("NOT") {
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &ConditionNot{Operand: operand}, nil
+	}
+
+	return p.parseTerm()
+}
+
+func (p *conditionParser) parseTerm() (ConditionNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, p.errorf("unexpected end of condition")
+	}
+
+	token := p.tokens[p.pos]
+	switch token.kind {
+	case conditionTokenOpen:
+		p.pos++
+		node, err := p.parseImp()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != conditionTokenClose {
+			return nil, p.errorf("missing closing parenthesis for the one at %d", token.pos)
+		}
+		p.pos++
+		return node, nil
+	case conditionTokenValue:
+		p.pos++
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != conditionTokenOperator {
+			return token.value, nil
+		}
+
+		opToken := p.tokens[p.pos]
+		p.pos++
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != conditionTokenValue {
+			return nil, p.errorf("missing value after %s", opToken.text)
+		}
+		right := p.tokens[p.pos].value
+		p.pos++
+
+		text := opToken.text
+		ignoreCase := strings.HasPrefix(text, "~")
+		return &ConditionComparison{
+			Operator:   conditionComparisonOperators[strings.TrimPrefix(text, "~")],
+			IgnoreCase: ignoreCase,
+			Left:       token.value,
+			Right:      right,
+		}, nil
+	default:
+		return nil, p.errorf("unexpected %s at %d", token.text, token.pos)
+	}
+}
@@ -11,5 +11,11 @@ const (
 	STRING_DATA_TABLE_NAME = "_StringData"
 	STRING_POOL_TABLE_NAME = "_StringPool"
 
+	COMPONENT_TABLE_NAME = "Component"
+	DIRECTORY_TABLE_NAME = "Directory"
+	FILE_TABLE_NAME      = "File"
+	MEDIA_TABLE_NAME     = "Media"
+	PROPERTY_TABLE_NAME  = "Property"
+
 	MAX_NUM_TABLE_COLUMNS uint32 = 32
 )
@@ -0,0 +1,211 @@
+package msi
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+const ICE_SEQUENCE_TABLE_NAME = "_ICESequence"
+
+// A row of a .cub file's _ICESequence table, naming an ICE to run.
+type ICESequenceEntry struct {
+	Action    string
+	Condition string
+	Sequence  int
+}
+
+// A validation module, such as darice.cub or mergemod.cub: a database whose
+// _Validation table describes the tables it checks and whose _ICESequence
+// table lists the ICEs to run.
+type Cub struct {
+	Package  *MSIPackage
+	Sequence []*ICESequenceEntry
+}
+
+var registeredICERules = make(map[string]*ICERule)
+
+// Makes a rule available to the _ICESequence of .cub files under its name,
+// in addition to DefaultICERules. A registered rule replaces a default rule
+// of the same name.
+func RegisterICERule(rule *ICERule) {
+	registeredICERules[rule.Name] = rule
+}
+
+// Returns the registered or default rule with the given name, or nil.
+func ICERuleByName(name string) *ICERule {
+	if rule, ok := registeredICERules[name]; ok {
+		return rule
+	}
+
+	for _, rule := range DefaultICERules {
+		if rule.Name == name {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// Opens a .cub file. Its ICE sequence is read in order of Sequence.
+func OpenCub(rdr io.ReadSeeker) (*Cub, error) {
+	p, err := Open(rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	cub := &Cub{
+		Package:  p,
+		Sequence: make([]*ICESequenceEntry, 0),
+	}
+
+	rows, err := iceRows(p, ICE_SEQUENCE_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		sequence, _ := row.GetInt("Sequence")
+		cub.Sequence = append(cub.Sequence, &ICESequenceEntry{
+			Action:    row.GetString("Action"),
+			Condition: row.GetString("Condition"),
+			Sequence:  sequence,
+		})
+	}
+	sort.SliceStable(cub.Sequence, func(i, j int) bool { return cub.Sequence[i].Sequence < cub.Sequence[j].Sequence })
+
+	return cub, nil
+}
+
+// Merges the _Validation table of another database, typically a .cub file,
+// into this package. Rows for tables the package has replace its own, and
+// the columns of those tables are updated to match. The package's
+// _Validation table is only written by Flush.
+func (p *MSIPackage) MergeValidation(source *MSIPackage) error {
+	sourceRows, err := iceRows(source, VALIDATION_TABLE_NAME)
+	if err != nil {
+		return err
+	}
+
+	if !p.HasTable(VALIDATION_TABLE_NAME) {
+		validationTable := makeValidationTable(p.StringPool.LongStringRefs)
+		err = p.CreateTable(validationTable.Name, validationTable.Columns)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Nullability is also stored in the column's type bits, which
+	// validation can only add to.
+	typeBits := make(map[tableColumnKey]int32)
+	columnRows, err := iceRows(p, COLUMNS_TABLE_NAME)
+	if err != nil {
+		return err
+	}
+	for _, row := range columnRows {
+		bits, _ := row.GetInt("Type")
+		typeBits[tableColumnKey{row.GetString("Table"), row.GetString("Name")}] = int32(bits)
+	}
+
+	merged := make(map[tableColumnKey][]Value)
+	for _, row := range sourceRows {
+		key := tableColumnKey{row.GetString("Table"), row.GetString("Column")}
+		if !p.HasTable(key.Table) {
+			continue
+		}
+		merged[key] = row.Values
+	}
+
+	_, err = p.DeleteRows(VALIDATION_TABLE_NAME, func(row *Row) bool {
+		_, ok := merged[tableColumnKey{row.GetString("Table"), row.GetString("Column")}]
+		return ok
+	})
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]Value, 0, len(merged))
+	for key, values := range merged {
+		rows = append(rows, values)
+
+		table := p.Table(key.Table)
+		idx := table.ColumnIndex(key.Column)
+		if idx == -1 {
+			continue
+		}
+
+		builder := NewColumnBuilder(key.Column)
+		err = builder.applyValidationRow(values)
+		if err != nil {
+			return fmt.Errorf("validation for %s.%s: %v", key.Table, key.Column, err)
+		}
+
+		bits, ok := typeBits[key]
+		if !ok {
+			bits = table.Columns[idx].BitField() &^ COL_NULLABLE_BIT
+		}
+		column, err := builder.withBitFields(bits)
+		if err != nil {
+			return err
+		}
+		*table.Columns[idx] = *column
+	}
+
+	return p.InsertRows(VALIDATION_TABLE_NAME, rows)
+}
+
+// Runs the ICEs of the .cub file's sequence whose condition holds for the
+// package's properties, against a copy of the package into which the
+// .cub's _Validation table is merged. The package itself is not changed.
+// ICEs that the .cub implements as custom actions, and that have no
+// registered rule, cannot be run and are reported as Info findings.
+func (p *MSIPackage) ValidateWithCub(cub *Cub) ([]*ICEFinding, error) {
+	target, err := p.clone()
+	if err != nil {
+		return nil, err
+	}
+
+	err = target.MergeValidation(cub.Package)
+	if err != nil {
+		return nil, err
+	}
+
+	properties, err := target.propertyValues()
+	if err != nil {
+		return nil, err
+	}
+	env := &ConditionEnvironment{Properties: properties}
+
+	findings := make([]*ICEFinding, 0)
+	for _, entry := range cub.Sequence {
+		run, err := EvaluateCondition(entry.Condition, env)
+		if err != nil {
+			findings = append(findings, &ICEFinding{
+				ICE:      entry.Action,
+				Severity: ICESeverityError,
+				Message:  fmt.Sprintf("invalid condition in _ICESequence: %v", err),
+			})
+			continue
+		}
+		if !run {
+			continue
+		}
+
+		rule := ICERuleByName(entry.Action)
+		if rule == nil {
+			findings = append(findings, &ICEFinding{
+				ICE:      entry.Action,
+				Severity: ICESeverityInfo,
+				Message:  "ICE is implemented as a custom action and was not run",
+			})
+			continue
+		}
+
+		ruleFindings, err := target.Validate(rule)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, ruleFindings...)
+	}
+
+	return findings, nil
+}
@@ -0,0 +1,327 @@
+package msi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A directory of the Directory table, resolved to full paths. Paths use
+// backslashes and end with one, as directory properties do.
+type ResolvedDirectory struct {
+	Key    string
+	Parent string
+	// The long target and source names from DefaultDir. A name of "."
+	// means the directory is the same as its parent.
+	TargetName string
+	SourceName string
+	TargetPath string
+	SourcePath string
+}
+
+// A File row resolved to the full paths of the file, through the directory
+// of its component.
+type ResolvedFile struct {
+	Key       string
+	Component string
+	Directory string
+	// The FileName column, of the form "short|long".
+	FileName   string
+	TargetPath string
+	SourcePath string
+}
+
+type DirectoryLayout struct {
+	Directories map[string]*ResolvedDirectory
+	Files       map[string]*ResolvedFile
+	// The directory key of each component.
+	Components map[string]string
+}
+
+// Returns the values of the standard folder properties, as they are set on
+// a 64-bit Windows installation. ROOTDRIVE is used for the target path of
+// root directories, and SourceDir, which is empty by default, for their
+// source path.
+func DefaultFolderProperties() map[string]string {
+	return map[string]string{
+		"ROOTDRIVE":             `C:\`,
+		"SourceDir":             "",
+		"WindowsVolume":         `C:\`,
+		"WindowsFolder":         `C:\Windows\`,
+		"SystemFolder":          `C:\Windows\SysWOW64\`,
+		"System16Folder":        `C:\Windows\System\`,
+		"System64Folder":        `C:\Windows\System32\`,
+		"FontsFolder":           `C:\Windows\Fonts\`,
+		"TempFolder":            `C:\Windows\Temp\`,
+		"ProgramFilesFolder":    `C:\Program Files (x86)\`,
+		"ProgramFiles64Folder":  `C:\Program Files\`,
+		"CommonFilesFolder":     `C:\Program Files (x86)\Common Files\`,
+		"CommonFiles64Folder":   `C:\Program Files\Common Files\`,
+		"CommonAppDataFolder":   `C:\ProgramData\`,
+		"AppDataFolder":         `C:\Users\User\AppData\Roaming\`,
+		"LocalAppDataFolder":    `C:\Users\User\AppData\Local\`,
+		"PersonalFolder":        `C:\Users\User\Documents\`,
+		"DesktopFolder":         `C:\Users\Public\Desktop\`,
+		"FavoritesFolder":       `C:\Users\User\Favorites\`,
+		"MyPicturesFolder":      `C:\Users\User\Pictures\`,
+		"NetHoodFolder":         `C:\Users\User\AppData\Roaming\Microsoft\Windows\Network Shortcuts\`,
+		"PrintHoodFolder":       `C:\Users\User\AppData\Roaming\Microsoft\Windows\Printer Shortcuts\`,
+		"RecentFolder":          `C:\Users\User\AppData\Roaming\Microsoft\Windows\Recent\`,
+		"SendToFolder":          `C:\Users\User\AppData\Roaming\Microsoft\Windows\SendTo\`,
+		"TemplateFolder":        `C:\ProgramData\Microsoft\Windows\Templates\`,
+		"AdminToolsFolder":      `C:\ProgramData\Microsoft\Windows\Start Menu\Programs\Administrative Tools\`,
+		"StartMenuFolder":       `C:\ProgramData\Microsoft\Windows\Start Menu\`,
+		"ProgramMenuFolder":     `C:\ProgramData\Microsoft\Windows\Start Menu\Programs\`,
+		"StartupFolder":         `C:\ProgramData\Microsoft\Windows\Start Menu\Programs\Startup\`,
+		"LocalAppDataFolderLow": `C:\Users\User\AppData\LocalLow\`,
+	}
+}
+
+// Resolves the Directory table and the File table into full target and
+// source paths. Properties are taken from DefaultFolderProperties, then
+// the Property table, then the given map, with later values winning. A
+// directory whose key is set as a property uses that value as its target
+// path.
+func (p *MSIPackage) ResolveDirectories(properties map[string]string) (*DirectoryLayout, error) {
+	merged, err := p.mergedProperties(properties)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := &directoryResolver{
+		properties:     merged,
+		rows:           make(map[string]*Row),
+		resolved:       make(map[string]*ResolvedDirectory),
+		visiting:       make(map[string]struct{}),
+		shortSourceDir: p.SummaryInfo.WordCount()&SourceFlagShortNames != 0,
+	}
+
+	if p.HasTable(DIRECTORY_TABLE_NAME) {
+		rows, err := p.SelectRows(DIRECTORY_TABLE_NAME)
+		if err != nil {
+			return nil, err
+		}
+		for row := rows.Next(); row != nil; row = rows.Next() {
+			resolver.rows[row.GetString("Directory")] = row
+		}
+	}
+
+	for key := range resolver.rows {
+		_, err = resolver.resolve(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	layout := &DirectoryLayout{
+		Directories: resolver.resolved,
+		Files:       make(map[string]*ResolvedFile),
+		Components:  make(map[string]string),
+	}
+
+	if !p.HasTable(COMPONENT_TABLE_NAME) {
+		return layout, nil
+	}
+
+	componentDirs := layout.Components
+	rows, err := p.SelectRows(COMPONENT_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	for row := rows.Next(); row != nil; row = rows.Next() {
+		componentDirs[row.GetString("Component")] = row.GetString("Directory_")
+	}
+
+	if !p.HasTable(FILE_TABLE_NAME) {
+		return layout, nil
+	}
+
+	rows, err = p.SelectRows(FILE_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	for row := rows.Next(); row != nil; row = rows.Next() {
+		key := row.GetString("File")
+		component := row.GetString("Component_")
+		dirKey, ok := componentDirs[component]
+		if !ok {
+			return nil, fmt.Errorf("file %s refers to missing component %s", key, component)
+		}
+
+		dir, ok := layout.Directories[dirKey]
+		if !ok {
+			return nil, fmt.Errorf("component %s refers to missing directory %s", component, dirKey)
+		}
+
+		fileName := row.GetString("FileName")
+		sourceName := LongFileName(fileName)
+		if resolver.shortSourceDir {
+			sourceName = ShortFileName(fileName)
+		}
+
+		layout.Files[key] = &ResolvedFile{
+			Key:        key,
+			Component:  component,
+			Directory:  dirKey,
+			FileName:   fileName,
+			TargetPath: dir.TargetPath + LongFileName(fileName),
+			SourcePath: dir.SourcePath + sourceName,
+		}
+	}
+
+	return layout, nil
+}
+
+type directoryResolver struct {
+	properties     map[string]string
+	rows           map[string]*Row
+	resolved       map[string]*ResolvedDirectory
+	visiting       map[string]struct{}
+	shortSourceDir bool
+}
+
+func (r *directoryResolver) resolve(key string) (*ResolvedDirectory, error) {
+	if dir, ok := r.resolved[key]; ok {
+		return dir, nil
+	}
+
+	row, ok := r.rows[key]
+	if !ok {
+		return nil, fmt.Errorf("directory %s does not exist", key)
+	}
+
+	if _, ok := r.visiting[key]; ok {
+		return nil, fmt.Errorf("directory %s is its own ancestor", key)
+	}
+	r.visiting[key] = struct{}{}
+	defer delete(r.visiting, key)
+
+	parentKey := row.GetString("Directory_Parent")
+	if parentKey == key {
+		parentKey = ""
+	}
+
+	targetPart, sourcePart := SplitDefaultDir(row.GetString("DefaultDir"))
+	dir := &ResolvedDirectory{
+		Key:        key,
+		Parent:     parentKey,
+		TargetName: LongFileName(targetPart),
+		SourceName: LongFileName(sourcePart),
+	}
+
+	if parentKey == "" {
+		// The DefaultDir of a root (usually "SourceDir") only names the
+		// source root.
+		dir.TargetPath = r.properties["ROOTDRIVE"]
+		dir.SourcePath = r.properties["SourceDir"]
+	} else {
+		parent, err := r.resolve(parentKey)
+		if err != nil {
+			return nil, err
+		}
+
+		sourceName := dir.SourceName
+		if r.shortSourceDir {
+			sourceName = ShortFileName(sourcePart)
+		}
+		dir.TargetPath = joinDirectory(parent.TargetPath, dir.TargetName)
+		dir.SourcePath = joinDirectory(parent.SourcePath, sourceName)
+	}
+
+	if value, ok := r.properties[key]; ok && value != "" {
+		dir.TargetPath = ensureTrailingBackslash(value)
+	}
+
+	r.resolved[key] = dir
+
+	return dir, nil
+}
+
+// Splits a DefaultDir value of the form "target:source" into its target
+// and source parts. Without a colon both parts are the same. Each part may
+// still be of the form "short|long".
+func SplitDefaultDir(defaultDir string) (string, string) {
+	idx := strings.Index(defaultDir, ":")
+	if idx == -1 {
+		return defaultDir, defaultDir
+	}
+
+	return defaultDir[:idx], defaultDir[idx+1:]
+}
+
+// Returns the long name of a "short|long" file name, or the name itself if
+// it has only one form.
+func LongFileName(name string) string {
+	idx := strings.Index(name, "|")
+	if idx == -1 {
+		return name
+	}
+
+	return name[idx+1:]
+}
+
+// Returns the short name of a "short|long" file name, or the name itself if
+// it has only one form.
+func ShortFileName(name string) string {
+	idx := strings.Index(name, "|")
+	if idx == -1 {
+		return name
+	}
+
+	return name[:idx]
+}
+
+// Appends a directory name to a path, where "." (or an empty name) means
+// the parent directory itself.
+func joinDirectory(path string, name string) string {
+	if name == "." || name == "" {
+		return path
+	}
+
+	return ensureTrailingBackslash(path) + name + `\`
+}
+
+func ensureTrailingBackslash(path string) string {
+	if path == "" || strings.HasSuffix(path, `\`) {
+		return path
+	}
+
+	return path + `\`
+}
+
+// Returns DefaultFolderProperties overridden by the Property table, then by
+// the given properties.
+func (p *MSIPackage) mergedProperties(properties map[string]string) (map[string]string, error) {
+	merged := DefaultFolderProperties()
+	packageProperties, err := p.propertyValues()
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range packageProperties {
+		merged[name] = value
+	}
+	for name, value := range properties {
+		merged[name] = value
+	}
+
+	return merged, nil
+}
+
+// Returns the contents of the Property table, or an empty map if the
+// package has none.
+func (p *MSIPackage) propertyValues() (map[string]string, error) {
+	properties := make(map[string]string)
+	if !p.HasTable(PROPERTY_TABLE_NAME) {
+		return properties, nil
+	}
+
+	rows, err := p.SelectRows(PROPERTY_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	for row := rows.Next(); row != nil; row = rows.Next() {
+		properties[row.GetString("Property")] = row.GetString("Value")
+	}
+
+	return properties, nil
+}
@@ -0,0 +1,115 @@
+package msi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Properties of the DocumentSummaryInformation section.
+const (
+	DOC_PROPERTY_CATEGORY uint32 = 2
+	DOC_PROPERTY_MANAGER  uint32 = 14
+	DOC_PROPERTY_COMPANY  uint32 = 15
+)
+
+var fmtIdDocSummaryInfo = []byte("\x02\xd5\xcd\xd5\x9c\x2e\x1b\x10\x93\x97\x08\x00\x2b\x2c\xf9\xae")
+var fmtIdUserDefinedProperties = []byte("\x05\xd5\xcd\xd5\x9c\x2e\x1b\x10\x93\x97\x08\x00\x2b\x2c\xf9\xae")
+
+// The contents of the \x05DocumentSummaryInformation stream, which some
+// authoring tools use to store vendor metadata as user-defined properties.
+type DocumentSummaryInfo struct {
+	Properties *PropertySet
+}
+
+func NewDocumentSummary() *DocumentSummaryInfo {
+	return &DocumentSummaryInfo{
+		Properties: NewPropertySet(Win32, defaultOsVersion, fmtIdDocSummaryInfo),
+	}
+}
+
+func (d *DocumentSummaryInfo) ReadDocumentSummaryInfo(reader io.ReadSeeker) (*DocumentSummaryInfo, error) {
+	propertySet, err := ReadPropertySet(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(propertySet.FmtID, fmtIdDocSummaryInfo) {
+		return nil, fmt.Errorf("invalid property set format id")
+	}
+
+	d.Properties = propertySet
+
+	return d, nil
+}
+
+func (d *DocumentSummaryInfo) WriteDocumentSummaryInfo(writer io.Writer) error {
+	return WritePropertySet(writer, d.Properties)
+}
+
+func (d *DocumentSummaryInfo) Category() string {
+	return d.stringProperty(DOC_PROPERTY_CATEGORY)
+}
+
+func (d *DocumentSummaryInfo) Manager() string {
+	return d.stringProperty(DOC_PROPERTY_MANAGER)
+}
+
+func (d *DocumentSummaryInfo) Company() string {
+	return d.stringProperty(DOC_PROPERTY_COMPANY)
+}
+
+// Returns the user-defined properties section, or nil if there is none.
+func (d *DocumentSummaryInfo) UserDefined() *PropertySection {
+	return d.Properties.Section(fmtIdUserDefinedProperties)
+}
+
+// Returns the user-defined properties, keyed by name.
+func (d *DocumentSummaryInfo) CustomProperties() map[string]*PropertyValue {
+	section := d.UserDefined()
+	if section == nil {
+		return make(map[string]*PropertyValue)
+	}
+
+	return section.NamedProperties()
+}
+
+// Returns the user-defined property with the given name, or nil if there
+// is none.
+func (d *DocumentSummaryInfo) CustomProperty(name string) *PropertyValue {
+	section := d.UserDefined()
+	if section == nil {
+		return nil
+	}
+
+	return section.PropertyByName(name)
+}
+
+// Sets a user-defined property, creating the user-defined section if
+// needed.
+func (d *DocumentSummaryInfo) SetCustomProperty(name string, value *PropertyValue) error {
+	section := d.UserDefined()
+	if section == nil {
+		section = NewPropertySection(fmtIdUserDefinedProperties)
+		section.CodePage = d.Properties.CodePage
+		d.Properties.AdditionalSections = append(d.Properties.AdditionalSections, section)
+	}
+
+	return section.SetNamedProperty(name, value)
+}
+
+func (d *DocumentSummaryInfo) stringProperty(name uint32) string {
+	value := d.Properties.Properties[name]
+	if value == nil {
+		return ""
+	}
+
+	switch value.vt {
+	case VT_LPSTR:
+		return value.LpStr
+	case VT_LPWSTR:
+		return value.LpWStr
+	}
+
+	return ""
+}
@@ -0,0 +1,374 @@
+package msi
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+)
+
+// The name the driver is registered under with database/sql. The data
+// source name is the path of the package, which is opened for writing if
+// possible and read-only otherwise.
+const DRIVER_NAME = "msi"
+
+func init() {
+	sql.Register(DRIVER_NAME, &Driver{})
+}
+
+// A database/sql driver for packages. Statements outside a transaction are
+// written to the file as soon as they run; in a transaction they are
+// written on commit and discarded on rollback. The connections to a file
+// share one package, so they see each other's changes; while one of them
+// has a transaction open, statements on the others fail.
+type Driver struct{}
+
+var (
+	driverFilesMu sync.Mutex
+	driverFiles   = make(map[string]*driverFile)
+)
+
+// A package opened by the driver, shared by every connection to its file.
+type driverFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	pkg  *MSIPackage
+	refs int
+	// The connection with an open transaction, if any.
+	tx *driverConn
+}
+
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	driverFilesMu.Lock()
+	defer driverFilesMu.Unlock()
+
+	f, ok := driverFiles[path]
+	if !ok {
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			file, err = os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		p, err := Open(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		f = &driverFile{path: path, file: file, pkg: p}
+		driverFiles[path] = f
+	}
+	f.refs++
+
+	return &driverConn{file: f}, nil
+}
+
+// Discards the changes not yet written by reopening the file. The caller
+// holds f.mu.
+func (f *driverFile) reload() error {
+	_, err := f.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	p, err := Open(f.file)
+	if err != nil {
+		return err
+	}
+	f.pkg = p
+
+	return nil
+}
+
+type driverConn struct {
+	file *driverFile
+}
+
+func (c *driverConn) Prepare(query string) (driver.Stmt, error) {
+	parsed, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &driverStmt{conn: c, query: parsed}, nil
+}
+
+func (c *driverConn) Close() error {
+	f := c.file
+
+	driverFilesMu.Lock()
+	defer driverFilesMu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.tx == c {
+		f.tx = nil
+		err := f.reload()
+		if err != nil {
+			return err
+		}
+	}
+
+	f.refs--
+	if f.refs > 0 {
+		return nil
+	}
+	delete(driverFiles, f.path)
+
+	return f.file.Close()
+}
+
+func (c *driverConn) Begin() (driver.Tx, error) {
+	f := c.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.tx != nil {
+		return nil, fmt.Errorf("a transaction is already in progress")
+	}
+	f.tx = c
+
+	return &driverTx{conn: c}, nil
+}
+
+// Discards changes a failed statement left unwritten outside a
+// transaction, before the connection is reused.
+func (c *driverConn) ResetSession(ctx context.Context) error {
+	f := c.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.tx == nil && f.pkg.hasPendingChanges() {
+		return f.reload()
+	}
+
+	return nil
+}
+
+type driverTx struct {
+	conn *driverConn
+}
+
+func (t *driverTx) Commit() error {
+	f := t.conn.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tx = nil
+	err := f.pkg.Flush()
+	if err != nil {
+		f.reload()
+		return err
+	}
+
+	return nil
+}
+
+func (t *driverTx) Rollback() error {
+	f := t.conn.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tx = nil
+	return f.reload()
+}
+
+type driverStmt struct {
+	conn  *driverConn
+	query *Query
+}
+
+func (s *driverStmt) Close() error {
+	return nil
+}
+
+func (s *driverStmt) NumInput() int {
+	return s.query.NumParams()
+}
+
+func (s *driverStmt) Exec(args []driver.Value) (driver.Result, error) {
+	f := s.conn.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result, err := s.execute(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.query.IsSelect() && f.tx == nil {
+		err = f.pkg.Flush()
+		if err != nil {
+			f.reload()
+			return nil, err
+		}
+	}
+
+	return driverResult{rowsAffected: int64(result.RowsAffected)}, nil
+}
+
+func (s *driverStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !s.query.IsSelect() {
+		return nil, fmt.Errorf("query %q does not return rows", s.query)
+	}
+
+	f := s.conn.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result, err := s.execute(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &driverRows{result: result}, nil
+}
+
+// Runs the statement on the shared package. A statement that fails outside
+// a transaction has its partial changes discarded. The caller holds the
+// file's lock.
+func (s *driverStmt) execute(args []driver.Value) (*QueryResult, error) {
+	f := s.conn.file
+	if f.tx != nil && f.tx != s.conn {
+		return nil, fmt.Errorf("the package is locked by a transaction on another connection")
+	}
+
+	params := make([]Value, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case nil:
+			params[i] = nil
+		case int64:
+			params[i] = int(v)
+		case string:
+			params[i] = v
+		case []byte:
+			params[i] = string(v)
+		case bool:
+			if v {
+				params[i] = 1
+			} else {
+				params[i] = 0
+			}
+		default:
+			return nil, fmt.Errorf("unsupported parameter type %T", arg)
+		}
+	}
+
+	result, err := f.pkg.Execute(s.query, params...)
+	if err != nil && f.tx == nil {
+		reloadErr := f.reload()
+		if reloadErr != nil {
+			return nil, reloadErr
+		}
+	}
+
+	return result, err
+}
+
+type driverResult struct {
+	rowsAffected int64
+}
+
+func (r driverResult) LastInsertId() (int64, error) {
+	return 0, fmt.Errorf("packages do not have insert IDs")
+}
+
+func (r driverResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+// Rows of a SELECT. Integers are returned as int64 and strings as string.
+type driverRows struct {
+	result *QueryResult
+}
+
+func (r *driverRows) Columns() []string {
+	return r.result.Columns()
+}
+
+func (r *driverRows) Close() error {
+	return nil
+}
+
+func (r *driverRows) Next(dest []driver.Value) error {
+	row := r.result.Next()
+	if row == nil {
+		return io.EOF
+	}
+
+	for i, value := range row.Values {
+		switch v := value.(type) {
+		case int:
+			dest[i] = int64(v)
+		default:
+			dest[i] = v
+		}
+	}
+
+	return nil
+}
+
+// Returns the type of the column as CREATE TABLE names it: SHORT, LONG,
+// CHAR, LONGCHAR or OBJECT.
+func (r *driverRows) ColumnTypeDatabaseTypeName(index int) string {
+	column := r.result.Table.Columns[index]
+	switch {
+	case column.ColumnType == ColumnTypeInt16:
+		return "SHORT"
+	case column.ColumnType == ColumnTypeInt32:
+		return "LONG"
+	case column.Category == CategoryBinary:
+		return "OBJECT"
+	case column.ColumnStringSize == 0:
+		return "LONGCHAR"
+	default:
+		return "CHAR"
+	}
+}
+
+func (r *driverRows) ColumnTypeNullable(index int) (bool, bool) {
+	return r.result.Table.Columns[index].IsNullable, true
+}
+
+func (r *driverRows) ColumnTypeLength(index int) (int64, bool) {
+	column := r.result.Table.Columns[index]
+	if column.ColumnType != ColumnTypeStr {
+		return 0, false
+	}
+	if column.ColumnStringSize == 0 {
+		return math.MaxInt64, true
+	}
+
+	return int64(column.ColumnStringSize), true
+}
+
+func (r *driverRows) ColumnTypeScanType(index int) reflect.Type {
+	column := r.result.Table.Columns[index]
+	switch {
+	case column.ColumnType == ColumnTypeStr && column.IsNullable:
+		return reflect.TypeOf(sql.NullString{})
+	case column.ColumnType == ColumnTypeStr:
+		return reflect.TypeOf("")
+	case column.IsNullable:
+		return reflect.TypeOf(sql.NullInt64{})
+	default:
+		return reflect.TypeOf(int64(0))
+	}
+}
@@ -0,0 +1,194 @@
+package msi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Returns the tables a foreign key may refer to. A KeyTable of the form
+// "Table1;Table2" allows a reference to any of them.
+func (f foreignKey) Tables() []string {
+	if f.TableName == "" {
+		return nil
+	}
+
+	return strings.Split(f.TableName, ";")
+}
+
+// A value of a foreign key column that matches no row of the tables it
+// refers to.
+type ForeignKeyViolation struct {
+	Table  string
+	Column string
+	// The primary key values of the row holding the reference.
+	Key       []Value
+	Value     Value
+	KeyTables []string
+	KeyColumn int
+}
+
+func (v *ForeignKeyViolation) Error() string {
+	parts := make([]string, len(v.Key))
+	for i, value := range v.Key {
+		parts[i] = fmt.Sprintf("%v", value)
+	}
+
+	return fmt.Sprintf("%s.%s [%s]: %v does not match column %d of %s",
+		v.Table, v.Column, strings.Join(parts, "/"), v.Value, v.KeyColumn, strings.Join(v.KeyTables, " or "))
+}
+
+// Checks every foreign key column described by _Validation and returns the
+// references that match no row, ordered by table.
+func (p *MSIPackage) CheckForeignKeys() ([]*ForeignKeyViolation, error) {
+	names := make([]string, 0, len(p.Tables))
+	for name := range p.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	targets := newForeignKeyTargets(p)
+	violations := make([]*ForeignKeyViolation, 0)
+	for _, name := range names {
+		table := p.Tables[name]
+		if !hasForeignKeys(table) {
+			continue
+		}
+
+		rows, err := p.SelectRows(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for row := rows.Next(); row != nil; row = rows.Next() {
+			for i, column := range table.Columns {
+				violation, err := targets.check(table, column, row.Values[i])
+				if err != nil {
+					return nil, err
+				}
+				if violation != nil {
+					violation.Key = row.Key()
+					violations = append(violations, violation)
+				}
+			}
+		}
+	}
+
+	return violations, nil
+}
+
+// Checks the foreign keys of rows about to be written to the table. Keys of
+// the rows themselves count as targets, so that self-referencing tables
+// such as Directory can be filled in one call.
+func (p *MSIPackage) checkForeignKeyValues(table *Table, rows [][]Value) error {
+	if !hasForeignKeys(table) {
+		return nil
+	}
+
+	targets := newForeignKeyTargets(p)
+	targets.pending[table.Name] = rows
+	for _, row := range rows {
+		for i, column := range table.Columns {
+			violation, err := targets.check(table, column, row[i])
+			if err != nil {
+				return err
+			}
+			if violation != nil {
+				violation.Key = NewRow(table, row).Key()
+				return violation
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasForeignKeys(table *Table) bool {
+	for _, column := range table.Columns {
+		if column.ForeignKey.TableName != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+type foreignKeyTargetKey struct {
+	Table       string
+	ColumnIndex int
+}
+
+// Collects the values of the columns that foreign keys refer to, reading
+// each table once.
+type foreignKeyTargets struct {
+	p       *MSIPackage
+	values  map[foreignKeyTargetKey]map[Value]struct{}
+	pending map[string][][]Value
+}
+
+func newForeignKeyTargets(p *MSIPackage) *foreignKeyTargets {
+	return &foreignKeyTargets{
+		p:       p,
+		values:  make(map[foreignKeyTargetKey]map[Value]struct{}),
+		pending: make(map[string][][]Value),
+	}
+}
+
+// Returns a violation without its row key if the value matches none of
+// the column's key tables. Null values never violate.
+func (t *foreignKeyTargets) check(table *Table, column *Column, value Value) (*ForeignKeyViolation, error) {
+	if value == nil || column.ForeignKey.TableName == "" {
+		return nil, nil
+	}
+
+	keyTables := column.ForeignKey.Tables()
+	keyColumn := int(column.ForeignKey.ColumnIndex)
+	for _, keyTable := range keyTables {
+		values, err := t.columnValues(keyTable, keyColumn-1)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := values[value]; ok {
+			return nil, nil
+		}
+		for _, row := range t.pending[keyTable] {
+			if keyColumn-1 < len(row) && row[keyColumn-1] == value {
+				return nil, nil
+			}
+		}
+	}
+
+	return &ForeignKeyViolation{
+		Table:     table.Name,
+		Column:    column.Name,
+		Value:     value,
+		KeyTables: keyTables,
+		KeyColumn: keyColumn,
+	}, nil
+}
+
+func (t *foreignKeyTargets) columnValues(tableName string, columnIndex int) (map[Value]struct{}, error) {
+	key := foreignKeyTargetKey{tableName, columnIndex}
+	if values, ok := t.values[key]; ok {
+		return values, nil
+	}
+
+	values := make(map[Value]struct{})
+	t.values[key] = values
+	table := t.p.Table(tableName)
+	if table == nil || columnIndex < 0 || columnIndex >= len(table.Columns) {
+		return values, nil
+	}
+
+	rows, err := t.p.SelectRows(tableName)
+	if err != nil {
+		return nil, err
+	}
+	for row := rows.Next(); row != nil; row = rows.Next() {
+		if row.Values[columnIndex] != nil {
+			values[row.Values[columnIndex]] = struct{}{}
+		}
+	}
+
+	return values, nil
+}
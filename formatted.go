@@ -0,0 +1,318 @@
+package msi
+
+import (
+	"strconv"
+	"strings"
+)
+
+type FormattedSegmentKind int
+
+const (
+	// Plain text, or a {...} group that holds no references.
+	FormattedLiteral FormattedSegmentKind = iota
+	// [Property], or [1] for a record field.
+	FormattedProperty
+	// [%Variable]
+	FormattedEnvironment
+	// [#FileKey]
+	FormattedFilePath
+	// [!FileKey]
+	FormattedShortFilePath
+	// [$Component]
+	FormattedComponentDirectory
+	// [\x], whose Text is x.
+	FormattedEscape
+	// [~]
+	FormattedNull
+	// {...}, which is removed entirely if any reference in it is empty.
+	FormattedGroup
+)
+
+// A piece of a Formatted or Template value. The name of a reference is in
+// Text, unless it is itself made of references, as in [[Property]], in which
+// case it is in Children. Children also holds the contents of a group.
+type FormattedSegment struct {
+	Kind     FormattedSegmentKind
+	Text     string
+	Children []*FormattedSegment
+}
+
+// The values that references in Formatted values are expanded from.
+type FormatEnvironment struct {
+	Properties  map[string]string
+	Environment map[string]string
+	// Used for [#FileKey], [!FileKey], [$Component] and for directory keys
+	// used as properties. May be nil.
+	Layout *DirectoryLayout
+	// Record fields, for the [1], [2]... references of Template values.
+	Fields []string
+}
+
+// Builds an environment from the package's properties, overridden by the
+// given ones, and its resolved directories.
+func (p *MSIPackage) NewFormatEnvironment(properties map[string]string) (*FormatEnvironment, error) {
+	merged, err := p.mergedProperties(properties)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := p.ResolveDirectories(properties)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FormatEnvironment{
+		Properties:  merged,
+		Environment: make(map[string]string),
+		Layout:      layout,
+	}, nil
+}
+
+// Splits a value of CategoryFormatted, CategoryFormattedSddlText or
+// CategoryTemplate into segments. Brackets and braces without a match are
+// kept as literal text, as Windows Installer does.
+func TokenizeFormatted(value string) []*FormattedSegment {
+	segments := make([]*FormattedSegment, 0)
+	literal := strings.Builder{}
+	flush := func() {
+		if literal.Len() > 0 {
+			segments = append(segments, &FormattedSegment{Kind: FormattedLiteral, Text: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(value); {
+		switch value[i] {
+		case '[':
+			segment, length := tokenizeReference(value[i:])
+			if segment == nil {
+				literal.WriteByte(value[i])
+				i++
+				continue
+			}
+			flush()
+			segments = append(segments, segment)
+			i += length
+		case '{':
+			end := matchingBracket(value[i:], '{', '}')
+			if end == -1 {
+				literal.WriteByte(value[i])
+				i++
+				continue
+			}
+			children := TokenizeFormatted(value[i+1 : i+end])
+			if !hasReferences(children) {
+				literal.WriteString(value[i : i+end+1])
+			} else {
+				flush()
+				segments = append(segments, &FormattedSegment{Kind: FormattedGroup, Children: children})
+			}
+			i += end + 1
+		default:
+			literal.WriteByte(value[i])
+			i++
+		}
+	}
+	flush()
+
+	return segments
+}
+
+// Tokenizes the reference at the start of value, returning nil if it is not
+// one, along with its length.
+func tokenizeReference(value string) (*FormattedSegment, int) {
+	// Escapes come first, since [\[] and [\]] would otherwise unbalance the
+	// brackets.
+	if len(value) >= 4 && value[1] == '\\' && value[3] == ']' {
+		return &FormattedSegment{Kind: FormattedEscape, Text: value[2:3]}, 4
+	}
+
+	end := matchingBracket(value, '[', ']')
+	if end == -1 {
+		return nil, 0
+	}
+
+	inner := value[1:end]
+	if inner == "" {
+		return nil, 0
+	}
+	if inner == "~" {
+		return &FormattedSegment{Kind: FormattedNull}, end + 1
+	}
+
+	kind := FormattedProperty
+	switch inner[0] {
+	case '%':
+		kind = FormattedEnvironment
+	case '#':
+		kind = FormattedFilePath
+	case '!':
+		kind = FormattedShortFilePath
+	case '$':
+		kind = FormattedComponentDirectory
+	}
+	if kind != FormattedProperty {
+		inner = inner[1:]
+	}
+
+	segment := &FormattedSegment{Kind: kind, Text: inner}
+	if strings.Contains(inner, "[") {
+		children := TokenizeFormatted(inner)
+		if hasReferences(children) {
+			segment.Text = ""
+			segment.Children = children
+		}
+	}
+
+	return segment, end + 1
+}
+
+// Returns the index of the bracket closing the one at the start of value,
+// or -1.
+func matchingBracket(value string, open byte, close byte) int {
+	depth := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+func hasReferences(segments []*FormattedSegment) bool {
+	for _, segment := range segments {
+		if segment.Kind != FormattedLiteral {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Expands the references of a Formatted or Template value. Also returns the
+// references that could not be resolved, as they were written, in order.
+// Unresolved references expand to an empty string.
+//
+// Files expand to their target paths. Short paths are approximated by the
+// short file name in the long directory path, since the real short names
+// are only known once the files exist.
+func ExpandFormatted(value string, env *FormatEnvironment) (string, []string) {
+	if env == nil {
+		env = &FormatEnvironment{}
+	}
+
+	expander := &formattedExpander{env: env, unresolved: make([]string, 0)}
+	expanded, _ := expander.expand(TokenizeFormatted(value))
+
+	return expanded, expander.unresolved
+}
+
+type formattedExpander struct {
+	env        *FormatEnvironment
+	unresolved []string
+}
+
+// Returns the expansion and whether any reference expanded to an empty
+// string, which removes the group it is in.
+func (e *formattedExpander) expand(segments []*FormattedSegment) (string, bool) {
+	out := strings.Builder{}
+	hasEmpty := false
+	for _, segment := range segments {
+		switch segment.Kind {
+		case FormattedLiteral, FormattedEscape:
+			out.WriteString(segment.Text)
+		case FormattedNull:
+			out.WriteByte(0)
+		case FormattedGroup:
+			expanded, empty := e.expand(segment.Children)
+			if !empty {
+				out.WriteString(expanded)
+			}
+		default:
+			name := segment.Text
+			if segment.Children != nil {
+				name, _ = e.expand(segment.Children)
+			}
+			value, ok := e.resolve(segment.Kind, name)
+			if !ok {
+				e.unresolved = append(e.unresolved, "["+formattedPrefix(segment.Kind)+name+"]")
+			}
+			if value == "" {
+				hasEmpty = true
+			}
+			out.WriteString(value)
+		}
+	}
+
+	return out.String(), hasEmpty
+}
+
+func (e *formattedExpander) resolve(kind FormattedSegmentKind, name string) (string, bool) {
+	layout := e.env.Layout
+	switch kind {
+	case FormattedEnvironment:
+		return lookupEnvironment(e.env.Environment, name)
+	case FormattedFilePath, FormattedShortFilePath:
+		if layout == nil {
+			return "", false
+		}
+		file, ok := layout.Files[name]
+		if !ok {
+			return "", false
+		}
+		if kind == FormattedShortFilePath {
+			dir := layout.Directories[file.Directory]
+			return dir.TargetPath + ShortFileName(file.FileName), true
+		}
+		return file.TargetPath, true
+	case FormattedComponentDirectory:
+		if layout == nil {
+			return "", false
+		}
+		dirKey, ok := layout.Components[name]
+		if !ok {
+			return "", false
+		}
+		dir, ok := layout.Directories[dirKey]
+		if !ok {
+			return "", false
+		}
+		return dir.TargetPath, true
+	default:
+		if index, err := strconv.Atoi(name); err == nil {
+			if index >= 1 && index <= len(e.env.Fields) {
+				return e.env.Fields[index-1], true
+			}
+			return "", false
+		}
+		if layout != nil {
+			if dir, ok := layout.Directories[name]; ok {
+				return dir.TargetPath, true
+			}
+		}
+		value, ok := e.env.Properties[name]
+		return value, ok
+	}
+}
+
+func formattedPrefix(kind FormattedSegmentKind) string {
+	switch kind {
+	case FormattedEnvironment:
+		return "%"
+	case FormattedFilePath:
+		return "#"
+	case FormattedShortFilePath:
+		return "!"
+	case FormattedComponentDirectory:
+		return "$"
+	default:
+		return ""
+	}
+}
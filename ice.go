@@ -0,0 +1,687 @@
+package msi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type ICESeverity int
+
+const (
+	ICESeverityError ICESeverity = iota
+	ICESeverityWarning
+	ICESeverityInfo
+)
+
+func (s ICESeverity) String() string {
+	switch s {
+	case ICESeverityError:
+		return "Error"
+	case ICESeverityWarning:
+		return "Warning"
+	case ICESeverityInfo:
+		return "Info"
+	default:
+		return ""
+	}
+}
+
+// A problem reported by an ICE rule. Table, Column and Key, the primary key
+// values of the row, are set when the finding is about a specific row.
+type ICEFinding struct {
+	ICE      string
+	Severity ICESeverity
+	Message  string
+	Table    string
+	Column   string
+	Key      []Value
+}
+
+func (f *ICEFinding) String() string {
+	location := ""
+	if f.Table != "" {
+		location = f.Table
+		if f.Column != "" {
+			location += "." + f.Column
+		}
+		if len(f.Key) > 0 {
+			parts := make([]string, len(f.Key))
+			for i, value := range f.Key {
+				parts[i] = fmt.Sprintf("%v", value)
+			}
+			location += " [" + strings.Join(parts, "/") + "]"
+		}
+		location += ": "
+	}
+
+	return fmt.Sprintf("%s %s: %s%s", f.ICE, f.Severity, location, f.Message)
+}
+
+// A validation rule, named after the Internal Consistency Evaluator it
+// mirrors. Check returns an error only if the package could not be read.
+type ICERule struct {
+	Name        string
+	Description string
+	Check       func(p *MSIPackage) ([]*ICEFinding, error)
+}
+
+// The rules run by Validate when none are given.
+var DefaultICERules = []*ICERule{
+	{"ICE03", "Values match the column definitions in _Validation", iceCheck03},
+	{"ICE06", "Columns described in _Validation exist in the database", iceCheck06},
+	{"ICE08", "Component GUIDs are unique", iceCheck08},
+	{"ICE09", "Components installed to the system folder are permanent", iceCheck09},
+	{"ICE18", "Components keyed by their directory are listed in CreateFolder", iceCheck18},
+	{"ICE30", "No two components install a file to the same path", iceCheck30},
+	{"ICE33", "COM registration is not authored in the Registry table", iceCheck33},
+	{"ICE38", "Components in the user profile use an HKCU key path", iceCheck38},
+	{"ICE43", "Components with non-advertised shortcuts use an HKCU key path", iceCheck43},
+	{"ICE57", "Components do not mix per-user and per-machine data", iceCheck57},
+	{"ICE64", "Directories in the user profile are listed in RemoveFile", iceCheck64},
+	{"ICE91", "Files are not installed to per-user folders in per-machine packages", iceCheck91},
+}
+
+// Runs the given rules, or DefaultICERules if none are given, and returns
+// their findings in rule order.
+func (p *MSIPackage) Validate(rules ...*ICERule) ([]*ICEFinding, error) {
+	if len(rules) == 0 {
+		rules = DefaultICERules
+	}
+
+	findings := make([]*ICEFinding, 0)
+	for _, rule := range rules {
+		ruleFindings, err := rule.Check(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", rule.Name, err)
+		}
+		for _, finding := range ruleFindings {
+			if finding.ICE == "" {
+				finding.ICE = rule.Name
+			}
+		}
+		findings = append(findings, ruleFindings...)
+	}
+
+	return findings, nil
+}
+
+const (
+	componentAttributePermanent       = 0x10
+	componentAttributeRegistryKeyPath = 0x4
+
+	registryRootUser    = -1
+	registryRootClasses = 0
+	registryRootHKCU    = 1
+	registryRootHKLM    = 2
+)
+
+// Folders that are always in the user's profile.
+var perUserFolders = map[string]struct{}{
+	"AppDataFolder":         {},
+	"LocalAppDataFolder":    {},
+	"LocalAppDataFolderLow": {},
+	"PersonalFolder":        {},
+	"FavoritesFolder":       {},
+	"MyPicturesFolder":      {},
+	"NetHoodFolder":         {},
+	"PrintHoodFolder":       {},
+	"RecentFolder":          {},
+	"SendToFolder":          {},
+	"TemplateFolder":        {},
+}
+
+// Folders that are in the user's profile unless ALLUSERS is set.
+var profileFolders = map[string]struct{}{
+	"AdminToolsFolder":  {},
+	"DesktopFolder":     {},
+	"ProgramMenuFolder": {},
+	"StartMenuFolder":   {},
+	"StartupFolder":     {},
+}
+
+// Returns the rows of a table, or none if the package does not have it.
+func iceRows(p *MSIPackage, tableName string) ([]*Row, error) {
+	result := make([]*Row, 0)
+	if !p.HasTable(tableName) {
+		return result, nil
+	}
+
+	rows, err := p.SelectRows(tableName)
+	if err != nil {
+		return nil, err
+	}
+	for row := rows.Next(); row != nil; row = rows.Next() {
+		result = append(result, row)
+	}
+
+	return result, nil
+}
+
+func rowFinding(severity ICESeverity, row *Row, column string, format string, args ...interface{}) *ICEFinding {
+	return &ICEFinding{
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+		Table:    row.Table.Name,
+		Column:   column,
+		Key:      row.Key(),
+	}
+}
+
+// Returns the parent of each directory in the Directory table.
+func iceDirectoryParents(p *MSIPackage) (map[string]string, error) {
+	rows, err := iceRows(p, DIRECTORY_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make(map[string]string)
+	for _, row := range rows {
+		parents[row.GetString("Directory")] = row.GetString("Directory_Parent")
+	}
+
+	return parents, nil
+}
+
+// Returns the first of the directory and its ancestors that is in folders,
+// or "" if there is none.
+func folderAncestor(parents map[string]string, key string, folders map[string]struct{}) string {
+	seen := make(map[string]struct{})
+	for key != "" {
+		if _, ok := folders[key]; ok {
+			return key
+		}
+		if _, ok := seen[key]; ok {
+			break
+		}
+		seen[key] = struct{}{}
+		key = parents[key]
+	}
+
+	return ""
+}
+
+// Returns true if the directory is in the user's profile, counting the
+// folders that move with ALLUSERS.
+func isProfileDirectory(parents map[string]string, key string) bool {
+	return folderAncestor(parents, key, perUserFolders) != "" ||
+		folderAncestor(parents, key, profileFolders) != ""
+}
+
+// Returns the Registry row of each component whose key path is a registry
+// key.
+func iceRegistryKeyPaths(p *MSIPackage, components []*Row) (map[string]*Row, error) {
+	registryRows, err := iceRows(p, "Registry")
+	if err != nil {
+		return nil, err
+	}
+	registry := make(map[string]*Row)
+	for _, row := range registryRows {
+		registry[row.GetString("Registry")] = row
+	}
+
+	keyPaths := make(map[string]*Row)
+	for _, row := range components {
+		attributes, _ := row.GetInt("Attributes")
+		if attributes&componentAttributeRegistryKeyPath == 0 {
+			continue
+		}
+		if reg, ok := registry[row.GetString("KeyPath")]; ok {
+			keyPaths[row.GetString("Component")] = reg
+		}
+	}
+
+	return keyPaths, nil
+}
+
+func hasHKCUKeyPath(keyPaths map[string]*Row, component string) bool {
+	reg, ok := keyPaths[component]
+	if !ok {
+		return false
+	}
+
+	root, _ := reg.GetInt("Root")
+	return root == registryRootHKCU
+}
+
+func iceCheck03(p *MSIPackage) ([]*ICEFinding, error) {
+	findings := make([]*ICEFinding, 0)
+	described := make(map[tableColumnKey]struct{})
+	validationRows, err := iceRows(p, VALIDATION_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range validationRows {
+		described[tableColumnKey{row.GetString("Table"), row.GetString("Column")}] = struct{}{}
+	}
+
+	names := make([]string, 0, len(p.Tables))
+	for name := range p.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == TABLES_TABLE_NAME || name == COLUMNS_TABLE_NAME || name == VALIDATION_TABLE_NAME {
+			continue
+		}
+
+		for _, column := range p.Tables[name].Columns {
+			if _, ok := described[tableColumnKey{name, column.Name}]; !ok {
+				findings = append(findings, &ICEFinding{
+					Severity: ICESeverityError,
+					Message:  "column has no _Validation entry",
+					Table:    name,
+					Column:   column.Name,
+				})
+			}
+		}
+
+		errors, err := p.ValidateTable(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, validationErr := range errors {
+			findings = append(findings, &ICEFinding{
+				Severity: ICESeverityError,
+				Message:  validationErr.Message,
+				Table:    validationErr.Table,
+				Column:   validationErr.Column,
+				Key:      validationErr.Key,
+			})
+		}
+	}
+
+	return findings, nil
+}
+
+func iceCheck06(p *MSIPackage) ([]*ICEFinding, error) {
+	findings := make([]*ICEFinding, 0)
+	rows, err := iceRows(p, VALIDATION_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		table := p.Table(row.GetString("Table"))
+		if table == nil {
+			continue
+		}
+		column := row.GetString("Column")
+		if !table.HasColumn(column) {
+			findings = append(findings, &ICEFinding{
+				Severity: ICESeverityError,
+				Message:  fmt.Sprintf("column %s is described in _Validation but missing from the database", column),
+				Table:    table.Name,
+				Column:   column,
+			})
+		}
+	}
+
+	return findings, nil
+}
+
+func iceCheck08(p *MSIPackage) ([]*ICEFinding, error) {
+	findings := make([]*ICEFinding, 0)
+	rows, err := iceRows(p, COMPONENT_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[string]string)
+	for _, row := range rows {
+		guid := strings.ToUpper(row.GetString("ComponentId"))
+		if guid == "" {
+			continue
+		}
+		component := row.GetString("Component")
+		if owner, ok := owners[guid]; ok {
+			findings = append(findings, rowFinding(ICESeverityError, row, "ComponentId",
+				"component GUID %s is also used by component %s", guid, owner))
+			continue
+		}
+		owners[guid] = component
+	}
+
+	return findings, nil
+}
+
+func iceCheck09(p *MSIPackage) ([]*ICEFinding, error) {
+	findings := make([]*ICEFinding, 0)
+	rows, err := iceRows(p, COMPONENT_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		directory := row.GetString("Directory_")
+		if directory != "SystemFolder" && directory != "System64Folder" {
+			continue
+		}
+		attributes, _ := row.GetInt("Attributes")
+		if attributes&componentAttributePermanent == 0 {
+			findings = append(findings, rowFinding(ICESeverityWarning, row, "Attributes",
+				"component installs to %s but is not permanent", directory))
+		}
+	}
+
+	return findings, nil
+}
+
+func iceCheck18(p *MSIPackage) ([]*ICEFinding, error) {
+	findings := make([]*ICEFinding, 0)
+	rows, err := iceRows(p, COMPONENT_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	createFolderRows, err := iceRows(p, "CreateFolder")
+	if err != nil {
+		return nil, err
+	}
+	createFolders := make(map[[2]string]struct{})
+	for _, row := range createFolderRows {
+		createFolders[[2]string{row.GetString("Directory_"), row.GetString("Component_")}] = struct{}{}
+	}
+
+	for _, row := range rows {
+		if row.GetString("KeyPath") != "" {
+			continue
+		}
+		directory := row.GetString("Directory_")
+		if _, ok := createFolders[[2]string{directory, row.GetString("Component")}]; !ok {
+			findings = append(findings, rowFinding(ICESeverityError, row, "KeyPath",
+				"key path is the directory %s, which is not listed in the CreateFolder table", directory))
+		}
+	}
+
+	return findings, nil
+}
+
+func iceCheck30(p *MSIPackage) ([]*ICEFinding, error) {
+	findings := make([]*ICEFinding, 0)
+	if !p.HasTable(FILE_TABLE_NAME) {
+		return findings, nil
+	}
+
+	layout, err := p.ResolveDirectories(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := iceRows(p, FILE_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[string]*ResolvedFile)
+	for _, row := range rows {
+		file, ok := layout.Files[row.GetString("File")]
+		if !ok {
+			continue
+		}
+		path := strings.ToLower(file.TargetPath)
+		owner, ok := owners[path]
+		if !ok {
+			owners[path] = file
+			continue
+		}
+		if owner.Component != file.Component {
+			findings = append(findings, rowFinding(ICESeverityError, row, "FileName",
+				"%s is also installed by file %s of component %s", file.TargetPath, owner.Key, owner.Component))
+		}
+	}
+
+	return findings, nil
+}
+
+// Registry keys under HKCR that the Class, ProgId, Extension, Verb, TypeLib
+// and AppId tables should author.
+var comRegistryPrefixes = []string{`clsid\`, `appid\`, `typelib\`, `interface\`}
+
+func iceCheck33(p *MSIPackage) ([]*ICEFinding, error) {
+	findings := make([]*ICEFinding, 0)
+	rows, err := iceRows(p, "Registry")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		root, _ := row.GetInt("Root")
+		key := strings.ToLower(row.GetString("Key"))
+		if root != registryRootClasses {
+			if root == registryRootHKCU || root == registryRootHKLM || root == registryRootUser {
+				trimmed := strings.TrimPrefix(key, `software\classes\`)
+				if trimmed == key {
+					continue
+				}
+				key = trimmed
+			} else {
+				continue
+			}
+		}
+
+		for _, prefix := range comRegistryPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				findings = append(findings, rowFinding(ICESeverityWarning, row, "Key",
+					"COM registration %s should be authored in the advertising tables", row.GetString("Key")))
+				break
+			}
+		}
+		if strings.HasPrefix(key, ".") {
+			findings = append(findings, rowFinding(ICESeverityWarning, row, "Key",
+				"extension registration %s should be authored in the Extension table", row.GetString("Key")))
+		}
+	}
+
+	return findings, nil
+}
+
+func iceCheck38(p *MSIPackage) ([]*ICEFinding, error) {
+	findings := make([]*ICEFinding, 0)
+	parents, err := iceDirectoryParents(p)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := iceRows(p, COMPONENT_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPaths, err := iceRegistryKeyPaths(p, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		if !isProfileDirectory(parents, row.GetString("Directory_")) {
+			continue
+		}
+		if !hasHKCUKeyPath(keyPaths, row.GetString("Component")) {
+			findings = append(findings, rowFinding(ICESeverityError, row, "KeyPath",
+				"component installs to the user profile but its key path is not an HKCU registry key"))
+		}
+	}
+
+	return findings, nil
+}
+
+func iceCheck43(p *MSIPackage) ([]*ICEFinding, error) {
+	findings := make([]*ICEFinding, 0)
+	shortcuts, err := iceRows(p, "Shortcut")
+	if err != nil {
+		return nil, err
+	}
+
+	components, err := iceRows(p, COMPONENT_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	componentRows := make(map[string]*Row)
+	for _, row := range components {
+		componentRows[row.GetString("Component")] = row
+	}
+
+	keyPaths, err := iceRegistryKeyPaths(p, components)
+	if err != nil {
+		return nil, err
+	}
+
+	reported := make(map[string]struct{})
+	for _, shortcut := range shortcuts {
+		// Advertised shortcuts target a feature; all others are formatted.
+		if !strings.Contains(shortcut.GetString("Target"), "[") {
+			continue
+		}
+		component := shortcut.GetString("Component_")
+		if _, ok := reported[component]; ok {
+			continue
+		}
+		row, ok := componentRows[component]
+		if !ok || hasHKCUKeyPath(keyPaths, component) {
+			continue
+		}
+		reported[component] = struct{}{}
+		findings = append(findings, rowFinding(ICESeverityError, row, "KeyPath",
+			"component has non-advertised shortcuts but its key path is not an HKCU registry key"))
+	}
+
+	return findings, nil
+}
+
+func iceCheck57(p *MSIPackage) ([]*ICEFinding, error) {
+	findings := make([]*ICEFinding, 0)
+	parents, err := iceDirectoryParents(p)
+	if err != nil {
+		return nil, err
+	}
+
+	components, err := iceRows(p, COMPONENT_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	componentDirs := make(map[string]string)
+	for _, row := range components {
+		componentDirs[row.GetString("Component")] = row.GetString("Directory_")
+	}
+
+	perUser := make(map[string]bool)
+	perMachine := make(map[string]bool)
+
+	files, err := iceRows(p, FILE_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range files {
+		component := row.GetString("Component_")
+		if isProfileDirectory(parents, componentDirs[component]) {
+			perUser[component] = true
+		} else {
+			perMachine[component] = true
+		}
+	}
+
+	registry, err := iceRows(p, "Registry")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range registry {
+		component := row.GetString("Component_")
+		switch root, _ := row.GetInt("Root"); root {
+		case registryRootHKCU:
+			perUser[component] = true
+		case registryRootHKLM, registryRootClasses:
+			perMachine[component] = true
+		}
+	}
+
+	for _, row := range components {
+		component := row.GetString("Component")
+		if perUser[component] && perMachine[component] {
+			findings = append(findings, rowFinding(ICESeverityError, row, "",
+				"component has both per-user and per-machine data"))
+		}
+	}
+
+	return findings, nil
+}
+
+func iceCheck64(p *MSIPackage) ([]*ICEFinding, error) {
+	findings := make([]*ICEFinding, 0)
+	directories, err := iceRows(p, DIRECTORY_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	parents, err := iceDirectoryParents(p)
+	if err != nil {
+		return nil, err
+	}
+
+	removeFileRows, err := iceRows(p, "RemoveFile")
+	if err != nil {
+		return nil, err
+	}
+	removed := make(map[string]struct{})
+	for _, row := range removeFileRows {
+		removed[row.GetString("DirProperty")] = struct{}{}
+	}
+
+	for _, row := range directories {
+		key := row.GetString("Directory")
+		if _, ok := perUserFolders[key]; ok {
+			continue
+		}
+		if _, ok := profileFolders[key]; ok {
+			continue
+		}
+		if !isProfileDirectory(parents, key) {
+			continue
+		}
+		if _, ok := removed[key]; !ok {
+			findings = append(findings, rowFinding(ICESeverityError, row, "Directory",
+				"directory is in the user profile but is not listed in the RemoveFile table"))
+		}
+	}
+
+	return findings, nil
+}
+
+func iceCheck91(p *MSIPackage) ([]*ICEFinding, error) {
+	findings := make([]*ICEFinding, 0)
+	properties, err := p.propertyValues()
+	if err != nil {
+		return nil, err
+	}
+	if properties["ALLUSERS"] == "" {
+		return findings, nil
+	}
+
+	parents, err := iceDirectoryParents(p)
+	if err != nil {
+		return nil, err
+	}
+
+	components, err := iceRows(p, COMPONENT_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	componentDirs := make(map[string]string)
+	for _, row := range components {
+		componentDirs[row.GetString("Component")] = row.GetString("Directory_")
+	}
+
+	files, err := iceRows(p, FILE_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range files {
+		folder := folderAncestor(parents, componentDirs[row.GetString("Component_")], perUserFolders)
+		if folder != "" {
+			findings = append(findings, rowFinding(ICESeverityWarning, row, "",
+				"file is installed to the per-user folder %s, which does not change with ALLUSERS", folder))
+		}
+	}
+
+	return findings, nil
+}
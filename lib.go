@@ -1,13 +1,18 @@
 package msi
 
 import (
+	"bytes"
 	"fmt"
 	"io"
-	"strings"
+	"path"
+	"time"
 
 	"github.com/asalih/go-mscfb"
+	"github.com/google/uuid"
 )
 
+const defaultCreatingApplication = "go-msi"
+
 type columnMapValue struct {
 	Index int
 	Name  string
@@ -27,6 +32,14 @@ type MSIPackage struct {
 	SummaryInfo *SummaryInfo
 	StringPool  *StringPool
 	Tables      map[string]*Table
+
+	// When set, InsertRows and UpdateRows refuse foreign key values that
+	// match no row of the tables they refer to.
+	StrictForeignKeys bool
+
+	rdr            io.ReadSeeker
+	pendingStreams map[string][]byte
+	removedStreams map[string]struct{}
 }
 
 func Open(rdr io.ReadSeeker) (*MSIPackage, error) {
@@ -38,36 +51,16 @@ func Open(rdr io.ReadSeeker) (*MSIPackage, error) {
 	rootEntry := msiReader.RootEntry()
 	packageType := PackageTypeFromCLSID(rootEntry.CLSID)
 
-	summaryStream, err := msiReader.OpenStream(SUMMARY_INFO_STREAM_NAME)
-	if err != nil {
-		return nil, err
+	if packageType == PackageTypeTransform {
+		return nil, fmt.Errorf("package is a transform; use OpenTransform")
 	}
 
-	summaryInfo := SummaryInfo{}
-	_, err = summaryInfo.ReadSummaryInfo(summaryStream)
-	if err != nil {
-		return nil, err
-	}
-
-	stringTableStreamName := NameEncode(STRING_POOL_TABLE_NAME, true)
-	stringTableStream, err := msiReader.OpenStream(stringTableStreamName)
-	if err != nil {
-		return nil, err
-	}
-
-	poolBuilder := StringPoolBuilder{}
-	err = poolBuilder.ReadFromPool(stringTableStream)
+	summaryInfo, err := readSummaryInfo(msiReader, "")
 	if err != nil {
 		return nil, err
 	}
 
-	stringDataStreamName := NameEncode(STRING_DATA_TABLE_NAME, true)
-	stringDataStream, err := msiReader.OpenStream(stringDataStreamName)
-	if err != nil {
-		return nil, err
-	}
-
-	stringPool, err := poolBuilder.BuildFromData(stringDataStream)
+	stringPool, err := readStringPool(msiReader, "")
 	if err != nil {
 		return nil, err
 	}
@@ -78,10 +71,7 @@ func Open(rdr io.ReadSeeker) (*MSIPackage, error) {
 	tablesTable := makeTablesTable(stringPool.LongStringRefs)
 	tablesStreamName := tablesTable.StreamName()
 
-	isTablesTableExist, err := msiReader.Exists(tablesStreamName)
-	if err != nil {
-		return nil, err
-	}
+	isTablesTableExist := streamExists(msiReader, tablesStreamName)
 
 	tableNames := make(map[string]struct{})
 	if isTablesTableExist {
@@ -116,10 +106,7 @@ func Open(rdr io.ReadSeeker) (*MSIPackage, error) {
 	columnsTable := makeColumnsTable(stringPool.LongStringRefs)
 	columnsTableStreamName := columnsTable.StreamName()
 
-	isColumnsTableExist, err := msiReader.Exists(columnsTableStreamName)
-	if err != nil {
-		return nil, err
-	}
+	isColumnsTableExist := streamExists(msiReader, columnsTableStreamName)
 
 	columnsMap := make(columnMap)
 	for tableName := range tableNames {
@@ -176,10 +163,7 @@ func Open(rdr io.ReadSeeker) (*MSIPackage, error) {
 	validationTable := makeValidationTable(stringPool.LongStringRefs)
 	validationTableStreamName := validationTable.StreamName()
 
-	isValidationTableExist, err := msiReader.Exists(validationTableStreamName)
-	if err != nil {
-		return nil, err
-	}
+	isValidationTableExist := streamExists(msiReader, validationTableStreamName)
 
 	if isValidationTableExist {
 		validationStream, err := msiReader.OpenStream(validationTableStreamName)
@@ -231,40 +215,13 @@ func Open(rdr io.ReadSeeker) (*MSIPackage, error) {
 			}
 
 			if valueRefs, ok := validationMap[key]; ok {
-				isNullable := valueRefs[2].ToValue(stringPool).(string) == "Y"
-				if isNullable {
-					builder.SetNullable()
-				}
-
-				minValue := valueRefs[3].ToValue(stringPool)
-				maxValue := valueRefs[4].ToValue(stringPool)
-				if minValue != nil && maxValue != nil {
-					mi := int32(minValue.(int))
-					ma := int32(maxValue.(int))
-					builder.SetRange(mi, ma)
-				}
-
-				keyTable := valueRefs[5].ToValue(stringPool)
-				keyColumn := valueRefs[6].ToValue(stringPool)
-				if keyTable != nil && keyColumn != nil {
-					kc := int32(keyColumn.(int))
-					builder.SetForeignKey(keyTable.(string), kc)
-				}
-
-				categoryValue := valueRefs[7].ToValue(stringPool)
-				if categoryValue != nil {
-					c := CategoryFromString(categoryValue.(string))
-					if c == -1 {
-						return nil, fmt.Errorf("invalid category value: %s", categoryValue)
-					}
-
-					builder.SetCategory(c)
+				values := make([]Value, 0)
+				for _, ref := range valueRefs {
+					values = append(values, ref.ToValue(stringPool))
 				}
-
-				enumValues := valueRefs[8].ToValue(stringPool)
-				if enumValues != nil {
-					v := strings.Split(enumValues.(string), ";")
-					builder.SetEnumValues(v...)
+				err := builder.applyValidationRow(values)
+				if err != nil {
+					return nil, err
 				}
 			}
 
@@ -283,31 +240,432 @@ func Open(rdr io.ReadSeeker) (*MSIPackage, error) {
 	return &MSIPackage{
 		CompoundFile: msiReader,
 		PackageType:  packageType,
-		SummaryInfo:  &summaryInfo,
+		SummaryInfo:  summaryInfo,
 		StringPool:   stringPool,
 		Tables:       allTables,
+
+		rdr:            rdr,
+		pendingStreams: make(map[string][]byte),
+		removedStreams: make(map[string]struct{}),
 	}, nil
 }
 
+// Reads the summary information of the given storage, or of the root
+// storage if storage is empty.
+func readSummaryInfo(cf *mscfb.CompoundFile, storage string) (*SummaryInfo, error) {
+	summaryStream, err := cf.OpenStream(storageStreamPath(storage, SUMMARY_INFO_STREAM_NAME))
+	if err != nil {
+		return nil, err
+	}
+
+	return (&SummaryInfo{}).ReadSummaryInfo(summaryStream)
+}
+
+func readStringPool(cf *mscfb.CompoundFile, storage string) (*StringPool, error) {
+	stringTableStreamName := storageStreamPath(storage, NameEncode(STRING_POOL_TABLE_NAME, true))
+	stringTableStream, err := cf.OpenStream(stringTableStreamName)
+	if err != nil {
+		return nil, err
+	}
+
+	poolBuilder := StringPoolBuilder{}
+	err = poolBuilder.ReadFromPool(stringTableStream)
+	if err != nil {
+		return nil, err
+	}
+
+	stringDataStreamName := storageStreamPath(storage, NameEncode(STRING_DATA_TABLE_NAME, true))
+	stringDataStream, err := cf.OpenStream(stringDataStreamName)
+	if err != nil {
+		return nil, err
+	}
+
+	return poolBuilder.BuildFromData(stringDataStream)
+}
+
+// Creates a new, empty package of the given type and writes it to the
+// given stream. The returned package can be modified and written back with
+// Flush.
+func Create(rw io.ReadWriteSeeker, packageType PackageType) (*MSIPackage, error) {
+	if packageType.CLSID() == uuid.Nil {
+		return nil, fmt.Errorf("invalid package type: %d", packageType)
+	}
+
+	summaryInfo := NewSummary()
+	summaryInfo.SetTitle(packageType.String())
+	summaryInfo.SetCreatingApplication(defaultCreatingApplication)
+	summaryInfo.SetCreationTime(time.Now())
+	if packageType == PackageTypeInstaller {
+		summaryInfo.SetTemplate("Intel;1033")
+		summaryInfo.SetPackageCode(uuid.New())
+		summaryInfo.SetPageCount(200)
+		summaryInfo.SetWordCount(0)
+	}
+
+	stringPool := NewStringPool(CodePageDefault())
+	tablesTable := makeTablesTable(stringPool.LongStringRefs)
+	columnsTable := makeColumnsTable(stringPool.LongStringRefs)
+
+	pkg := &MSIPackage{
+		PackageType: packageType,
+		SummaryInfo: summaryInfo,
+		StringPool:  stringPool,
+		Tables: map[string]*Table{
+			tablesTable.Name:  tablesTable,
+			columnsTable.Name: columnsTable,
+		},
+
+		rdr:            rw,
+		pendingStreams: make(map[string][]byte),
+		removedStreams: make(map[string]struct{}),
+	}
+
+	pkg.writeStream(tablesTable.StreamName(), []byte{})
+	pkg.writeStream(columnsTable.StreamName(), []byte{})
+
+	validationTable := makeValidationTable(stringPool.LongStringRefs)
+	err := pkg.CreateTable(validationTable.Name, validationTable.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pkg.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return pkg, nil
+}
+
+// Returns true if the package has changes that Flush has not written.
+func (p *MSIPackage) hasPendingChanges() bool {
+	return len(p.pendingStreams) > 0 || len(p.removedStreams) > 0 ||
+		p.SummaryInfo.IsModified || p.StringPool.IsModified
+}
+
+// Writes all pending changes to the underlying stream, which must have been
+// opened for writing.
+func (p *MSIPackage) Flush() error {
+	rw, ok := p.rdr.(io.ReadWriteSeeker)
+	if !ok {
+		return fmt.Errorf("package is not writable")
+	}
+
+	data, err := p.encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = rw.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = rw.Write(data)
+	if err != nil {
+		return err
+	}
+
+	if truncater, ok := rw.(interface{ Truncate(size int64) error }); ok {
+		err = truncater.Truncate(int64(len(data)))
+		if err != nil {
+			return err
+		}
+	}
+
+	compoundFile, err := mscfb.Open(rw, mscfb.ValidationPermissive)
+	if err != nil {
+		return err
+	}
+
+	p.CompoundFile = compoundFile
+	p.pendingStreams = make(map[string][]byte)
+	p.removedStreams = make(map[string]struct{})
+	p.SummaryInfo.IsModified = false
+	p.StringPool.IsModified = false
+
+	return nil
+}
+
+// Returns the compound file holding the package with its pending changes,
+// leaving them pending.
+func (p *MSIPackage) encode() ([]byte, error) {
+	streams := make(map[string][]byte, len(p.pendingStreams)+3)
+	for streamPath, data := range p.pendingStreams {
+		streams[streamPath] = data
+	}
+
+	if p.SummaryInfo.IsModified {
+		buf := new(bytes.Buffer)
+		err := p.SummaryInfo.WriteSummaryInfo(buf)
+		if err != nil {
+			return nil, err
+		}
+		streams[streamPath(SUMMARY_INFO_STREAM_NAME)] = buf.Bytes()
+	}
+
+	if p.StringPool.IsModified {
+		poolBuf := new(bytes.Buffer)
+		err := p.StringPool.WritePool(poolBuf)
+		if err != nil {
+			return nil, err
+		}
+
+		dataBuf := new(bytes.Buffer)
+		err = p.StringPool.WriteData(dataBuf)
+		if err != nil {
+			return nil, err
+		}
+
+		streams[streamPath(NameEncode(STRING_POOL_TABLE_NAME, true))] = poolBuf.Bytes()
+		streams[streamPath(NameEncode(STRING_DATA_TABLE_NAME, true))] = dataBuf.Bytes()
+	}
+
+	rootCLSID := p.PackageType.CLSID()
+	if p.CompoundFile != nil {
+		rootCLSID = p.CompoundFile.RootEntry().CLSID
+	}
+
+	writer := newCompoundWriter(rootCLSID)
+	if p.CompoundFile != nil {
+		rootEntry := p.CompoundFile.Directory.RootDirEntry()
+		err := p.copyEntries(writer, rootEntry.Child, "/", streams)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for streamPath, data := range streams {
+		err := writer.AddStream(streamPath, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	_, err := writer.WriteTo(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Returns a read-only copy of the package, including its pending changes.
+// Changes to the copy do not affect the package.
+func (p *MSIPackage) clone() (*MSIPackage, error) {
+	data, err := p.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return Open(bytes.NewReader(data))
+}
+
+// Copies every stream and storage below the given directory entry that has
+// not been replaced or removed.
+func (p *MSIPackage) copyEntries(writer *compoundWriter, id uint32, parentPath string, replaced map[string][]byte) error {
+	if id == mscfb.NO_STREAM {
+		return nil
+	}
+
+	dirEntry := p.CompoundFile.Directory.DirEntries[id]
+	err := p.copyEntries(writer, dirEntry.LeftSibling, parentPath, replaced)
+	if err != nil {
+		return err
+	}
+
+	err = p.copyEntries(writer, dirEntry.RightSibling, parentPath, replaced)
+	if err != nil {
+		return err
+	}
+
+	entryPath := path.Join(parentPath, dirEntry.Name)
+	if _, ok := p.removedStreams[entryPath]; ok {
+		return nil
+	}
+
+	switch dirEntry.ObjType {
+	case mscfb.ObjStorage:
+		err = writer.AddStorage(entryPath, dirEntry.CLSID)
+		if err != nil {
+			return err
+		}
+
+		return p.copyEntries(writer, dirEntry.Child, entryPath, replaced)
+	case mscfb.ObjStream:
+		if _, ok := replaced[entryPath]; ok {
+			return nil
+		}
+
+		stream, err := p.CompoundFile.OpenStream(entryPath)
+		if err != nil {
+			return err
+		}
+
+		data, err := io.ReadAll(stream)
+		if err != nil {
+			return err
+		}
+
+		return writer.AddStream(entryPath, data)
+	}
+
+	return nil
+}
+
+// Returns the table with the given name, or nil if the package has no such
+// table.
+func (p *MSIPackage) Table(name string) *Table {
+	return p.Tables[name]
+}
+
+// Returns true if the package has a table with the given name.
+func (p *MSIPackage) HasTable(name string) bool {
+	_, ok := p.Tables[name]
+	return ok
+}
+
+// Returns an iterator over the rows of the table with the given name. A
+// table without a data stream is treated as an empty table.
+func (p *MSIPackage) SelectRows(tableName string) (*Rows, error) {
+	table := p.Table(tableName)
+	if table == nil {
+		return nil, fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	rows, err := p.readTableRows(table)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRows(p.StringPool, table, rows), nil
+}
+
+func (p *MSIPackage) readTableRows(table *Table) ([][]*ValueRef, error) {
+	streamName := table.StreamName()
+	if !p.hasStream(streamName) {
+		return make([][]*ValueRef, 0), nil
+	}
+
+	stream, err := p.openStream(streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	return table.ReadRows(stream)
+}
+
+func (p *MSIPackage) hasStream(name string) bool {
+	streamPath := streamPath(name)
+	if _, ok := p.pendingStreams[streamPath]; ok {
+		return true
+	}
+	if _, ok := p.removedStreams[streamPath]; ok {
+		return false
+	}
+	if p.CompoundFile == nil {
+		return false
+	}
+
+	isStream, err := p.CompoundFile.IsStream(streamPath)
+	return err == nil && isStream
+}
+
+func (p *MSIPackage) openStream(name string) (io.ReadSeeker, error) {
+	streamPath := streamPath(name)
+	if data, ok := p.pendingStreams[streamPath]; ok {
+		return bytes.NewReader(data), nil
+	}
+	if !p.hasStream(name) {
+		return nil, fmt.Errorf("stream %s does not exist", name)
+	}
+
+	return p.CompoundFile.OpenStream(streamPath)
+}
+
+// Stages the given stream contents until the next Flush.
+func (p *MSIPackage) writeStream(name string, data []byte) {
+	streamPath := streamPath(name)
+	delete(p.removedStreams, streamPath)
+	p.pendingStreams[streamPath] = data
+}
+
+// Stages the removal of the given stream until the next Flush.
+func (p *MSIPackage) removeStream(name string) {
+	streamPath := streamPath(name)
+	delete(p.pendingStreams, streamPath)
+	p.removedStreams[streamPath] = struct{}{}
+}
+
+func streamPath(name string) string {
+	return mscfb.PathFromNameChain(mscfb.NameChainFromPath(name))
+}
+
+// Returns the path of a stream within a storage of the compound file, or
+// within the root storage if storage is empty.
+func storageStreamPath(storage string, name string) string {
+	if storage == "" {
+		return streamPath(name)
+	}
+
+	return mscfb.PathFromNameChain([]string{storage, name})
+}
+
+// Returns an iterator over the entries of the given storage, or of the
+// root storage if storage is empty. A missing storage has no entries.
+func storageEntries(cf *mscfb.CompoundFile, storage string) *mscfb.Entries {
+	dir := cf.Directory
+	if storage == "" {
+		return dir.RootStorageEntries()
+	}
+
+	start := mscfb.NO_STREAM
+	id, err := dir.StreamIDForNameChain([]string{storage})
+	if err == nil && dir.DirEntries[id].ObjType == mscfb.ObjStorage {
+		start = dir.DirEntries[id].Child
+	}
+
+	return mscfb.NewEntries(mscfb.EntriesNonRecursive, dir, mscfb.PathFromNameChain([]string{storage}), start)
+}
+
 func (p *MSIPackage) Streams() *Streams {
 	return NewStreams(p.CompoundFile.Directory.RootStorageEntries())
 }
 
+// Reads the \x05DocumentSummaryInformation stream. Returns nil if the
+// package has none.
+func (p *MSIPackage) DocumentSummaryInfo() (*DocumentSummaryInfo, error) {
+	if !p.hasStream(DOC_SUMMARY_INFO_STREAM_NAME) {
+		return nil, nil
+	}
+
+	stream, err := p.openStream(DOC_SUMMARY_INFO_STREAM_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	return (&DocumentSummaryInfo{}).ReadDocumentSummaryInfo(stream)
+}
+
 func (p *MSIPackage) ReadStream(streamName string) (io.ReadSeeker, error) {
 	if !NameIsValid(streamName, false) {
 		return nil, fmt.Errorf("invalid stream name: %s", streamName)
 	}
 
 	encoded := NameEncode(streamName, false)
-	isStream, err := p.CompoundFile.IsStream(encoded)
-	if err != nil {
-		return nil, err
-	}
-	if !isStream {
+	if !p.hasStream(encoded) {
 		return nil, fmt.Errorf("stream %s does not exist", streamName)
 	}
 
-	return p.CompoundFile.OpenStream(encoded)
+	return p.openStream(encoded)
+}
+
+// The compound file reports a missing stream as an error, so any lookup
+// failure is treated as the stream not existing.
+func streamExists(cf *mscfb.CompoundFile, name string) bool {
+	exists, err := cf.Exists(name)
+	return err == nil && exists
 }
 
 func makeTablesTable(longStringRefs bool) *Table {
@@ -0,0 +1,253 @@
+package msi
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func openTestPackage(t *testing.T, path string) *MSIPackage {
+	t.Helper()
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+
+	p, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func tableRows(t *testing.T, p *MSIPackage, name string) [][]Value {
+	t.Helper()
+
+	rows, err := p.SelectRows(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make([][]Value, 0)
+	for row := rows.Next(); row != nil; row = rows.Next() {
+		values = append(values, row.Values)
+	}
+	sort.Slice(values, func(i, j int) bool { return rowKey(p.Table(name), values[i]) < rowKey(p.Table(name), values[j]) })
+
+	return values
+}
+
+func tableNames(p *MSIPackage) []string {
+	names := make([]string, 0, len(p.Tables))
+	for name := range p.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Checks that the reopened package has the same tables, columns, rows,
+// summary information and streams as the one that was flushed.
+func comparePackages(t *testing.T, got *MSIPackage, want *MSIPackage, streams map[string][]byte) {
+	t.Helper()
+
+	if got.PackageType != want.PackageType {
+		t.Errorf("got package type %v, want %v", got.PackageType, want.PackageType)
+	}
+
+	if !reflect.DeepEqual(tableNames(got), tableNames(want)) {
+		t.Fatalf("got tables %v, want %v", tableNames(got), tableNames(want))
+	}
+	for _, name := range tableNames(want) {
+		if !reflect.DeepEqual(got.Table(name).Columns, want.Table(name).Columns) {
+			t.Errorf("table %s: got columns %+v, want %+v", name, got.Table(name).Columns, want.Table(name).Columns)
+		}
+		if gotRows, wantRows := tableRows(t, got, name), tableRows(t, want, name); !reflect.DeepEqual(gotRows, wantRows) {
+			t.Errorf("table %s: got rows %v, want %v", name, gotRows, wantRows)
+		}
+	}
+
+	summaries := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"title", got.SummaryInfo.Title(), want.SummaryInfo.Title()},
+		{"author", got.SummaryInfo.Author(), want.SummaryInfo.Author()},
+		{"template", got.SummaryInfo.Template(), want.SummaryInfo.Template()},
+		{"creating application", got.SummaryInfo.CreatingApplication(), want.SummaryInfo.CreatingApplication()},
+		{"creation time", got.SummaryInfo.CreationTime().UTC(), want.SummaryInfo.CreationTime().UTC()},
+		{"page count", got.SummaryInfo.PageCount(), want.SummaryInfo.PageCount()},
+		{"word count", got.SummaryInfo.WordCount(), want.SummaryInfo.WordCount()},
+	}
+	for _, summary := range summaries {
+		if !reflect.DeepEqual(summary.got, summary.want) {
+			t.Errorf("got %s %v, want %v", summary.name, summary.got, summary.want)
+		}
+	}
+	gotCode, _ := got.SummaryInfo.PackageCode()
+	wantCode, _ := want.SummaryInfo.PackageCode()
+	if gotCode != wantCode {
+		t.Errorf("got package code %v, want %v", gotCode, wantCode)
+	}
+
+	for name, data := range streams {
+		stream, err := got.ReadStream(name)
+		if err != nil {
+			t.Errorf("stream %s: %v", name, err)
+			continue
+		}
+		gotData, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gotData, data) {
+			t.Errorf("stream %s: got %q, want %q", name, gotData, data)
+		}
+	}
+}
+
+func TestCreateFlushOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.msi")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	p, err := Create(file, PackageTypeInstaller)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.SummaryInfo.SetAuthor("go-msi")
+	p.SummaryInfo.SetTemplate("x64;1033,1031")
+	p.SummaryInfo.SetPackageCode(uuid.MustParse("01234567-89ab-cdef-0123-456789abcdef"))
+	p.SummaryInfo.SetCreationTime(time.Date(2021, 6, 15, 10, 30, 0, 0, time.UTC))
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(p.CreateTable("Property", []*Column{
+		NewColumnBuilder("Property").SetPrimaryKey().IDString(72),
+		NewColumnBuilder("Value").SetLocalizable().TextString(0),
+	}))
+	must(p.CreateTable("Directory", []*Column{
+		NewColumnBuilder("Directory").SetPrimaryKey().IDString(72),
+		NewColumnBuilder("Directory_Parent").SetNullable().SetForeignKey("Directory", 1).IDString(72),
+		NewColumnBuilder("DefaultDir").SetLocalizable().SetCategory(CategoryDefaultDir).String(255),
+	}))
+	must(p.CreateTable("Registry", []*Column{
+		NewColumnBuilder("Registry").SetPrimaryKey().IDString(72),
+		NewColumnBuilder("Root").SetRange(-1, 3).Int16(),
+		NewColumnBuilder("Key").SetLocalizable().SetCategory(CategoryRegPath).String(255),
+		NewColumnBuilder("Name").SetNullable().SetLocalizable().FormattedString(255),
+		NewColumnBuilder("Size").SetNullable().Int32(),
+	}))
+	must(p.InsertRows("Property", [][]Value{
+		{"ProductName", "Round Trip"},
+		{"ProductVersion", "1.2.3"},
+		{"Manufacturer", "Ünïcödé"},
+	}))
+	must(p.InsertRows("Directory", [][]Value{
+		{"TARGETDIR", nil, "SourceDir"},
+		{"ProgramFilesFolder", "TARGETDIR", "PFiles"},
+		{"INSTALLDIR", "ProgramFilesFolder", "APP|My App"},
+	}))
+	must(p.InsertRows("Registry", [][]Value{
+		{"reg1", 2, "Software\\Round Trip", "Version", 100000},
+		{"reg2", -1, "Software\\Round Trip", nil, nil},
+	}))
+
+	streams := map[string][]byte{"Binary.data": {0, 1, 2, 3, 0xff}}
+	for name, data := range streams {
+		p.writeStream(NameEncode(name, false), data)
+	}
+
+	must(p.Flush())
+
+	reopened := openTestPackage(t, path)
+	comparePackages(t, reopened, p, streams)
+
+	// Changes to the reopened package survive a second flush.
+	_, err = reopened.UpdateRows("Property", map[string]Value{"Value": "2.0.0"}, func(row *Row) bool {
+		return row.GetString("Property") == "ProductVersion"
+	})
+	must(err)
+	_, err = reopened.DeleteRows("Registry", func(row *Row) bool { return row.GetString("Registry") == "reg2" })
+	must(err)
+	must(reopened.DropTable("Directory"))
+	must(reopened.AddColumn("Registry", NewColumnBuilder("Flags").SetNullable().Int16()))
+	reopened.SummaryInfo.SetAuthor("someone else")
+	must(reopened.Flush())
+
+	comparePackages(t, openTestPackage(t, path), reopened, streams)
+
+	if reopened.HasTable("Directory") {
+		t.Errorf("dropped table Directory is still present")
+	}
+	if rows := tableRows(t, reopened, "Registry"); !reflect.DeepEqual(rows, [][]Value{{"reg1", 2, "Software\\Round Trip", "Version", 100000, nil}}) {
+		t.Errorf("got Registry rows %v", rows)
+	}
+}
+
+func TestIntegerColumnTypeBits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.msi")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	p, err := Create(file, PackageTypeInstaller)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.CreateTable("Numbers", []*Column{
+		NewColumnBuilder("Short").SetPrimaryKey().Int16(),
+		NewColumnBuilder("NullableShort").SetNullable().Int16(),
+		NewColumnBuilder("Long").Int32(),
+		NewColumnBuilder("NullableLong").SetNullable().Int32(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The type bits Windows Installer writes for i2, I2, i4 and I4 columns,
+	// with 0x2000 marking the primary key.
+	want := map[string]int{
+		"Short":         0x2502,
+		"NullableShort": 0x1502,
+		"Long":          0x104,
+		"NullableLong":  0x1104,
+	}
+	for _, row := range tableRows(t, openTestPackage(t, path), COLUMNS_TABLE_NAME) {
+		if row[0] != "Numbers" {
+			continue
+		}
+		name := row[2].(string)
+		if row[3] != want[name] {
+			t.Errorf("column %s: got type bits %#x, want %#x", name, row[3], want[name])
+		}
+		delete(want, name)
+	}
+	if len(want) != 0 {
+		t.Errorf("columns %v missing from %s", want, COLUMNS_TABLE_NAME)
+	}
+}
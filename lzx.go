@@ -0,0 +1,573 @@
+package msi
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	lzxMinMatch            = 2
+	lzxNumChars            = 256
+	lzxNumPrimaryLengths   = 7
+	lzxNumSecondaryLengths = 249
+	lzxPretreeNumElements  = 20
+	lzxAlignedNumElements  = 8
+	lzxMaxCodeLength       = 16
+
+	lzxBlockTypeVerbatim     = 1
+	lzxBlockTypeAligned      = 2
+	lzxBlockTypeUncompressed = 3
+
+	// Calls to x86 CALL instructions are only translated within the first
+	// 32768 frames.
+	lzxMaxIntelFrames = 32768
+)
+
+var lzxExtraBits [51]uint
+var lzxPositionBase [51]uint32
+
+func init() {
+	extra := uint(0)
+	for i := 0; i < len(lzxExtraBits); i += 2 {
+		lzxExtraBits[i] = extra
+		if i+1 < len(lzxExtraBits) {
+			lzxExtraBits[i+1] = extra
+		}
+		if i != 0 && extra < 17 {
+			extra++
+		}
+	}
+
+	for i := 1; i < len(lzxPositionBase); i++ {
+		lzxPositionBase[i] = lzxPositionBase[i-1] + 1<<lzxExtraBits[i-1]
+	}
+}
+
+// Decompresses LZX data blocks. The window, repeated offsets and Huffman
+// code lengths carry over from one block to the next within a folder, and
+// an LZX block may span several data blocks.
+type lzxDecompressor struct {
+	window        []byte
+	windowPos     int
+	framePos      int
+	numMainSyms   int
+	headerRead    bool
+	intelFileSize int32
+	intelStarted  bool
+	frame         int
+
+	blockType      int
+	blockLength    int
+	blockRemaining int
+	pendingPadding bool
+	r0, r1, r2     uint32
+
+	mainLengths    []uint8
+	lengthLengths  []uint8
+	alignedLengths []uint8
+	mainTree       *huffmanTree
+	lengthTree     *huffmanTree
+	alignedTree    *huffmanTree
+
+	bits *lzxBitReader
+}
+
+func newLZXDecompressor(windowBits int) (*lzxDecompressor, error) {
+	var positionSlots int
+	switch windowBits {
+	case 15:
+		positionSlots = 30
+	case 16:
+		positionSlots = 32
+	case 17:
+		positionSlots = 34
+	case 18:
+		positionSlots = 36
+	case 19:
+		positionSlots = 38
+	case 20:
+		positionSlots = 42
+	case 21:
+		positionSlots = 50
+	default:
+		return nil, fmt.Errorf("invalid LZX window size: %d", windowBits)
+	}
+
+	numMainSyms := lzxNumChars + positionSlots*8
+
+	return &lzxDecompressor{
+		window:         make([]byte, 1<<windowBits),
+		numMainSyms:    numMainSyms,
+		r0:             1,
+		r1:             1,
+		r2:             1,
+		mainLengths:    make([]uint8, numMainSyms),
+		lengthLengths:  make([]uint8, lzxNumSecondaryLengths),
+		alignedLengths: make([]uint8, lzxAlignedNumElements),
+	}, nil
+}
+
+// Decompresses one frame. In a cabinet each data block holds exactly one
+// frame, so the bit stream is realigned at every block.
+func (l *lzxDecompressor) decompress(data []byte, size int) ([]byte, error) {
+	l.bits = &lzxBitReader{data: data}
+
+	if !l.headerRead {
+		l.headerRead = true
+		if l.bits.readBits(1) == 1 {
+			high := l.bits.readBits(16)
+			low := l.bits.readBits(16)
+			l.intelFileSize = int32(high<<16 | low)
+		}
+	}
+
+	frameStart := l.framePos
+	frameEnd := frameStart + size
+	if frameEnd > len(l.window) {
+		return nil, fmt.Errorf("LZX frame runs past the end of the window")
+	}
+
+	for l.windowPos < frameEnd {
+		if l.blockRemaining == 0 {
+			err := l.readBlockHeader()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		switch l.blockType {
+		case lzxBlockTypeVerbatim, lzxBlockTypeAligned:
+			err = l.decodeCompressed(frameEnd)
+		case lzxBlockTypeUncompressed:
+			err = l.copyUncompressed(frameEnd)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if l.bits.overrun() {
+			return nil, fmt.Errorf("LZX data block is truncated")
+		}
+	}
+
+	// A match may run past the end of the frame; those bytes are already in
+	// the window and are output with the next frame.
+	out := make([]byte, size)
+	copy(out, l.window[frameStart:frameEnd])
+
+	if l.intelStarted && l.intelFileSize != 0 && l.frame < lzxMaxIntelFrames && size > 10 {
+		l.translateIntelCalls(out, int32(l.frame*cabMaxBlockSize))
+	}
+
+	l.frame++
+	l.framePos = frameEnd
+	if l.framePos == len(l.window) {
+		l.framePos = 0
+		l.windowPos = 0
+	}
+
+	return out, nil
+}
+
+func (l *lzxDecompressor) readBlockHeader() error {
+	if l.pendingPadding {
+		l.pendingPadding = false
+		l.bits.skipBytes(1)
+	}
+
+	l.blockType = int(l.bits.readBits(3))
+	high := l.bits.readBits(16)
+	low := l.bits.readBits(8)
+	l.blockLength = int(high<<8 | low)
+	l.blockRemaining = l.blockLength
+
+	if l.blockLength == 0 {
+		return fmt.Errorf("LZX block is empty")
+	}
+
+	var err error
+	switch l.blockType {
+	case lzxBlockTypeAligned:
+		for i := range l.alignedLengths {
+			l.alignedLengths[i] = uint8(l.bits.readBits(3))
+		}
+		l.alignedTree, err = newHuffmanTree(l.alignedLengths)
+		if err != nil {
+			return err
+		}
+		fallthrough
+	case lzxBlockTypeVerbatim:
+		err = l.readLengths(l.mainLengths, 0, lzxNumChars)
+		if err != nil {
+			return err
+		}
+		err = l.readLengths(l.mainLengths, lzxNumChars, l.numMainSyms)
+		if err != nil {
+			return err
+		}
+		l.mainTree, err = newHuffmanTree(l.mainLengths)
+		if err != nil {
+			return err
+		}
+		if l.mainLengths[0xe8] != 0 {
+			l.intelStarted = true
+		}
+
+		err = l.readLengths(l.lengthLengths, 0, lzxNumSecondaryLengths)
+		if err != nil {
+			return err
+		}
+		l.lengthTree, err = newHuffmanTree(l.lengthLengths)
+		if err != nil {
+			return err
+		}
+	case lzxBlockTypeUncompressed:
+		l.intelStarted = true
+		l.bits.alignToWord()
+		var offsets [12]byte
+		l.bits.readRaw(offsets[:])
+		l.r0 = binary.LittleEndian.Uint32(offsets[0:4])
+		l.r1 = binary.LittleEndian.Uint32(offsets[4:8])
+		l.r2 = binary.LittleEndian.Uint32(offsets[8:12])
+	default:
+		return fmt.Errorf("invalid LZX block type: %d", l.blockType)
+	}
+
+	return nil
+}
+
+// Reads the code lengths for lengths[first:last], which are coded as deltas
+// from the previous block's lengths using a pretree.
+func (l *lzxDecompressor) readLengths(lengths []uint8, first int, last int) error {
+	pretreeLengths := make([]uint8, lzxPretreeNumElements)
+	for i := range pretreeLengths {
+		pretreeLengths[i] = uint8(l.bits.readBits(4))
+	}
+
+	pretree, err := newHuffmanTree(pretreeLengths)
+	if err != nil {
+		return err
+	}
+
+	for x := first; x < last; {
+		code, err := pretree.decode(l.bits)
+		if err != nil {
+			return err
+		}
+
+		switch code {
+		case 17, 18:
+			var run int
+			if code == 17 {
+				run = int(l.bits.readBits(4)) + 4
+			} else {
+				run = int(l.bits.readBits(5)) + 20
+			}
+			if x+run > last {
+				return fmt.Errorf("LZX code length run overflows the tree")
+			}
+			for ; run > 0; run-- {
+				lengths[x] = 0
+				x++
+			}
+		case 19:
+			run := int(l.bits.readBits(1)) + 4
+			code, err = pretree.decode(l.bits)
+			if err != nil {
+				return err
+			}
+			if code > 16 {
+				return fmt.Errorf("invalid LZX code length")
+			}
+			if x+run > last {
+				return fmt.Errorf("LZX code length run overflows the tree")
+			}
+			value := (int(lengths[x]) - code + 17) % 17
+			for ; run > 0; run-- {
+				lengths[x] = uint8(value)
+				x++
+			}
+		default:
+			lengths[x] = uint8((int(lengths[x]) - code + 17) % 17)
+			x++
+		}
+	}
+
+	return nil
+}
+
+func (l *lzxDecompressor) decodeCompressed(frameEnd int) error {
+	for l.blockRemaining > 0 && l.windowPos < frameEnd {
+		mainElement, err := l.mainTree.decode(l.bits)
+		if err != nil {
+			return err
+		}
+
+		if mainElement < lzxNumChars {
+			l.window[l.windowPos] = byte(mainElement)
+			l.windowPos++
+			l.blockRemaining--
+			continue
+		}
+
+		mainElement -= lzxNumChars
+		matchLength := mainElement & lzxNumPrimaryLengths
+		if matchLength == lzxNumPrimaryLengths {
+			footer, err := l.lengthTree.decode(l.bits)
+			if err != nil {
+				return err
+			}
+			matchLength += footer
+		}
+		matchLength += lzxMinMatch
+
+		var matchOffset uint32
+		switch slot := mainElement >> 3; slot {
+		case 0:
+			matchOffset = l.r0
+		case 1:
+			matchOffset = l.r1
+			l.r1 = l.r0
+			l.r0 = matchOffset
+		case 2:
+			matchOffset = l.r2
+			l.r2 = l.r0
+			l.r0 = matchOffset
+		default:
+			extra := lzxExtraBits[slot]
+			matchOffset = lzxPositionBase[slot] - 2
+			if l.blockType == lzxBlockTypeAligned && extra >= 3 {
+				matchOffset += l.bits.readBits(extra-3) << 3
+				aligned, err := l.alignedTree.decode(l.bits)
+				if err != nil {
+					return err
+				}
+				matchOffset += uint32(aligned)
+			} else if extra > 0 {
+				matchOffset += l.bits.readBits(extra)
+			}
+			l.r2 = l.r1
+			l.r1 = l.r0
+			l.r0 = matchOffset
+		}
+
+		if l.windowPos+matchLength > len(l.window) {
+			return fmt.Errorf("LZX match runs past the end of the window")
+		}
+		if int(matchOffset) > len(l.window) || matchOffset == 0 {
+			return fmt.Errorf("invalid LZX match offset: %d", matchOffset)
+		}
+
+		src := l.windowPos - int(matchOffset)
+		if src < 0 {
+			src += len(l.window)
+		}
+		for i := 0; i < matchLength; i++ {
+			l.window[l.windowPos] = l.window[src]
+			l.windowPos++
+			src++
+			if src == len(l.window) {
+				src = 0
+			}
+		}
+
+		l.blockRemaining -= matchLength
+		if l.blockRemaining < 0 {
+			return fmt.Errorf("LZX match runs past the end of the block")
+		}
+	}
+
+	return nil
+}
+
+func (l *lzxDecompressor) copyUncompressed(frameEnd int) error {
+	length := l.blockRemaining
+	if length > frameEnd-l.windowPos {
+		length = frameEnd - l.windowPos
+	}
+
+	if !l.bits.readRaw(l.window[l.windowPos : l.windowPos+length]) {
+		return fmt.Errorf("LZX uncompressed block is truncated")
+	}
+	l.windowPos += length
+	l.blockRemaining -= length
+
+	// Uncompressed blocks of odd length are followed by a padding byte,
+	// which is skipped now unless the data block ended with the block.
+	if l.blockRemaining == 0 && l.blockLength&1 == 1 {
+		if l.bits.remaining() > 0 {
+			l.bits.skipBytes(1)
+		} else {
+			l.pendingPadding = true
+		}
+	}
+
+	return nil
+}
+
+// Reverses the encoder's conversion of the relative targets of x86 CALL
+// instructions (0xE8) into absolute ones.
+func (l *lzxDecompressor) translateIntelCalls(data []byte, position int32) {
+	end := len(data) - 10
+	for i := 0; i < end; {
+		if data[i] != 0xe8 {
+			i++
+			position++
+			continue
+		}
+
+		absolute := int32(binary.LittleEndian.Uint32(data[i+1:]))
+		if absolute >= -position && absolute < l.intelFileSize {
+			var relative int32
+			if absolute >= 0 {
+				relative = absolute - position
+			} else {
+				relative = absolute + l.intelFileSize
+			}
+			binary.LittleEndian.PutUint32(data[i+1:], uint32(relative))
+		}
+
+		i += 5
+		position += 5
+	}
+}
+
+// Reads an LZX bit stream, which is made of little-endian 16-bit words
+// consumed from the most significant bit. Reading past the end yields
+// zero bits.
+type lzxBitReader struct {
+	data  []byte
+	pos   int
+	buf   uint64
+	count uint
+}
+
+func (b *lzxBitReader) fill(n uint) {
+	for b.count < n {
+		var word uint64
+		if b.pos+1 < len(b.data) {
+			word = uint64(b.data[b.pos]) | uint64(b.data[b.pos+1])<<8
+		}
+		b.pos += 2
+		b.buf |= word << (48 - b.count)
+		b.count += 16
+	}
+}
+
+func (b *lzxBitReader) peekBits(n uint) uint32 {
+	b.fill(n)
+	return uint32(b.buf >> (64 - n))
+}
+
+func (b *lzxBitReader) removeBits(n uint) {
+	b.buf <<= n
+	b.count -= n
+}
+
+func (b *lzxBitReader) readBits(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+
+	value := b.peekBits(n)
+	b.removeBits(n)
+	return value
+}
+
+// Skips to the next 16-bit boundary before raw data. If the stream is
+// already on a boundary, a whole word of padding is skipped.
+func (b *lzxBitReader) alignToWord() {
+	if b.count%16 == 0 {
+		if b.count == 0 {
+			b.pos += 2
+		} else {
+			b.count -= 16
+		}
+	}
+	b.pos -= 2 * int(b.count/16)
+	b.buf = 0
+	b.count = 0
+}
+
+// Copies raw bytes from the stream, which must be word aligned. Returns
+// false if the data ran out.
+func (b *lzxBitReader) readRaw(out []byte) bool {
+	if b.pos+len(out) > len(b.data) || b.pos < 0 {
+		return false
+	}
+
+	copy(out, b.data[b.pos:])
+	b.pos += len(out)
+	return true
+}
+
+// Returns the number of raw bytes left, which is only meaningful when the
+// stream is word aligned.
+func (b *lzxBitReader) remaining() int {
+	return len(b.data) - b.pos
+}
+
+func (b *lzxBitReader) skipBytes(n int) {
+	b.pos += n
+}
+
+// Returns true if more bits were consumed than the data holds.
+func (b *lzxBitReader) overrun() bool {
+	return b.pos-int(b.count/8) > len(b.data)+2
+}
+
+// A canonical Huffman code, decoded one bit at a time.
+type huffmanTree struct {
+	counts  [lzxMaxCodeLength + 1]int
+	symbols []int
+}
+
+func newHuffmanTree(lengths []uint8) (*huffmanTree, error) {
+	tree := &huffmanTree{symbols: make([]int, 0, len(lengths))}
+	for _, length := range lengths {
+		if length > lzxMaxCodeLength {
+			return nil, fmt.Errorf("invalid Huffman code length: %d", length)
+		}
+		tree.counts[length]++
+	}
+
+	// Check that the code is not over-subscribed.
+	left := 1
+	for length := 1; length <= lzxMaxCodeLength; length++ {
+		left <<= 1
+		left -= tree.counts[length]
+		if left < 0 {
+			return nil, fmt.Errorf("invalid Huffman code lengths")
+		}
+	}
+
+	for length := 1; length <= lzxMaxCodeLength; length++ {
+		for symbol, symbolLength := range lengths {
+			if int(symbolLength) == length {
+				tree.symbols = append(tree.symbols, symbol)
+			}
+		}
+	}
+
+	return tree, nil
+}
+
+func (t *huffmanTree) decode(bits *lzxBitReader) (int, error) {
+	code := 0
+	first := 0
+	index := 0
+	for length := 1; length <= lzxMaxCodeLength; length++ {
+		code |= int(bits.readBits(1))
+		count := t.counts[length]
+		if code-first < count {
+			return t.symbols[index+code-first], nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+
+	return 0, fmt.Errorf("invalid Huffman code")
+}
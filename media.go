@@ -0,0 +1,220 @@
+package msi
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Opens a cabinet that is not embedded in the package, typically by looking
+// for it next to the package on disk. Readers that implement io.Closer are
+// closed once the cabinet has been read.
+type CabinetResolver func(name string) (io.ReadSeeker, error)
+
+// A file extracted from one of the package's cabinets.
+type ExtractedFile struct {
+	// The name of the file within the cabinet, which is its File table key.
+	Key string
+	// The File table row with that key, or nil if the table has none.
+	Row  *Row
+	Path string
+	Size int64
+}
+
+// Returns a resolver that opens external cabinets from the given directory.
+func DirectoryCabinetResolver(dir string) CabinetResolver {
+	return func(name string) (io.ReadSeeker, error) {
+		if !isPlainFileName(name) {
+			return nil, fmt.Errorf("invalid cabinet name: %s", name)
+		}
+
+		return os.Open(filepath.Join(dir, name))
+	}
+}
+
+// Extracts every file stored in the cabinets listed in the Media table into
+// the dest directory, naming each one after its File table key. Embedded
+// cabinets are read from the package's streams, and all others are opened
+// with the resolver.
+func (p *MSIPackage) ExtractFiles(dest string, resolver CabinetResolver) ([]*ExtractedFile, error) {
+	fileRows, err := p.fileRowsByKey()
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(dest, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	extracted := make([]*ExtractedFile, 0)
+	err = p.ExtractCabinets(resolver, func(file *CabinetFile, data io.Reader) error {
+		if !isPlainFileName(file.Name) {
+			return fmt.Errorf("invalid file name in cabinet: %s", file.Name)
+		}
+
+		path := filepath.Join(dest, file.Name)
+		out, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+
+		size, err := io.Copy(out, data)
+		closeErr := out.Close()
+		if err != nil {
+			return err
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+
+		err = os.Chtimes(path, file.Modified, file.Modified)
+		if err != nil {
+			return err
+		}
+
+		extracted = append(extracted, &ExtractedFile{
+			Key:  file.Name,
+			Row:  fileRows[file.Name],
+			Path: path,
+			Size: size,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return extracted, nil
+}
+
+// Calls fn for every file stored in the cabinets listed in the Media table,
+// in order of disk ID. Cabinets that continue into others are followed, and
+// each cabinet is only read once.
+func (p *MSIPackage) ExtractCabinets(resolver CabinetResolver, fn func(file *CabinetFile, data io.Reader) error) error {
+	cabinets, err := p.mediaCabinets()
+	if err != nil {
+		return err
+	}
+
+	visited := make(map[string]struct{})
+	open := func(name string) (io.ReadSeeker, error) {
+		visited[strings.ToLower(strings.TrimPrefix(name, "#"))] = struct{}{}
+		return p.openCabinet(name, resolver)
+	}
+
+	for _, name := range cabinets {
+		if _, ok := visited[strings.ToLower(strings.TrimPrefix(name, "#"))]; ok {
+			continue
+		}
+
+		err = p.extractCabinet(name, open, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Extracts the cabinet set starting at the named cabinet, closing the
+// readers the resolver returned once it is done.
+func (p *MSIPackage) extractCabinet(name string, open func(name string) (io.ReadSeeker, error), fn func(file *CabinetFile, data io.Reader) error) error {
+	rdr, err := open(name)
+	if err != nil {
+		return err
+	}
+	if closer, ok := rdr.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	cab, err := OpenCabinet(rdr)
+	if err != nil {
+		return fmt.Errorf("cabinet %s: %v", name, err)
+	}
+
+	return ExtractCabinet(cab, open, fn)
+}
+
+// Returns the cabinets named in the Media table, ordered by disk ID.
+// Embedded cabinets keep their leading '#'.
+func (p *MSIPackage) mediaCabinets() ([]string, error) {
+	if !p.HasTable(MEDIA_TABLE_NAME) {
+		return make([]string, 0), nil
+	}
+
+	rows, err := p.SelectRows(MEDIA_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	type media struct {
+		diskID  int
+		cabinet string
+	}
+	medias := make([]media, 0)
+	for row := rows.Next(); row != nil; row = rows.Next() {
+		cabinet := row.GetString("Cabinet")
+		if cabinet == "" {
+			continue
+		}
+		diskID, _ := row.GetInt("DiskId")
+		medias = append(medias, media{diskID, cabinet})
+	}
+	sort.SliceStable(medias, func(i, j int) bool { return medias[i].diskID < medias[j].diskID })
+
+	cabinets := make([]string, len(medias))
+	for i, m := range medias {
+		cabinets[i] = m.cabinet
+	}
+
+	return cabinets, nil
+}
+
+// Opens a cabinet by name. Names starting with '#' are embedded streams;
+// other names are looked up as streams first, since cabinets that continue
+// one another name the next cabinet without the '#'.
+func (p *MSIPackage) openCabinet(name string, resolver CabinetResolver) (io.ReadSeeker, error) {
+	if strings.HasPrefix(name, "#") {
+		return p.ReadStream(name[1:])
+	}
+
+	if NameIsValid(name, false) && p.hasStream(NameEncode(name, false)) {
+		return p.ReadStream(name)
+	}
+
+	if resolver == nil {
+		return nil, fmt.Errorf("cabinet %s is external but no resolver was given", name)
+	}
+
+	return resolver(name)
+}
+
+func (p *MSIPackage) fileRowsByKey() (map[string]*Row, error) {
+	fileRows := make(map[string]*Row)
+	if !p.HasTable(FILE_TABLE_NAME) {
+		return fileRows, nil
+	}
+
+	rows, err := p.SelectRows(FILE_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	for row := rows.Next(); row != nil; row = rows.Next() {
+		fileRows[row.GetString("File")] = row
+	}
+
+	return fileRows, nil
+}
+
+// Returns true if the name can be used as a file name without escaping the
+// directory it is joined to.
+func isPlainFileName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\\:\x00")
+}
@@ -0,0 +1,1172 @@
+package msi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MODULE_SIGNATURE_TABLE_NAME     = "ModuleSignature"
+	MODULE_COMPONENTS_TABLE_NAME    = "ModuleComponents"
+	MODULE_DEPENDENCY_TABLE_NAME    = "ModuleDependency"
+	MODULE_EXCLUSION_TABLE_NAME     = "ModuleExclusion"
+	MODULE_CONFIGURATION_TABLE_NAME = "ModuleConfiguration"
+	MODULE_SUBSTITUTION_TABLE_NAME  = "ModuleSubstitution"
+	MODULE_IGNORE_TABLE_TABLE_NAME  = "ModuleIgnoreTable"
+
+	FEATURE_TABLE_NAME            = "Feature"
+	FEATURE_COMPONENTS_TABLE_NAME = "FeatureComponents"
+
+	// The stream holding the files of a merge module.
+	MERGE_MODULE_CABINET_STREAM_NAME = "MergeModule.CABinet"
+)
+
+// The sequence tables of a merge module and the package tables their
+// actions are merged into.
+var moduleSequenceTables = map[string]string{
+	"ModuleInstallExecuteSequence": "InstallExecuteSequence",
+	"ModuleInstallUISequence":      "InstallUISequence",
+	"ModuleAdminExecuteSequence":   "AdminExecuteSequence",
+	"ModuleAdminUISequence":        "AdminUISequence",
+	"ModuleAdvtExecuteSequence":    "AdvtExecuteSequence",
+	"ModuleAdvtUISequence":         "AdvtUISequence",
+}
+
+// Columns of module tables that refer to keys of other tables even when
+// the module's _Validation table does not say so.
+var moduleKeyReferences = map[tableColumnKey]string{
+	{MODULE_COMPONENTS_TABLE_NAME, "Component"}: COMPONENT_TABLE_NAME,
+}
+
+// The row of the ModuleSignature table identifying a merge module.
+type ModuleSignature struct {
+	// The module's name followed by a period and its GUID, with the GUID's
+	// hyphens replaced by underscores.
+	ModuleID string
+	Language int
+	Version  string
+}
+
+// A row of the ModuleComponents table, listing a component of the module.
+type ModuleComponent struct {
+	Component string
+	ModuleID  string
+	Language  int
+}
+
+// A row of the ModuleDependency table: a module that must also be merged.
+type ModuleDependency struct {
+	ModuleID         string
+	ModuleLanguage   int
+	RequiredID       string
+	RequiredLanguage int
+	// Empty if any version will do.
+	RequiredVersion string
+}
+
+// A row of the ModuleExclusion table: a module that must not be merged
+// into the same package.
+type ModuleExclusion struct {
+	ModuleID         string
+	ModuleLanguage   int
+	ExcludedID       string
+	ExcludedLanguage int
+	// Empty if the range is open at that end.
+	ExcludedMinVersion string
+	ExcludedMaxVersion string
+}
+
+// How the value of a configuration item is used.
+type ModuleConfigurationFormat int
+
+const (
+	// The value is substituted as text.
+	ModuleConfigurationFormatText ModuleConfigurationFormat = iota
+	// The value is a key of a row of the package.
+	ModuleConfigurationFormatKey
+	// The value is an integer.
+	ModuleConfigurationFormatInteger
+	// The value is an integer whose bits, selected by the item's
+	// ContextData mask, replace those of the substituted cell.
+	ModuleConfigurationFormatBitfield
+)
+
+func (f ModuleConfigurationFormat) String() string {
+	switch f {
+	case ModuleConfigurationFormatText:
+		return "Text"
+	case ModuleConfigurationFormatKey:
+		return "Key"
+	case ModuleConfigurationFormatInteger:
+		return "Integer"
+	case ModuleConfigurationFormatBitfield:
+		return "Bitfield"
+	default:
+		return "Unknown"
+	}
+}
+
+// The value of a configuration item may not be null.
+const MODULE_CONFIGURATION_NON_NULLABLE = 0x2
+
+// A row of the ModuleConfiguration table: an item whose value is chosen
+// when the module is merged.
+type ModuleConfiguration struct {
+	Name        string
+	Format      ModuleConfigurationFormat
+	Type        string
+	ContextData string
+	// Nil if the item has no default.
+	DefaultValue Value
+	Attributes   int
+	DisplayName  string
+	Description  string
+	HelpLocation string
+	HelpKeyword  string
+}
+
+// A row of the ModuleSubstitution table: a cell of the module whose value
+// is computed from configuration items when the module is merged.
+type ModuleSubstitution struct {
+	Table string
+	// The key values of the row, separated by semicolons.
+	Row    string
+	Column string
+	// Holds [=Item] references to configuration items. Nil sets the cell
+	// to null.
+	Value Value
+}
+
+// A merge module (.msm): a database of components and the rows that
+// install them, to be merged into packages.
+type MergeModule struct {
+	Package *MSIPackage
+}
+
+func OpenMergeModule(rdr io.ReadSeeker) (*MergeModule, error) {
+	p, err := Open(rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.HasTable(MODULE_SIGNATURE_TABLE_NAME) {
+		return nil, fmt.Errorf("package is not a merge module")
+	}
+
+	return &MergeModule{Package: p}, nil
+}
+
+// Returns the module's signature.
+func (m *MergeModule) Signature() (*ModuleSignature, error) {
+	rows, err := iceRows(m.Package, MODULE_SIGNATURE_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 {
+		return nil, fmt.Errorf("merge module has %d signatures, but should have 1", len(rows))
+	}
+
+	language, _ := rows[0].GetInt("Language")
+	return &ModuleSignature{
+		ModuleID: rows[0].GetString("ModuleID"),
+		Language: language,
+		Version:  rows[0].GetString("Version"),
+	}, nil
+}
+
+func (m *MergeModule) Components() ([]*ModuleComponent, error) {
+	rows, err := iceRows(m.Package, MODULE_COMPONENTS_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	components := make([]*ModuleComponent, 0, len(rows))
+	for _, row := range rows {
+		language, _ := row.GetInt("Language")
+		components = append(components, &ModuleComponent{
+			Component: row.GetString("Component"),
+			ModuleID:  row.GetString("ModuleID"),
+			Language:  language,
+		})
+	}
+
+	return components, nil
+}
+
+func (m *MergeModule) Dependencies() ([]*ModuleDependency, error) {
+	rows, err := iceRows(m.Package, MODULE_DEPENDENCY_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	dependencies := make([]*ModuleDependency, 0, len(rows))
+	for _, row := range rows {
+		moduleLanguage, _ := row.GetInt("ModuleLanguage")
+		requiredLanguage, _ := row.GetInt("RequiredLanguage")
+		dependencies = append(dependencies, &ModuleDependency{
+			ModuleID:         row.GetString("ModuleID"),
+			ModuleLanguage:   moduleLanguage,
+			RequiredID:       row.GetString("RequiredID"),
+			RequiredLanguage: requiredLanguage,
+			RequiredVersion:  row.GetString("RequiredVersion"),
+		})
+	}
+
+	return dependencies, nil
+}
+
+func (m *MergeModule) Exclusions() ([]*ModuleExclusion, error) {
+	return moduleExclusions(m.Package)
+}
+
+func moduleExclusions(p *MSIPackage) ([]*ModuleExclusion, error) {
+	rows, err := iceRows(p, MODULE_EXCLUSION_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	exclusions := make([]*ModuleExclusion, 0, len(rows))
+	for _, row := range rows {
+		moduleLanguage, _ := row.GetInt("ModuleLanguage")
+		excludedLanguage, _ := row.GetInt("ExcludedLanguage")
+		exclusions = append(exclusions, &ModuleExclusion{
+			ModuleID:           row.GetString("ModuleID"),
+			ModuleLanguage:     moduleLanguage,
+			ExcludedID:         row.GetString("ExcludedID"),
+			ExcludedLanguage:   excludedLanguage,
+			ExcludedMinVersion: row.GetString("ExcludedMinVersion"),
+			ExcludedMaxVersion: row.GetString("ExcludedMaxVersion"),
+		})
+	}
+
+	return exclusions, nil
+}
+
+func (m *MergeModule) Configurations() ([]*ModuleConfiguration, error) {
+	rows, err := iceRows(m.Package, MODULE_CONFIGURATION_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	configurations := make([]*ModuleConfiguration, 0, len(rows))
+	for _, row := range rows {
+		format, _ := row.GetInt("Format")
+		attributes, _ := row.GetInt("Attributes")
+		configurations = append(configurations, &ModuleConfiguration{
+			Name:         row.GetString("Name"),
+			Format:       ModuleConfigurationFormat(format),
+			Type:         row.GetString("Type"),
+			ContextData:  row.GetString("ContextData"),
+			DefaultValue: row.Get("DefaultValue"),
+			Attributes:   attributes,
+			DisplayName:  row.GetString("DisplayName"),
+			Description:  row.GetString("Description"),
+			HelpLocation: row.GetString("HelpLocation"),
+			HelpKeyword:  row.GetString("HelpKeyword"),
+		})
+	}
+
+	return configurations, nil
+}
+
+func (m *MergeModule) Substitutions() ([]*ModuleSubstitution, error) {
+	rows, err := iceRows(m.Package, MODULE_SUBSTITUTION_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	substitutions := make([]*ModuleSubstitution, 0, len(rows))
+	for _, row := range rows {
+		substitutions = append(substitutions, &ModuleSubstitution{
+			Table:  row.GetString("Table"),
+			Row:    row.GetString("Row"),
+			Column: row.GetString("Column"),
+			Value:  row.Get("Value"),
+		})
+	}
+
+	return substitutions, nil
+}
+
+// Returns the tables of the module that are not merged, as listed in the
+// ModuleIgnoreTable table.
+func (m *MergeModule) IgnoredTables() ([]string, error) {
+	rows, err := iceRows(m.Package, MODULE_IGNORE_TABLE_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]string, 0, len(rows))
+	for _, row := range rows {
+		tables = append(tables, row.GetString("Table"))
+	}
+
+	return tables, nil
+}
+
+// Opens the cabinet holding the module's files, named by their File keys.
+// Returns nil if the module has no files.
+func (m *MergeModule) OpenCabinet() (*Cabinet, error) {
+	data, err := m.cabinetData()
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	return OpenCabinet(bytes.NewReader(data))
+}
+
+func (m *MergeModule) cabinetData() ([]byte, error) {
+	if !m.Package.hasStream(NameEncode(MERGE_MODULE_CABINET_STREAM_NAME, false)) {
+		return nil, nil
+	}
+
+	stream, err := m.Package.ReadStream(MERGE_MODULE_CABINET_STREAM_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(stream)
+}
+
+// Returns the suffix the module's keys end with: the GUID of its module
+// ID, with underscores for hyphens.
+func moduleKeySuffix(moduleID string) (string, error) {
+	idx := strings.LastIndex(moduleID, ".")
+	if idx == -1 || idx == len(moduleID)-1 {
+		return "", fmt.Errorf("module ID %s has no GUID", moduleID)
+	}
+
+	return moduleID[idx+1:], nil
+}
+
+// The state of a merge: the module's rows, rewritten for the package
+// before they are inserted.
+type moduleMerge struct {
+	p      *MSIPackage
+	module *MergeModule
+	suffix string
+	tables map[string]*Table
+	rows   map[string][][]Value
+	// New keys of the module rows that lacked the module's suffix, by table.
+	renames map[string]map[string]string
+}
+
+// Merges a merge module into the package, as the mergemod tool does. The
+// module's rows are inserted after its configurable substitutions are made
+// with the values in config, or the items' defaults. Keys of rows that
+// other rows refer to get the module's GUID suffix if they lack it, except
+// for File keys, which name the files in the module's cabinet, standard
+// folders and properties. Directories under the module's TARGETDIR are
+// moved under redirectDir unless it is empty, and the module's components
+// are added to the feature featureKey unless it is empty. Sequenced
+// actions are scheduled, relative to their base action if they have no
+// sequence number, and the module's cabinet is embedded with a new Media
+// row. Rows that already exist with the same values are skipped; other
+// conflicts fail the merge. On error the package should be reopened.
+func (p *MSIPackage) Merge(module *MergeModule, featureKey string, redirectDir string, config map[string]string) error {
+	signature, err := module.Signature()
+	if err != nil {
+		return err
+	}
+
+	suffix, err := moduleKeySuffix(signature.ModuleID)
+	if err != nil {
+		return err
+	}
+
+	err = p.checkModuleExclusions(module, signature)
+	if err != nil {
+		return err
+	}
+
+	m := &moduleMerge{
+		p:       p,
+		module:  module,
+		suffix:  suffix,
+		tables:  make(map[string]*Table),
+		rows:    make(map[string][][]Value),
+		renames: make(map[string]map[string]string),
+	}
+
+	err = m.loadRows()
+	if err != nil {
+		return err
+	}
+
+	err = m.substitute(config)
+	if err != nil {
+		return err
+	}
+
+	m.renameKeys()
+	m.redirect(redirectDir)
+
+	err = m.mergeCabinet()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(m.rows))
+	for name := range m.rows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err = m.insert(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = m.addFeatureComponents(featureKey)
+	if err != nil {
+		return err
+	}
+
+	sequenceNames := make([]string, 0, len(moduleSequenceTables))
+	for name := range moduleSequenceTables {
+		sequenceNames = append(sequenceNames, name)
+	}
+	sort.Strings(sequenceNames)
+	for _, name := range sequenceNames {
+		err = m.mergeSequence(name, moduleSequenceTables[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fails if the module excludes a module merged into the package, or one
+// merged into the package excludes the module.
+func (p *MSIPackage) checkModuleExclusions(module *MergeModule, signature *ModuleSignature) error {
+	merged, err := iceRows(p, MODULE_SIGNATURE_TABLE_NAME)
+	if err != nil {
+		return err
+	}
+
+	exclusions, err := module.Exclusions()
+	if err != nil {
+		return err
+	}
+	for _, exclusion := range exclusions {
+		for _, row := range merged {
+			language, _ := row.GetInt("Language")
+			if exclusion.excludes(row.GetString("ModuleID"), language, row.GetString("Version")) {
+				return fmt.Errorf("module %s excludes module %s, which the package has", signature.ModuleID, exclusion.ExcludedID)
+			}
+		}
+	}
+
+	exclusions, err = moduleExclusions(p)
+	if err != nil {
+		return err
+	}
+	for _, exclusion := range exclusions {
+		if exclusion.excludes(signature.ModuleID, signature.Language, signature.Version) {
+			return fmt.Errorf("module %s is excluded by module %s, which the package has", signature.ModuleID, exclusion.ModuleID)
+		}
+	}
+
+	return nil
+}
+
+// Returns true if the exclusion applies to the given module. A language
+// of 0 matches any language, and a negative one any but its opposite.
+func (e *ModuleExclusion) excludes(moduleID string, language int, version string) bool {
+	if !strings.EqualFold(e.ExcludedID, moduleID) {
+		return false
+	}
+
+	switch {
+	case e.ExcludedLanguage > 0 && e.ExcludedLanguage != language:
+		return false
+	case e.ExcludedLanguage < 0 && -e.ExcludedLanguage == language:
+		return false
+	}
+
+	if e.ExcludedMinVersion != "" && compareVersions(version, e.ExcludedMinVersion, 4) < 0 {
+		return false
+	}
+	if e.ExcludedMaxVersion != "" && compareVersions(version, e.ExcludedMaxVersion, 4) > 0 {
+		return false
+	}
+
+	return true
+}
+
+// Reads the rows of the module's tables that are merged as they are.
+func (m *moduleMerge) loadRows() error {
+	skip := map[string]struct{}{
+		MODULE_CONFIGURATION_TABLE_NAME: {},
+		MODULE_SUBSTITUTION_TABLE_NAME:  {},
+		MODULE_IGNORE_TABLE_TABLE_NAME:  {},
+	}
+	for name := range moduleSequenceTables {
+		skip[name] = struct{}{}
+	}
+
+	ignored, err := m.module.IgnoredTables()
+	if err != nil {
+		return err
+	}
+	for _, name := range ignored {
+		skip[name] = struct{}{}
+	}
+
+	for name, table := range m.module.Package.Tables {
+		if _, ok := skip[name]; ok || strings.HasPrefix(name, "_") {
+			continue
+		}
+
+		rows, err := iceRows(m.module.Package, name)
+		if err != nil {
+			return err
+		}
+
+		m.tables[name] = table
+		m.rows[name] = make([][]Value, len(rows))
+		for i, row := range rows {
+			values := make([]Value, len(table.Columns))
+			copy(values, row.Values)
+			m.rows[name][i] = values
+		}
+	}
+
+	return nil
+}
+
+// Makes the module's configurable substitutions.
+func (m *moduleMerge) substitute(config map[string]string) error {
+	items, err := m.module.Configurations()
+	if err != nil {
+		return err
+	}
+
+	itemsByName := make(map[string]*ModuleConfiguration)
+	values := make(map[string]Value)
+	for _, item := range items {
+		itemsByName[item.Name] = item
+
+		value := item.DefaultValue
+		if v, ok := config[item.Name]; ok {
+			value = v
+		}
+		if value == nil && item.Attributes&MODULE_CONFIGURATION_NON_NULLABLE != 0 {
+			return fmt.Errorf("configuration item %s needs a value", item.Name)
+		}
+		values[item.Name] = value
+	}
+
+	substitutions, err := m.module.Substitutions()
+	if err != nil {
+		return err
+	}
+
+	for _, substitution := range substitutions {
+		table := m.tables[substitution.Table]
+		if table == nil {
+			return fmt.Errorf("substitution refers to table %s, which is not merged", substitution.Table)
+		}
+
+		columnIndex := table.ColumnIndex(substitution.Column)
+		if columnIndex == -1 {
+			return fmt.Errorf("substitution refers to column %s of table %s, which does not exist", substitution.Column, substitution.Table)
+		}
+		column := table.Columns[columnIndex]
+
+		row := m.findRow(table, substitution.Row)
+		if row == nil {
+			return fmt.Errorf("substitution refers to row %s of table %s, which does not exist", substitution.Row, substitution.Table)
+		}
+
+		template, ok := substitution.Value.(string)
+		if !ok {
+			row[columnIndex] = nil
+			continue
+		}
+
+		if name, ok := bitfieldReference(template, itemsByName); ok {
+			row[columnIndex], err = substituteBitfield(itemsByName[name], values[name], row[columnIndex])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		str, err := substituteConfiguration(template, values)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case str == "":
+			row[columnIndex] = nil
+		case column.ColumnType == ColumnTypeStr:
+			row[columnIndex] = str
+		default:
+			num, err := strconv.Atoi(str)
+			if err != nil {
+				return fmt.Errorf("substitution of %s.%s gives %q, which is not an integer", substitution.Table, substitution.Column, str)
+			}
+			row[columnIndex] = num
+		}
+	}
+
+	return nil
+}
+
+func (m *moduleMerge) findRow(table *Table, key string) []Value {
+	parts := strings.Split(key, ";")
+	for _, row := range m.rows[table.Name] {
+		indices := table.PrimaryKeyIndices()
+		if len(indices) != len(parts) {
+			return nil
+		}
+
+		match := true
+		for i, idx := range indices {
+			if fmt.Sprintf("%v", row[idx]) != parts[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return row
+		}
+	}
+
+	return nil
+}
+
+// Returns the name of the item if the template is a lone reference to a
+// bitfield configuration item.
+func bitfieldReference(template string, items map[string]*ModuleConfiguration) (string, bool) {
+	if !strings.HasPrefix(template, "[=") || !strings.HasSuffix(template, "]") {
+		return "", false
+	}
+
+	name := template[2 : len(template)-1]
+	item, ok := items[name]
+	return name, ok && item.Format == ModuleConfigurationFormatBitfield
+}
+
+// Replaces the bits of the cell selected by the item's mask with those of
+// the item's value.
+func substituteBitfield(item *ModuleConfiguration, value Value, cell Value) (Value, error) {
+	mask, err := strconv.Atoi(item.ContextData)
+	if err != nil {
+		return nil, fmt.Errorf("bitfield configuration item %s has mask %q, which is not an integer", item.Name, item.ContextData)
+	}
+
+	bits, err := strconv.Atoi(fmt.Sprintf("%v", value))
+	if err != nil {
+		return nil, fmt.Errorf("bitfield configuration item %s has value %v, which is not an integer", item.Name, value)
+	}
+
+	current, _ := cell.(int)
+	return current&^mask | bits&mask, nil
+}
+
+// Replaces the [=Item] references of a substitution with the items'
+// values. [\c] stands for the character c.
+func substituteConfiguration(template string, values map[string]Value) (string, error) {
+	var sb strings.Builder
+	for {
+		start := strings.Index(template, "[")
+		if start == -1 {
+			sb.WriteString(template)
+			return sb.String(), nil
+		}
+		end := strings.Index(template[start:], "]")
+		if end == -1 {
+			sb.WriteString(template)
+			return sb.String(), nil
+		}
+		end += start
+
+		sb.WriteString(template[:start])
+		inner := template[start+1 : end]
+		switch {
+		case strings.HasPrefix(inner, "="):
+			value, ok := values[inner[1:]]
+			if !ok {
+				return "", fmt.Errorf("substitution refers to configuration item %s, which does not exist", inner[1:])
+			}
+			if value != nil {
+				sb.WriteString(fmt.Sprintf("%v", value))
+			}
+		case strings.HasPrefix(inner, `\`) && len(inner) == 2:
+			sb.WriteByte(inner[1])
+		case inner == `\` && end+1 < len(template) && template[end+1] == ']':
+			sb.WriteByte(']')
+			end++
+		default:
+			sb.WriteString(template[start : end+1])
+		}
+
+		template = template[end+1:]
+	}
+}
+
+// Gives the module's suffix to the keys of rows that other rows refer to
+// and that lack it, and rewrites the references.
+func (m *moduleMerge) renameKeys() {
+	referenced := make(map[string]struct{})
+	for _, name := range moduleKeyReferences {
+		referenced[name] = struct{}{}
+	}
+	for _, table := range m.tables {
+		for _, column := range table.Columns {
+			if column.ForeignKey.ColumnIndex != 1 {
+				continue
+			}
+			for _, name := range column.ForeignKey.Tables() {
+				referenced[name] = struct{}{}
+			}
+		}
+	}
+
+	folders := DefaultFolderProperties()
+	for name := range referenced {
+		table := m.tables[name]
+		if table == nil || name == FILE_TABLE_NAME || name == PROPERTY_TABLE_NAME {
+			continue
+		}
+		indices := table.PrimaryKeyIndices()
+		if len(indices) != 1 || indices[0] != 0 || table.Columns[0].ColumnType != ColumnTypeStr {
+			continue
+		}
+
+		renames := make(map[string]string)
+		for _, row := range m.rows[name] {
+			key, ok := row[0].(string)
+			if !ok || strings.HasSuffix(key, "."+m.suffix) {
+				continue
+			}
+			if name == DIRECTORY_TABLE_NAME {
+				if _, ok := folders[key]; ok || key == "TARGETDIR" {
+					continue
+				}
+			}
+
+			renames[key] = key + "." + m.suffix
+		}
+		if len(renames) > 0 {
+			m.renames[name] = renames
+		}
+	}
+
+	for name, table := range m.tables {
+		for _, row := range m.rows[name] {
+			for i, column := range table.Columns {
+				if i == 0 && m.renames[name] != nil {
+					row[i] = m.renamed([]string{name}, row[i])
+					continue
+				}
+				if keyTable, ok := moduleKeyReferences[tableColumnKey{name, column.Name}]; ok {
+					row[i] = m.renamed([]string{keyTable}, row[i])
+				} else if column.ForeignKey.ColumnIndex == 1 {
+					row[i] = m.renamed(column.ForeignKey.Tables(), row[i])
+				}
+			}
+		}
+	}
+}
+
+// Returns the new key of a value referring to one of the given tables, or
+// the value itself if it was not renamed.
+func (m *moduleMerge) renamed(tables []string, value Value) Value {
+	key, ok := value.(string)
+	if !ok {
+		return value
+	}
+
+	for _, table := range tables {
+		if newKey, ok := m.renames[table][key]; ok {
+			return newKey
+		}
+	}
+
+	return value
+}
+
+// Moves the directories at the root of the module under redirectDir.
+func (m *moduleMerge) redirect(redirectDir string) {
+	table := m.tables[DIRECTORY_TABLE_NAME]
+	if redirectDir == "" || table == nil {
+		return
+	}
+
+	parentIndex := table.ColumnIndex("Directory_Parent")
+	if parentIndex == -1 {
+		return
+	}
+
+	for _, row := range m.rows[DIRECTORY_TABLE_NAME] {
+		if row[parentIndex] == "TARGETDIR" && row[0] != "TARGETDIR" {
+			row[parentIndex] = redirectDir
+		}
+	}
+}
+
+// Embeds the module's cabinet in the package with a new Media row, and
+// numbers the module's files after the package's.
+func (m *moduleMerge) mergeCabinet() error {
+	data, err := m.module.cabinetData()
+	if err != nil || data == nil {
+		return err
+	}
+
+	cab, err := OpenCabinet(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	media := m.p.Table(MEDIA_TABLE_NAME)
+	if media == nil {
+		return fmt.Errorf("package has no %s table for the module's cabinet", MEDIA_TABLE_NAME)
+	}
+	mediaIndexes, err := columnIndexes(media, "DiskId", "LastSequence")
+	if err != nil {
+		return err
+	}
+
+	var lastSequence, lastDiskID int
+	mediaRows, err := iceRows(m.p, MEDIA_TABLE_NAME)
+	if err != nil {
+		return err
+	}
+	for _, row := range mediaRows {
+		if sequence, ok := row.GetInt("LastSequence"); ok && sequence > lastSequence {
+			lastSequence = sequence
+		}
+		if diskID, ok := row.GetInt("DiskId"); ok && diskID > lastDiskID {
+			lastDiskID = diskID
+		}
+	}
+
+	fileRows, err := iceRows(m.p, FILE_TABLE_NAME)
+	if err != nil {
+		return err
+	}
+	for _, row := range fileRows {
+		if sequence, ok := row.GetInt("Sequence"); ok && sequence > lastSequence {
+			lastSequence = sequence
+		}
+	}
+
+	if table := m.tables[FILE_TABLE_NAME]; table != nil {
+		sequences := make(map[string]int)
+		for i, file := range cab.Files {
+			sequences[file.Name] = lastSequence + i + 1
+		}
+
+		sequenceIndex := table.ColumnIndex("Sequence")
+		for _, row := range m.rows[FILE_TABLE_NAME] {
+			if sequence, ok := sequences[fmt.Sprintf("%v", row[0])]; ok && sequenceIndex != -1 {
+				row[sequenceIndex] = sequence
+			}
+		}
+	}
+
+	name := "MergeModule." + m.suffix
+	if !NameIsValid(name, false) {
+		return fmt.Errorf("invalid cabinet stream name: %s", name)
+	}
+	m.p.writeStream(NameEncode(name, false), data)
+
+	values := make([]Value, len(media.Columns))
+	values[mediaIndexes[0]] = lastDiskID + 1
+	values[mediaIndexes[1]] = lastSequence + len(cab.Files)
+	if idx := media.ColumnIndex("Cabinet"); idx != -1 {
+		values[idx] = "#" + name
+	}
+
+	return m.p.InsertRows(MEDIA_TABLE_NAME, [][]Value{values})
+}
+
+// Inserts the module's rows of a table, creating the table if the package
+// lacks it.
+func (m *moduleMerge) insert(name string) error {
+	moduleTable := m.tables[name]
+	if len(m.rows[name]) == 0 {
+		return nil
+	}
+
+	table := m.p.Table(name)
+	if table == nil {
+		columns := make([]*Column, len(moduleTable.Columns))
+		for i, column := range moduleTable.Columns {
+			c := *column
+			columns[i] = &c
+		}
+
+		err := m.p.CreateTable(name, columns)
+		if err != nil {
+			return err
+		}
+		table = m.p.Table(name)
+	}
+
+	for i, column := range moduleTable.Columns {
+		if table.ColumnIndex(column.Name) != -1 {
+			continue
+		}
+		for _, row := range m.rows[name] {
+			if row[i] != nil {
+				return fmt.Errorf("package table %s has no column %s for the module's rows", name, column.Name)
+			}
+		}
+	}
+
+	existing, err := iceRows(m.p, name)
+	if err != nil {
+		return err
+	}
+	existingRows := make(map[string][]Value)
+	for _, row := range existing {
+		existingRows[rowKey(table, row.Values)] = row.Values
+	}
+
+	rows := make([][]Value, 0)
+	for _, moduleRow := range m.rows[name] {
+		values := make([]Value, len(table.Columns))
+		for i, column := range table.Columns {
+			if idx := moduleTable.ColumnIndex(column.Name); idx != -1 {
+				values[i] = moduleRow[idx]
+			}
+		}
+
+		key := rowKey(table, values)
+		if old, ok := existingRows[key]; ok {
+			if reflect.DeepEqual(old, values) {
+				continue
+			}
+			return fmt.Errorf("module row %s of table %s conflicts with a row of the package", key, name)
+		}
+		existingRows[key] = values
+
+		rows = append(rows, values)
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return m.p.InsertRows(name, rows)
+}
+
+// Adds the module's components to the feature.
+func (m *moduleMerge) addFeatureComponents(featureKey string) error {
+	if featureKey == "" {
+		return nil
+	}
+
+	features, err := iceRows(m.p, FEATURE_TABLE_NAME)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, feature := range features {
+		if feature.GetString("Feature") == featureKey {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("package has no feature %s", featureKey)
+	}
+
+	table := m.p.Table(FEATURE_COMPONENTS_TABLE_NAME)
+	if table == nil {
+		return fmt.Errorf("package has no %s table", FEATURE_COMPONENTS_TABLE_NAME)
+	}
+	indexes, err := columnIndexes(table, "Feature_", "Component_")
+	if err != nil {
+		return err
+	}
+
+	existing, err := iceRows(m.p, FEATURE_COMPONENTS_TABLE_NAME)
+	if err != nil {
+		return err
+	}
+	existingRows := make(map[string]struct{})
+	for _, row := range existing {
+		existingRows[rowKey(table, row.Values)] = struct{}{}
+	}
+
+	moduleTable := m.tables[MODULE_COMPONENTS_TABLE_NAME]
+	if moduleTable == nil {
+		return nil
+	}
+	moduleIndexes, err := columnIndexes(moduleTable, "Component")
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]Value, 0)
+	for _, moduleRow := range m.rows[MODULE_COMPONENTS_TABLE_NAME] {
+		values := make([]Value, len(table.Columns))
+		values[indexes[0]] = featureKey
+		values[indexes[1]] = moduleRow[moduleIndexes[0]]
+
+		key := rowKey(table, values)
+		if _, ok := existingRows[key]; ok {
+			continue
+		}
+		existingRows[key] = struct{}{}
+
+		rows = append(rows, values)
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return m.p.InsertRows(FEATURE_COMPONENTS_TABLE_NAME, rows)
+}
+
+// Schedules the actions of one of the module's sequence tables in the
+// package's table. Actions the package already schedules are skipped.
+func (m *moduleMerge) mergeSequence(moduleTableName string, tableName string) error {
+	moduleRows, err := iceRows(m.module.Package, moduleTableName)
+	if err != nil || len(moduleRows) == 0 {
+		return err
+	}
+
+	table := m.p.Table(tableName)
+	if table == nil {
+		return fmt.Errorf("package has no %s table for the module's actions", tableName)
+	}
+	indexes, err := columnIndexes(table, "Action", "Sequence")
+	if err != nil {
+		return err
+	}
+
+	existing, err := iceRows(m.p, tableName)
+	if err != nil {
+		return err
+	}
+
+	scheduled := make(map[string]int)
+	used := make([]int, 0, len(existing))
+	for _, row := range existing {
+		sequence, ok := row.GetInt("Sequence")
+		scheduled[row.GetString("Action")] = sequence
+		if ok {
+			used = append(used, sequence)
+		}
+	}
+
+	pending := make([]*Row, 0, len(moduleRows))
+	for _, row := range moduleRows {
+		if _, ok := scheduled[m.actionName(row.GetString("Action"))]; !ok {
+			pending = append(pending, row)
+		}
+	}
+
+	rows := make([][]Value, 0)
+	for len(pending) > 0 {
+		waiting := make([]*Row, 0)
+		for _, row := range pending {
+			sequence, ok := row.GetInt("Sequence")
+			if !ok {
+				baseSequence, found := scheduled[m.actionName(row.GetString("BaseAction"))]
+				if !found {
+					waiting = append(waiting, row)
+					continue
+				}
+
+				after, _ := row.GetInt("After")
+				sequence, err = relativeSequence(used, baseSequence, after != 0)
+				if err != nil {
+					return fmt.Errorf("cannot schedule action %s: %v", row.GetString("Action"), err)
+				}
+			}
+
+			action := m.actionName(row.GetString("Action"))
+			scheduled[action] = sequence
+			used = append(used, sequence)
+
+			values := make([]Value, len(table.Columns))
+			values[indexes[0]] = action
+			values[indexes[1]] = sequence
+			if idx := table.ColumnIndex("Condition"); idx != -1 {
+				values[idx] = row.Get("Condition")
+			}
+			rows = append(rows, values)
+		}
+
+		if len(waiting) == len(pending) {
+			return fmt.Errorf("cannot schedule action %s: base action %s is not scheduled",
+				waiting[0].GetString("Action"), waiting[0].GetString("BaseAction"))
+		}
+		pending = waiting
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return m.p.InsertRows(tableName, rows)
+}
+
+// Returns the name of an action after its custom action or dialog was
+// renamed.
+func (m *moduleMerge) actionName(action string) string {
+	return m.renamed([]string{"CustomAction", "Dialog"}, action).(string)
+}
+
+// Returns a free sequence number just before or after the base action's,
+// halfway to the neighbouring action.
+func relativeSequence(used []int, base int, after bool) (int, error) {
+	if after {
+		next := -1
+		for _, sequence := range used {
+			if sequence > base && (next == -1 || sequence < next) {
+				next = sequence
+			}
+		}
+		if next == -1 {
+			return base + 1, nil
+		}
+
+		sequence := base + (next-base+1)/2
+		if sequence >= next {
+			return 0, fmt.Errorf("no sequence number is free after %d", base)
+		}
+		return sequence, nil
+	}
+
+	prev := 0
+	for _, sequence := range used {
+		if sequence < base && sequence > prev {
+			prev = sequence
+		}
+	}
+
+	sequence := prev + (base-prev)/2
+	if sequence <= prev {
+		return 0, fmt.Errorf("no sequence number is free before %d", base)
+	}
+	return sequence, nil
+}
+
+// Returns the indexes of the named columns, which the table must have.
+func columnIndexes(table *Table, names ...string) ([]int, error) {
+	indexes := make([]int, len(names))
+	for i, name := range names {
+		indexes[i] = table.ColumnIndex(name)
+		if indexes[i] == -1 {
+			return nil, fmt.Errorf("table %s has no %s column", table.Name, name)
+		}
+	}
+
+	return indexes, nil
+}
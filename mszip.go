@@ -0,0 +1,48 @@
+package msi
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// The size of the deflate window, which is carried over between blocks.
+const mszipWindowSize = 32768
+
+// Decompresses MSZIP data blocks. Each block is a complete deflate stream
+// prefixed with "CK", using the previous block's output as its dictionary.
+type mszipDecompressor struct {
+	window []byte
+}
+
+func newMSZIPDecompressor() *mszipDecompressor {
+	return &mszipDecompressor{}
+}
+
+func (m *mszipDecompressor) decompress(data []byte, size int) ([]byte, error) {
+	if len(data) < 2 || data[0] != 'C' || data[1] != 'K' {
+		return nil, fmt.Errorf("invalid MSZIP block signature")
+	}
+
+	rdr := flate.NewReaderDict(bytes.NewReader(data[2:]), m.window)
+	defer rdr.Close()
+
+	out := make([]byte, size)
+	_, err := io.ReadFull(rdr, out)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MSZIP block: %v", err)
+	}
+
+	if len(out) >= mszipWindowSize {
+		m.window = out[len(out)-mszipWindowSize:]
+	} else {
+		window := append(m.window, out...)
+		if len(window) > mszipWindowSize {
+			window = window[len(window)-mszipWindowSize:]
+		}
+		m.window = append([]byte(nil), window...)
+	}
+
+	return out, nil
+}
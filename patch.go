@@ -0,0 +1,398 @@
+package msi
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+const (
+	PATCH_METADATA_TABLE_NAME = "MsiPatchMetadata"
+	PATCH_SEQUENCE_TABLE_NAME = "MsiPatchSequence"
+)
+
+// A row of the MsiPatchMetadata table, describing the patch.
+type PatchMetadata struct {
+	// Empty for the standard properties, such as Description or
+	// Classification.
+	Company  string
+	Property string
+	Value    string
+}
+
+// A row of the MsiPatchSequence table, placing the patch in the order
+// patches of the same family are applied.
+type PatchSequence struct {
+	PatchFamily string
+	// Empty if the sequence applies to every target product.
+	ProductCode string
+	Sequence    string
+	Attributes  int
+}
+
+// A pair of transforms embedded in a patch. The first changes the target
+// product into the upgraded one; the patch transform adds the Media and
+// other rows that let the installer find the patch's files.
+type PatchTransform struct {
+	Name           string
+	Transform      *Transform
+	PatchTransform *Transform
+}
+
+// A patch (.msp). Its root storage is a database holding the
+// MsiPatchMetadata and MsiPatchSequence tables and the cabinets with the
+// patched files, and each pair of transforms is kept in its own storage.
+type Patch struct {
+	Package *MSIPackage
+}
+
+func OpenPatch(rdr io.ReadSeeker) (*Patch, error) {
+	p, err := Open(rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.PackageType != PackageTypePatch {
+		return nil, fmt.Errorf("package is not a patch")
+	}
+
+	return &Patch{Package: p}, nil
+}
+
+// Returns the patch code, the first GUID of the Revision Number summary
+// property.
+func (p *Patch) PatchCode() string {
+	codes := splitGUIDs(p.Package.SummaryInfo.RevisionNumber())
+	if len(codes) == 0 {
+		return ""
+	}
+
+	return codes[0]
+}
+
+// Returns the codes of the patches this patch replaces, which follow the
+// patch code in the Revision Number summary property.
+func (p *Patch) ObsoletedPatchCodes() []string {
+	codes := splitGUIDs(p.Package.SummaryInfo.RevisionNumber())
+	if len(codes) == 0 {
+		return codes
+	}
+
+	return codes[1:]
+}
+
+// Returns the product codes the patch can be applied to, listed in the
+// Template summary property.
+func (p *Patch) TargetProductCodes() []string {
+	return splitList(p.Package.SummaryInfo.Template())
+}
+
+// Returns the rows of the MsiPatchMetadata table, or none if the patch has
+// no such table.
+func (p *Patch) Metadata() ([]*PatchMetadata, error) {
+	rows, err := iceRows(p.Package, PATCH_METADATA_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make([]*PatchMetadata, 0, len(rows))
+	for _, row := range rows {
+		metadata = append(metadata, &PatchMetadata{
+			Company:  row.GetString("Company"),
+			Property: row.GetString("Property"),
+			Value:    row.GetString("Value"),
+		})
+	}
+
+	return metadata, nil
+}
+
+// Returns the value of a standard MsiPatchMetadata property, such as
+// DisplayName or Classification, or an empty string if it is not set.
+func (p *Patch) MetadataValue(property string) (string, error) {
+	metadata, err := p.Metadata()
+	if err != nil {
+		return "", err
+	}
+
+	for _, m := range metadata {
+		if m.Company == "" && m.Property == property {
+			return m.Value, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Returns the rows of the MsiPatchSequence table, or none if the patch has
+// no such table.
+func (p *Patch) Sequences() ([]*PatchSequence, error) {
+	rows, err := iceRows(p.Package, PATCH_SEQUENCE_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	sequences := make([]*PatchSequence, 0, len(rows))
+	for _, row := range rows {
+		attributes, _ := row.GetInt("Attributes")
+		sequences = append(sequences, &PatchSequence{
+			PatchFamily: row.GetString("PatchFamily"),
+			ProductCode: row.GetString("ProductCode"),
+			Sequence:    row.GetString("Sequence"),
+			Attributes:  attributes,
+		})
+	}
+
+	return sequences, nil
+}
+
+// Returns the embedded transforms in the order they are applied, as listed
+// in the Last Saved By summary property. Each storage name is prefixed by
+// ':', and the patch transform of a pair is named after the other with a
+// leading '#'.
+func (p *Patch) Transforms() ([]*PatchTransform, error) {
+	names := splitList(p.Package.SummaryInfo.LastSavedBy())
+
+	listed := make(map[string]struct{})
+	for _, name := range names {
+		listed[strings.TrimPrefix(name, ":")] = struct{}{}
+	}
+
+	transforms := make([]*PatchTransform, 0)
+	for _, name := range names {
+		storage := strings.TrimPrefix(name, ":")
+		if strings.HasPrefix(storage, "#") {
+			if _, ok := listed[storage[1:]]; ok {
+				continue
+			}
+		}
+
+		pair := &PatchTransform{Name: storage}
+		transform, err := p.Package.OpenStorageTransform(storage)
+		if err != nil {
+			return nil, err
+		}
+		pair.Transform = transform
+
+		if _, ok := listed["#"+storage]; ok {
+			pair.PatchTransform, err = p.Package.OpenStorageTransform("#" + storage)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		transforms = append(transforms, pair)
+	}
+
+	return transforms, nil
+}
+
+// Returns the names of the streams of the patch that hold cabinets. The
+// Media rows added by the patch transforms refer to them with a leading
+// '#'.
+func (p *Patch) Cabinets() ([]string, error) {
+	names := make([]string, 0)
+	streams := p.Package.Streams()
+	for name := streams.Next(); name != ""; name = streams.Next() {
+		stream, err := p.Package.ReadStream(name)
+		if err != nil {
+			return nil, err
+		}
+
+		signature := make([]byte, 4)
+		_, err = io.ReadFull(stream, signature)
+		if err == nil && string(signature) == CABINET_SIGNATURE {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// Opens one of the patch's cabinets by its stream name, with or without
+// the leading '#'.
+func (p *Patch) OpenCabinet(name string) (*Cabinet, error) {
+	stream, err := p.Package.ReadStream(strings.TrimPrefix(name, "#"))
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenCabinet(stream)
+}
+
+// Splits a semicolon-separated summary property, dropping empty entries.
+func splitList(str string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(str, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Splits a run of braced GUIDs, such as "{...}{...}".
+func splitGUIDs(str string) []string {
+	guids := make([]string, 0)
+	for {
+		start := strings.Index(str, "{")
+		if start == -1 {
+			return guids
+		}
+		end := strings.Index(str[start:], "}")
+		if end == -1 {
+			return guids
+		}
+
+		guids = append(guids, str[start:start+end+1])
+		str = str[start+end+1:]
+	}
+}
+
+// A row of the File, Component or Media table that applying a patch
+// inserted, updated or deleted.
+type PatchChange struct {
+	Table     string
+	Operation TransformOperation
+	// The row after the patch, or nil if the patch deleted it.
+	Row *Row
+	// The row before the patch, or nil if the patch inserted it.
+	Previous *Row
+}
+
+// The outcome of applying a patch to a package.
+type PatchResult struct {
+	// The transform pair that was applied.
+	Transform *PatchTransform
+	Changes   []*PatchChange
+}
+
+// The tables whose changes ApplyPatch reports.
+var patchReportTables = []string{FILE_TABLE_NAME, COMPONENT_TABLE_NAME, MEDIA_TABLE_NAME}
+
+// Applies a patch to the package, as the installer does when patching an
+// installed product. The first transform pair whose validation flags the
+// package satisfies is applied: the transform itself, then its patch
+// transform. The patch's cabinets named by the Media rows it adds are
+// copied into the package so ExtractFiles sees the patched files. As with
+// ApplyTransform, on error the package should be reopened.
+func (p *MSIPackage) ApplyPatch(patch *Patch) (*PatchResult, error) {
+	properties, err := p.propertyValues()
+	if err != nil {
+		return nil, err
+	}
+
+	targeted := false
+	for _, code := range patch.TargetProductCodes() {
+		if strings.EqualFold(code, properties["ProductCode"]) {
+			targeted = true
+		}
+	}
+	if !targeted {
+		return nil, fmt.Errorf("patch does not target product %q", properties["ProductCode"])
+	}
+
+	pairs, err := patch.Transforms()
+	if err != nil {
+		return nil, err
+	}
+
+	var pair *PatchTransform
+	for _, candidate := range pairs {
+		if p.checkTransformTarget(candidate.Transform) == nil {
+			pair = candidate
+			break
+		}
+	}
+	if pair == nil {
+		return nil, fmt.Errorf("patch has no transform that applies to product %q version %q language %q",
+			properties["ProductCode"], properties["ProductVersion"], properties["ProductLanguage"])
+	}
+
+	before := make(map[string][]*Row)
+	for _, name := range patchReportTables {
+		before[name], err = iceRows(p, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = p.applyTransform(pair.Transform, pair.Transform.ErrorConditions())
+	if err != nil {
+		return nil, err
+	}
+	if pair.PatchTransform != nil {
+		err = p.applyTransform(pair.PatchTransform, pair.PatchTransform.ErrorConditions())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &PatchResult{Transform: pair, Changes: make([]*PatchChange, 0)}
+	for _, name := range patchReportTables {
+		after, err := iceRows(p, name)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Changes = append(result.Changes, diffPatchedRows(name, before[name], after)...)
+	}
+
+	for _, change := range result.Changes {
+		if change.Table != MEDIA_TABLE_NAME || change.Row == nil {
+			continue
+		}
+
+		cabinet := change.Row.GetString("Cabinet")
+		if !strings.HasPrefix(cabinet, "#") || !NameIsValid(cabinet[1:], false) ||
+			!patch.Package.hasStream(NameEncode(cabinet[1:], false)) {
+			continue
+		}
+
+		stream, err := patch.Package.ReadStream(cabinet[1:])
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(stream)
+		if err != nil {
+			return nil, err
+		}
+		p.writeStream(NameEncode(cabinet[1:], false), data)
+	}
+
+	return result, nil
+}
+
+// Compares the rows of a table before and after a patch, matching them by
+// primary key.
+func diffPatchedRows(name string, before []*Row, after []*Row) []*PatchChange {
+	changes := make([]*PatchChange, 0)
+
+	previous := make(map[string]*Row)
+	for _, row := range before {
+		previous[rowKey(row.Table, row.Values)] = row
+	}
+
+	for _, row := range after {
+		key := rowKey(row.Table, row.Values)
+		old, ok := previous[key]
+		delete(previous, key)
+
+		switch {
+		case !ok:
+			changes = append(changes, &PatchChange{Table: name, Operation: TransformOperationInsert, Row: row})
+		case !reflect.DeepEqual(old.Values, row.Values):
+			changes = append(changes, &PatchChange{Table: name, Operation: TransformOperationUpdate, Row: row, Previous: old})
+		}
+	}
+
+	for _, row := range before {
+		if _, ok := previous[rowKey(row.Table, row.Values)]; ok {
+			changes = append(changes, &PatchChange{Table: name, Operation: TransformOperationDelete, Previous: row})
+		}
+	}
+
+	return changes
+}
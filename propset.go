@@ -1,11 +1,12 @@
 package msi
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
-
-	"github.com/asalih/go-mscfb"
+	"sort"
+	"strings"
 )
 
 type OperatingSystem int
@@ -17,10 +18,15 @@ const (
 )
 
 const (
-	BYTE_ORDER_MARK   uint16 = 0xfffe
-	PROPERTY_CODEPAGE uint32 = 1
+	BYTE_ORDER_MARK     uint16 = 0xfffe
+	PROPERTY_DICTIONARY uint32 = 0
+	PROPERTY_CODEPAGE   uint32 = 1
 )
 
+// Property sets in practice have one or two sections; anything beyond this
+// is treated as corrupt.
+const maxPropertySections = 16
+
 type PropertyFormatVersion uint16
 
 const (
@@ -47,6 +53,20 @@ type PropertySet struct {
 	CodePage  CodePage
 	//todo: must be binary tree
 	Properties map[uint32]*PropertyValue
+	// Names of the properties in the first section, from its dictionary
+	// (PID 0), if it has one.
+	Dictionary map[uint32]string
+	// Sections after the first one, such as the user-defined section of a
+	// DocumentSummaryInformation stream.
+	AdditionalSections []*PropertySection
+}
+
+// A section of a property set, identified by its format ID.
+type PropertySection struct {
+	FmtID      []byte
+	CodePage   CodePage
+	Properties map[uint32]*PropertyValue
+	Dictionary map[uint32]string
 }
 
 func NewPropertySet(os OperatingSystem, osVersion uint16, fmtId []byte) *PropertySet {
@@ -60,7 +80,105 @@ func NewPropertySet(os OperatingSystem, osVersion uint16, fmtId []byte) *Propert
 	}
 }
 
-func ReadPropertySet(reader *mscfb.Stream) (*PropertySet, error) {
+func NewPropertySection(fmtId []byte) *PropertySection {
+	return &PropertySection{
+		FmtID:      fmtId,
+		CodePage:   CodePageDefault(),
+		Properties: make(map[uint32]*PropertyValue),
+		Dictionary: make(map[uint32]string),
+	}
+}
+
+// Returns the section with the given format ID, or nil if the property
+// set has none. The first section is returned as a view sharing its maps
+// with the property set.
+func (p *PropertySet) Section(fmtId []byte) *PropertySection {
+	if bytes.Equal(p.FmtID, fmtId) {
+		return p.firstSection()
+	}
+
+	for _, section := range p.AdditionalSections {
+		if bytes.Equal(section.FmtID, fmtId) {
+			return section
+		}
+	}
+
+	return nil
+}
+
+func (p *PropertySet) firstSection() *PropertySection {
+	if p.Dictionary == nil {
+		p.Dictionary = make(map[uint32]string)
+	}
+
+	return &PropertySection{
+		FmtID:      p.FmtID,
+		CodePage:   p.CodePage,
+		Properties: p.Properties,
+		Dictionary: p.Dictionary,
+	}
+}
+
+// Returns the property with the given dictionary name, or nil if there is
+// none. Names are compared case-insensitively.
+func (s *PropertySection) PropertyByName(name string) *PropertyValue {
+	pid, ok := s.propertyID(name)
+	if !ok {
+		return nil
+	}
+
+	return s.Properties[pid]
+}
+
+// Returns the named properties of the section, keyed by dictionary name.
+func (s *PropertySection) NamedProperties() map[string]*PropertyValue {
+	properties := make(map[string]*PropertyValue)
+	for pid, name := range s.Dictionary {
+		if value, ok := s.Properties[pid]; ok {
+			properties[name] = value
+		}
+	}
+
+	return properties
+}
+
+// Sets a named property, adding it to the dictionary if needed.
+func (s *PropertySection) SetNamedProperty(name string, value *PropertyValue) error {
+	if name == "" {
+		return fmt.Errorf("property name cannot be empty")
+	}
+
+	pid, ok := s.propertyID(name)
+	if !ok {
+		// PIDs 0 and 1 are reserved for the dictionary and the code page.
+		pid = 2
+		for {
+			_, used := s.Properties[pid]
+			_, named := s.Dictionary[pid]
+			if !used && !named {
+				break
+			}
+			pid++
+		}
+		s.Dictionary[pid] = name
+	}
+
+	s.Properties[pid] = value
+
+	return nil
+}
+
+func (s *PropertySection) propertyID(name string) (uint32, bool) {
+	for pid, entry := range s.Dictionary {
+		if strings.EqualFold(entry, name) {
+			return pid, true
+		}
+	}
+
+	return 0, false
+}
+
+func ReadPropertySet(reader io.ReadSeeker) (*PropertySet, error) {
 	var byteOrder uint16
 	err := binary.Read(reader, binary.LittleEndian, &byteOrder)
 	if err != nil {
@@ -109,30 +227,52 @@ func ReadPropertySet(reader *mscfb.Stream) (*PropertySet, error) {
 		return nil, err
 	}
 
-	var reserved uint32
-	err = binary.Read(reader, binary.LittleEndian, &reserved)
+	var numSections uint32
+	err = binary.Read(reader, binary.LittleEndian, &numSections)
 	if err != nil {
 		return nil, err
 	}
-	if reserved < 1 {
-		return nil, fmt.Errorf("invalid reserved value: %v", reserved)
+	if numSections < 1 || numSections > maxPropertySections {
+		return nil, fmt.Errorf("invalid number of sections: %v", numSections)
 	}
 
-	//section header
-	var fmtId [16]byte
-	err = binary.Read(reader, binary.LittleEndian, &fmtId)
-	if err != nil {
-		return nil, err
+	var sectionOffsets = make([]uint32, numSections)
+	var fmtIds = make([][16]byte, numSections)
+	for i := 0; i < int(numSections); i++ {
+		err = binary.Read(reader, binary.LittleEndian, &fmtIds[i])
+		if err != nil {
+			return nil, err
+		}
+
+		err = binary.Read(reader, binary.LittleEndian, &sectionOffsets[i])
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	var sectionOffset uint32
-	err = binary.Read(reader, binary.LittleEndian, &sectionOffset)
-	if err != nil {
-		return nil, err
+	sections := make([]*PropertySection, numSections)
+	for i := range sections {
+		sections[i], err = readPropertySection(reader, sectionOffsets[i], PropertyFormatVersion(propertyFormatVersion))
+		if err != nil {
+			return nil, err
+		}
+		sections[i].FmtID = fmtIds[i][:]
 	}
 
-	//section
-	_, err = reader.Seek(int64(sectionOffset), io.SeekStart)
+	return &PropertySet{
+		OS:                 OperatingSystem(os),
+		OSVersion:          osVersion,
+		CLSID:              clsid[:],
+		FmtID:              sections[0].FmtID,
+		CodePage:           sections[0].CodePage,
+		Properties:         sections[0].Properties,
+		Dictionary:         sections[0].Dictionary,
+		AdditionalSections: sections[1:],
+	}, nil
+}
+
+func readPropertySection(reader io.ReadSeeker, sectionOffset uint32, formatVersion PropertyFormatVersion) (*PropertySection, error) {
+	_, err := reader.Seek(int64(sectionOffset), io.SeekStart)
 	if err != nil {
 		return nil, err
 	}
@@ -184,40 +324,231 @@ func ReadPropertySet(reader *mscfb.Stream) (*PropertySet, error) {
 			return nil, err
 		}
 
-		cp := CodePageFromID(int(propVal.I2))
+		// Code pages above 32767 (such as UTF-8) are stored as unsigned.
+		cp := CodePageFromID(int(uint16(propVal.I2)))
 		if cp == -1 {
 			return nil, fmt.Errorf("invalid code page: %v", propVal.I2)
 		}
+		codePageRead = cp
 
 	} else {
 		codePageRead = CodePageDefault()
 	}
 
+	dictionary := make(map[uint32]string)
 	propertyValues := make(map[uint32]*PropertyValue)
 	for name, offset := range propertyOffset {
+		if offset >= sectionSize {
+			return nil, fmt.Errorf("property %v is outside of its section", name)
+		}
+
 		_, err = reader.Seek(int64(sectionOffset)+int64(offset), io.SeekStart)
 		if err != nil {
 			return nil, err
 		}
 
-		propVal, err := ReadPropValue(reader, codePageRead)
+		// Values cannot extend past the end of their section.
+		valueReader := io.LimitReader(reader, int64(sectionSize-offset))
+
+		if name == PROPERTY_DICTIONARY {
+			dictionary, err = readDictionary(valueReader, codePageRead)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		propVal, err := readTypedPropValue(&countingReader{r: valueReader}, codePageRead)
 		if err != nil {
 			return nil, err
 		}
 
-		if propVal.MinimumVersion() > PropertyFormatVersion(propertyFormatVersion) {
+		if propVal.MinimumVersion() > formatVersion {
 			return nil, fmt.Errorf("invalid property format version: %v", propVal.MinimumVersion())
 		}
 
 		propertyValues[name] = propVal
 	}
 
-	return &PropertySet{
-		OS:         OperatingSystem(os),
-		OSVersion:  osVersion,
-		CLSID:      clsid[:],
-		FmtID:      fmtId[:],
+	return &PropertySection{
 		CodePage:   codePageRead,
 		Properties: propertyValues,
+		Dictionary: dictionary,
 	}, nil
 }
+
+// Reads a dictionary, which maps property IDs to names. Unlike other
+// properties it has no type number. The names are in the section's code
+// page; in UTF-16 their length counts characters rather than bytes, and
+// each entry is padded to a multiple of four bytes.
+func readDictionary(reader io.Reader, codePage CodePage) (map[uint32]string, error) {
+	var count uint32
+	err := binary.Read(reader, binary.LittleEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+
+	dictionary := make(map[uint32]string)
+	for i := 0; i < int(count); i++ {
+		var pid, length uint32
+		err = binary.Read(reader, binary.LittleEndian, &pid)
+		if err != nil {
+			return nil, err
+		}
+
+		err = binary.Read(reader, binary.LittleEndian, &length)
+		if err != nil {
+			return nil, err
+		}
+
+		size := uint64(length)
+		if codePage == Utf16 {
+			size *= 2
+		}
+		value, err := readSizedBytes(reader, size)
+		if err != nil {
+			return nil, err
+		}
+
+		if codePage == Utf16 && size%4 != 0 {
+			_, err = readSizedBytes(reader, 4-size%4)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		name, err := codePage.Decode(trimCodePageString(value, codePage))
+		if err != nil {
+			return nil, err
+		}
+
+		dictionary[pid] = name
+	}
+
+	return dictionary, nil
+}
+
+func WritePropertySet(writer io.Writer, propertySet *PropertySet) error {
+	sections := append([]*PropertySection{propertySet.firstSection()}, propertySet.AdditionalSections...)
+
+	formatVersion := PropertyFormatVersion0
+	for _, section := range sections {
+		for _, value := range section.Properties {
+			if value.MinimumVersion() > formatVersion {
+				formatVersion = value.MinimumVersion()
+			}
+		}
+	}
+
+	clsid := propertySet.CLSID
+	if len(clsid) != 16 {
+		clsid = make([]byte, 16)
+	}
+
+	buf := new(bytes.Buffer)
+	writeLE(buf,
+		BYTE_ORDER_MARK,
+		uint16(formatVersion),
+		propertySet.OSVersion,
+		uint16(propertySet.OS),
+	)
+	buf.Write(clsid)
+	// Number of sections, followed by the section headers.
+	writeLE(buf, uint32(len(sections)))
+
+	sectionOffset := uint32(buf.Len() + 20*len(sections))
+	sectionData := new(bytes.Buffer)
+	for _, section := range sections {
+		if len(section.FmtID) != 16 {
+			return fmt.Errorf("invalid property set format id")
+		}
+
+		buf.Write(section.FmtID)
+		writeLE(buf, sectionOffset+uint32(sectionData.Len()))
+
+		err := writePropertySection(sectionData, section)
+		if err != nil {
+			return err
+		}
+	}
+	buf.Write(sectionData.Bytes())
+
+	_, err := buf.WriteTo(writer)
+	return err
+}
+
+func writePropertySection(buf *bytes.Buffer, section *PropertySection) error {
+	properties := make(map[uint32]*PropertyValue)
+	for name, value := range section.Properties {
+		properties[name] = value
+	}
+	properties[PROPERTY_CODEPAGE] = PropertyValueFromI2(int16(section.CodePage.ID()))
+
+	names := make([]uint32, 0, len(properties)+1)
+	for name := range properties {
+		names = append(names, name)
+	}
+	if len(section.Dictionary) > 0 {
+		names = append(names, PROPERTY_DICTIONARY)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+
+	values := new(bytes.Buffer)
+	offsets := make([]uint32, len(names))
+	headerSize := uint32(8 + 8*len(names))
+	for i, name := range names {
+		offsets[i] = headerSize + uint32(values.Len())
+
+		var err error
+		if name == PROPERTY_DICTIONARY {
+			err = writeDictionary(values, section.Dictionary, section.CodePage)
+		} else {
+			err = properties[name].Write(values, section.CodePage)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	writeLE(buf, headerSize+uint32(values.Len()), uint32(len(names)))
+	for i, name := range names {
+		writeLE(buf, name, offsets[i])
+	}
+	buf.Write(values.Bytes())
+
+	return nil
+}
+
+func writeDictionary(w io.Writer, dictionary map[uint32]string, codePage CodePage) error {
+	pids := make([]uint32, 0, len(dictionary))
+	for pid := range dictionary {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+
+	buf := new(bytes.Buffer)
+	writeLE(buf, uint32(len(pids)))
+	for _, pid := range pids {
+		name, err := codePage.Encode(dictionary[pid])
+		if err != nil {
+			return err
+		}
+
+		terminator := codePageNull(codePage)
+		length := len(name) + len(terminator)
+		if codePage == Utf16 {
+			length /= 2
+		}
+
+		writeLE(buf, pid, uint32(length))
+		buf.Write(name)
+		buf.Write(terminator)
+		if codePage == Utf16 {
+			writeAlignment(buf)
+		}
+	}
+	writeAlignment(buf)
+
+	_, err := buf.WriteTo(w)
+	return err
+}
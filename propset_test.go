@@ -0,0 +1,115 @@
+package msi
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+)
+
+// Encodes a string as null-terminated UTF-16LE.
+func utf16String(str string) []byte {
+	buf := new(bytes.Buffer)
+	writeLE(buf, utf16.Encode([]rune(str)), uint16(0))
+	return buf.Bytes()
+}
+
+// Builds a property set whose only section uses code page 1200, laid out
+// as in MS-OLEPS: dictionary names are counted in characters and padded to
+// a multiple of four bytes, and strings are counted in bytes.
+func utf16PropertySet() []byte {
+	dictionary := new(bytes.Buffer)
+	writeLE(dictionary, uint32(2))
+	// Five characters, padded with two bytes.
+	writeLE(dictionary, uint32(2), uint32(5), utf16String("Näme"), uint16(0))
+	// Four characters, without padding.
+	writeLE(dictionary, uint32(3), uint32(4), utf16String("ABC"))
+
+	codePage := new(bytes.Buffer)
+	writeLE(codePage, VT_I2, int16(1200), uint16(0))
+
+	str := new(bytes.Buffer)
+	value := utf16String("Wërt")
+	writeLE(str, VT_LPSTR, uint32(len(value)))
+	str.Write(value)
+	writeAlignment(str)
+
+	number := new(bytes.Buffer)
+	writeLE(number, VT_I4, int32(42))
+
+	values := [][]byte{dictionary.Bytes(), codePage.Bytes(), str.Bytes(), number.Bytes()}
+	headerSize := 8 + 8*len(values)
+	section := new(bytes.Buffer)
+	size := headerSize
+	for _, value := range values {
+		size += len(value)
+	}
+	writeLE(section, uint32(size), uint32(len(values)))
+	offset := headerSize
+	for pid, value := range values {
+		writeLE(section, uint32(pid), uint32(offset))
+		offset += len(value)
+	}
+	for _, value := range values {
+		section.Write(value)
+	}
+
+	buf := new(bytes.Buffer)
+	writeLE(buf, BYTE_ORDER_MARK, uint16(PropertyFormatVersion0), uint16(defaultOsVersion), uint16(Win32))
+	buf.Write(make([]byte, 16))
+	writeLE(buf, uint32(1))
+	buf.Write(fmtIdUserDefinedProperties)
+	writeLE(buf, uint32(buf.Len()+4))
+	buf.Write(section.Bytes())
+
+	return buf.Bytes()
+}
+
+func TestReadPropertySetUTF16(t *testing.T) {
+	data := utf16PropertySet()
+	set, err := ReadPropertySet(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if set.CodePage != Utf16 {
+		t.Errorf("got code page %d, want %d", set.CodePage.ID(), Utf16.ID())
+	}
+	if want := map[uint32]string{2: "Näme", 3: "ABC"}; !reflect.DeepEqual(set.Dictionary, want) {
+		t.Errorf("got dictionary %v, want %v", set.Dictionary, want)
+	}
+	if value := set.Properties[2]; value == nil || value.LpStr != "Wërt" {
+		t.Errorf("got property 2 %+v, want %q", value, "Wërt")
+	}
+	if value := set.Properties[3]; value == nil || value.I4 != 42 {
+		t.Errorf("got property 3 %+v, want 42", value)
+	}
+
+	// Writing the set back produces the same layout.
+	buf := new(bytes.Buffer)
+	err = WritePropertySet(buf, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("got %x, want %x", buf.Bytes(), data)
+	}
+}
+
+func TestReadUTF16String(t *testing.T) {
+	// "AĀ" is 41 00 00 01: the two null bytes at an odd offset do not end
+	// the string, but the aligned terminator after it does, despite the
+	// padding that follows.
+	value := append(utf16String("AĀ"), 0, 0)
+	buf := new(bytes.Buffer)
+	writeLE(buf, VT_LPSTR, uint32(len(value)))
+	buf.Write(value)
+
+	got, err := readTypedPropValue(&countingReader{r: bytes.NewReader(buf.Bytes())}, Utf16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LpStr != "AĀ" {
+		t.Errorf("got %q, want %q", got.LpStr, "AĀ")
+	}
+}
@@ -1,9 +1,33 @@
 package msi
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
+	"time"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+)
+
+const (
+	VT_EMPTY    uint32 = 0
+	VT_NULL     uint32 = 1
+	VT_I2       uint32 = 2
+	VT_I4       uint32 = 3
+	VT_R8       uint32 = 5
+	VT_BOOL     uint32 = 11
+	VT_VARIANT  uint32 = 12
+	VT_I1       uint32 = 16
+	VT_UI4      uint32 = 19
+	VT_LPSTR    uint32 = 30
+	VT_LPWSTR   uint32 = 31
+	VT_FILETIME uint32 = 64
+	VT_BLOB     uint32 = 65
+	VT_CLSID    uint32 = 72
+	VT_VECTOR   uint32 = 0x1000
 )
 
 type PropertyValue struct {
@@ -12,91 +36,479 @@ type PropertyValue struct {
 	I1       int8
 	I2       int16
 	I4       int32
+	UI4      uint32
+	R8       float64
+	Bool     bool
 	LpStr    string
+	LpWStr   string
 	FileTime int64
+	Blob     []byte
+	CLSID    uuid.UUID
+	// The elements of a VT_VECTOR value. For vectors of VT_VARIANT each
+	// element carries its own type.
+	Vector []*PropertyValue
+
+	vt uint32
+}
+
+// Number of 100-nanosecond intervals between 1601-01-01 and 1970-01-01.
+const fileTimeUnixEpoch int64 = 116444736000000000
+
+// Converts a time into a Windows FILETIME value.
+func FileTimeFromTime(t time.Time) int64 {
+	return t.UnixNano()/100 + fileTimeUnixEpoch
+}
+
+// Converts a Windows FILETIME value into a time.
+func TimeFromFileTime(fileTime int64) time.Time {
+	return time.Unix(0, (fileTime-fileTimeUnixEpoch)*100).UTC()
+}
+
+func PropertyValueFromI2(value int16) *PropertyValue {
+	return &PropertyValue{I2: value, vt: VT_I2}
+}
+
+func PropertyValueFromI4(value int32) *PropertyValue {
+	return &PropertyValue{I4: value, vt: VT_I4}
+}
+
+func PropertyValueFromLpStr(value string) *PropertyValue {
+	return &PropertyValue{LpStr: value, vt: VT_LPSTR}
+}
+
+func PropertyValueFromFileTime(value int64) *PropertyValue {
+	return &PropertyValue{FileTime: value, vt: VT_FILETIME}
+}
+
+func PropertyValueFromI1(value int8) *PropertyValue {
+	return &PropertyValue{I1: value, vt: VT_I1}
+}
+
+func PropertyValueFromUI4(value uint32) *PropertyValue {
+	return &PropertyValue{UI4: value, vt: VT_UI4}
+}
+
+func PropertyValueFromR8(value float64) *PropertyValue {
+	return &PropertyValue{R8: value, vt: VT_R8}
+}
+
+func PropertyValueFromBool(value bool) *PropertyValue {
+	return &PropertyValue{Bool: value, vt: VT_BOOL}
+}
+
+func PropertyValueFromLpWStr(value string) *PropertyValue {
+	return &PropertyValue{LpWStr: value, vt: VT_LPWSTR}
+}
+
+func PropertyValueFromBlob(value []byte) *PropertyValue {
+	return &PropertyValue{Blob: value, vt: VT_BLOB}
+}
+
+func PropertyValueFromCLSID(value uuid.UUID) *PropertyValue {
+	return &PropertyValue{CLSID: value, vt: VT_CLSID}
+}
+
+// Creates a VT_VECTOR value of the given element type. Every element must
+// have that type, unless the element type is VT_VARIANT.
+func PropertyValueFromVector(elementType uint32, values []*PropertyValue) (*PropertyValue, error) {
+	if !isVectorElementType(elementType) {
+		return nil, fmt.Errorf("invalid vector element type: %v", elementType)
+	}
+
+	for _, value := range values {
+		if elementType == VT_VARIANT {
+			if value.vt&VT_VECTOR != 0 {
+				return nil, fmt.Errorf("vector of variants cannot contain vectors")
+			}
+		} else if value.vt != elementType {
+			return nil, fmt.Errorf("vector of type %v cannot contain a value of type %v", elementType, value.vt)
+		}
+	}
+
+	return &PropertyValue{Vector: values, vt: VT_VECTOR | elementType}, nil
+}
+
+// Returns the VARIANT type number of the value, including the VT_VECTOR
+// flag for vectors.
+func (p *PropertyValue) Type() uint32 {
+	return p.vt
+}
+
+// Returns true if the value is a VT_VECTOR.
+func (p *PropertyValue) IsVector() bool {
+	return p.vt&VT_VECTOR != 0
 }
 
 func ReadPropValue(rdr io.ReadSeeker, codePage CodePage) (*PropertyValue, error) {
+	return readTypedPropValue(&countingReader{r: rdr}, codePage)
+}
+
+// Keeps track of the bytes read so that padding can be skipped relative to
+// the start of a property value.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) skipPadding() error {
+	if rem := c.n % 4; rem != 0 {
+		_, err := io.CopyN(io.Discard, c, 4-rem)
+		return err
+	}
+	return nil
+}
+
+// Reads a length-prefixed value. The length comes from the file, so the
+// buffer only grows as the data is actually read.
+func readSizedBytes(rdr io.Reader, length uint64) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	_, err := io.CopyN(buf, rdr, int64(length))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Returns the null terminator of strings in the code page, which is two
+// bytes wide in UTF-16.
+func codePageNull(codePage CodePage) []byte {
+	if codePage == Utf16 {
+		return []byte{0, 0}
+	}
+
+	return []byte{0}
+}
+
+// Cuts a string in the code page at its first null terminator. In UTF-16
+// the terminator must start at an even offset.
+func trimCodePageString(value []byte, codePage CodePage) []byte {
+	if codePage != Utf16 {
+		if idx := bytes.IndexByte(value, 0); idx != -1 {
+			value = value[:idx]
+		}
+		return value
+	}
+
+	for i := 0; i+1 < len(value); i += 2 {
+		if value[i] == 0 && value[i+1] == 0 {
+			return value[:i]
+		}
+	}
+
+	return value[:len(value)&^1]
+}
+
+func readTypedPropValue(rdr *countingReader, codePage CodePage) (*PropertyValue, error) {
 	var typeNumber uint32
 	err := binary.Read(rdr, binary.LittleEndian, &typeNumber)
 	if err != nil {
 		return nil, err
 	}
 
+	if typeNumber&VT_VECTOR == 0 {
+		return readPropScalar(rdr, typeNumber, codePage)
+	}
+
+	elementType := typeNumber &^ VT_VECTOR
+	if !isVectorElementType(elementType) {
+		return nil, fmt.Errorf("invalid property type: %v", typeNumber)
+	}
+
+	var count uint32
+	err = binary.Read(rdr, binary.LittleEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]*PropertyValue, 0)
+	for i := 0; i < int(count); i++ {
+		var value *PropertyValue
+		if elementType == VT_VARIANT {
+			value, err = readTypedPropValue(rdr, codePage)
+			if err == nil && value.IsVector() {
+				err = fmt.Errorf("vector of variants cannot contain vectors")
+			}
+		} else {
+			value, err = readPropScalar(rdr, elementType, codePage)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Variable-length elements and variants are each padded to a
+		// multiple of four bytes.
+		if elementType == VT_VARIANT || isVariableLengthType(elementType) {
+			err = rdr.skipPadding()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		values = append(values, value)
+	}
+
+	return &PropertyValue{Vector: values, vt: typeNumber}, nil
+}
+
+func readPropScalar(rdr io.Reader, typeNumber uint32, codePage CodePage) (*PropertyValue, error) {
+	var err error
 	switch typeNumber {
-	case 0:
-		return &PropertyValue{Empty: true}, nil
-	case 1:
-		return &PropertyValue{Null: true}, nil
-	case 2:
+	case VT_EMPTY:
+		return &PropertyValue{Empty: true, vt: VT_EMPTY}, nil
+	case VT_NULL:
+		return &PropertyValue{Null: true, vt: VT_NULL}, nil
+	case VT_I2:
 		var value int16
 		err = binary.Read(rdr, binary.LittleEndian, &value)
 		if err != nil {
 			return nil, err
 		}
-		return &PropertyValue{I2: value}, nil
-	case 3:
+		return PropertyValueFromI2(value), nil
+	case VT_I4:
 		var value int32
 		err = binary.Read(rdr, binary.LittleEndian, &value)
 		if err != nil {
 			return nil, err
 		}
-		return &PropertyValue{I4: value}, nil
-	case 16:
+		return PropertyValueFromI4(value), nil
+	case VT_I1:
 		var value int8
 		err = binary.Read(rdr, binary.LittleEndian, &value)
 		if err != nil {
 			return nil, err
 		}
-		return &PropertyValue{I1: value}, nil
-	case 30:
-		var length uint32
-		err = binary.Read(rdr, binary.LittleEndian, &length)
+		return PropertyValueFromI1(value), nil
+	case VT_UI4:
+		var value uint32
+		err = binary.Read(rdr, binary.LittleEndian, &value)
 		if err != nil {
 			return nil, err
 		}
-		if length != 0 {
-			length = length - 1
+		return PropertyValueFromUI4(value), nil
+	case VT_R8:
+		var value uint64
+		err = binary.Read(rdr, binary.LittleEndian, &value)
+		if err != nil {
+			return nil, err
 		}
-		var value = make([]byte, 0, length)
-		for i := 0; i < int(length); i++ {
-			var b uint8
-			err = binary.Read(rdr, binary.LittleEndian, &b)
-			if err != nil {
-				return nil, err
-			}
-			value = append(value, b)
+		return PropertyValueFromR8(math.Float64frombits(value)), nil
+	case VT_BOOL:
+		var value uint16
+		err = binary.Read(rdr, binary.LittleEndian, &value)
+		if err != nil {
+			return nil, err
 		}
-		var term uint8
-		err = binary.Read(rdr, binary.LittleEndian, &term)
+		return PropertyValueFromBool(value != 0), nil
+	case VT_LPSTR:
+		var length uint32
+		err = binary.Read(rdr, binary.LittleEndian, &length)
 		if err != nil {
 			return nil, err
 		}
-		if term != 0 {
-			return nil, fmt.Errorf("invalid string terminator: %v", term)
+		value, err := readSizedBytes(rdr, uint64(length))
+		if err != nil {
+			return nil, err
 		}
-
-		str, err := codePage.Decode(value)
+		// The length includes the null terminator, though some writers
+		// pad the string with additional nulls.
+		str, err := codePage.Decode(trimCodePageString(value, codePage))
 		if err != nil {
 			return nil, err
 		}
 
-		return &PropertyValue{LpStr: str}, nil
-	case 64:
+		return PropertyValueFromLpStr(str), nil
+	case VT_LPWSTR:
+		var length uint32
+		err = binary.Read(rdr, binary.LittleEndian, &length)
+		if err != nil {
+			return nil, err
+		}
+		data, err := readSizedBytes(rdr, uint64(length)*2)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]uint16, length)
+		for i := range value {
+			value[i] = binary.LittleEndian.Uint16(data[i*2:])
+		}
+		for i, char := range value {
+			if char == 0 {
+				value = value[:i]
+				break
+			}
+		}
+		return PropertyValueFromLpWStr(string(utf16.Decode(value))), nil
+	case VT_FILETIME:
 		var value int64
 		err = binary.Read(rdr, binary.LittleEndian, &value)
 		if err != nil {
 			return nil, err
 		}
-		return &PropertyValue{FileTime: value}, nil
+		return PropertyValueFromFileTime(value), nil
+	case VT_BLOB:
+		var length uint32
+		err = binary.Read(rdr, binary.LittleEndian, &length)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readSizedBytes(rdr, uint64(length))
+		if err != nil {
+			return nil, err
+		}
+		return PropertyValueFromBlob(value), nil
+	case VT_CLSID:
+		var value [16]byte
+		_, err = io.ReadFull(rdr, value[:])
+		if err != nil {
+			return nil, err
+		}
+		return PropertyValueFromCLSID(clsidFromBytes(value[:])), nil
 	default:
 		return nil, fmt.Errorf("invalid property type: %v", typeNumber)
 	}
 }
 
+// Writes the type number and the value, padded to a multiple of four bytes.
+func (p *PropertyValue) Write(w io.Writer, codePage CodePage) error {
+	buf := new(bytes.Buffer)
+	writeLE(buf, p.vt)
+
+	if p.IsVector() {
+		elementType := p.vt &^ VT_VECTOR
+		if !isVectorElementType(elementType) {
+			return fmt.Errorf("invalid property type: %v", p.vt)
+		}
+
+		writeLE(buf, uint32(len(p.Vector)))
+		for _, value := range p.Vector {
+			var err error
+			if elementType == VT_VARIANT {
+				if value.IsVector() {
+					return fmt.Errorf("vector of variants cannot contain vectors")
+				}
+				err = value.Write(buf, codePage)
+			} else if value.vt != elementType {
+				err = fmt.Errorf("vector of type %v cannot contain a value of type %v", elementType, value.vt)
+			} else {
+				err = value.writeScalar(buf, codePage)
+				if isVariableLengthType(elementType) {
+					writeAlignment(buf)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		err := p.writeScalar(buf, codePage)
+		if err != nil {
+			return err
+		}
+	}
+
+	writeAlignment(buf)
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func (p *PropertyValue) writeScalar(buf *bytes.Buffer, codePage CodePage) error {
+	switch p.vt {
+	case VT_EMPTY, VT_NULL:
+	case VT_I2:
+		writeLE(buf, p.I2)
+	case VT_I4:
+		writeLE(buf, p.I4)
+	case VT_I1:
+		writeLE(buf, p.I1)
+	case VT_UI4:
+		writeLE(buf, p.UI4)
+	case VT_R8:
+		writeLE(buf, math.Float64bits(p.R8))
+	case VT_BOOL:
+		// VARIANT_BOOL uses all bits set for true.
+		if p.Bool {
+			writeLE(buf, uint16(0xffff))
+		} else {
+			writeLE(buf, uint16(0))
+		}
+	case VT_LPSTR:
+		value, err := codePage.Encode(p.LpStr)
+		if err != nil {
+			return err
+		}
+		terminator := codePageNull(codePage)
+		writeLE(buf, uint32(len(value)+len(terminator)))
+		buf.Write(value)
+		buf.Write(terminator)
+	case VT_LPWSTR:
+		value := utf16.Encode([]rune(p.LpWStr))
+		writeLE(buf, uint32(len(value)+1), value, uint16(0))
+	case VT_FILETIME:
+		writeLE(buf, p.FileTime)
+	case VT_BLOB:
+		writeLE(buf, uint32(len(p.Blob)))
+		buf.Write(p.Blob)
+	case VT_CLSID:
+		writeCLSID(buf, p.CLSID)
+	default:
+		return fmt.Errorf("invalid property type: %v", p.vt)
+	}
+
+	return nil
+}
+
+// VT_I1 values were only introduced with version 1 of the property set
+// format.
 func (p *PropertyValue) MinimumVersion() PropertyFormatVersion {
-	if p.I1 == int8(PropertyFormatVersion1) {
+	if p.vt&^VT_VECTOR == VT_I1 {
 		return PropertyFormatVersion1
 	}
+
+	for _, value := range p.Vector {
+		if value.MinimumVersion() == PropertyFormatVersion1 {
+			return PropertyFormatVersion1
+		}
+	}
+
 	return PropertyFormatVersion0
 }
+
+func isVectorElementType(typeNumber uint32) bool {
+	switch typeNumber {
+	case VT_I2, VT_I4, VT_R8, VT_BOOL, VT_VARIANT, VT_I1, VT_UI4, VT_LPSTR, VT_LPWSTR, VT_FILETIME, VT_CLSID:
+		return true
+	default:
+		return false
+	}
+}
+
+func isVariableLengthType(typeNumber uint32) bool {
+	return typeNumber == VT_LPSTR || typeNumber == VT_LPWSTR || typeNumber == VT_BLOB
+}
+
+func writeAlignment(buf *bytes.Buffer) {
+	if rem := buf.Len() % 4; rem != 0 {
+		buf.Write(make([]byte, 4-rem))
+	}
+}
+
+// Converts the mixed-endian on-disk form of a CLSID into a UUID.
+func clsidFromBytes(data []byte) uuid.UUID {
+	var clsid uuid.UUID
+	binary.BigEndian.PutUint32(clsid[0:4], binary.LittleEndian.Uint32(data[0:4]))
+	binary.BigEndian.PutUint16(clsid[4:6], binary.LittleEndian.Uint16(data[4:6]))
+	binary.BigEndian.PutUint16(clsid[6:8], binary.LittleEndian.Uint16(data[6:8]))
+	copy(clsid[8:], data[8:16])
+	return clsid
+}
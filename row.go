@@ -47,3 +47,52 @@ func NewRow(t *Table, values []Value) *Row {
 		Values: values,
 	}
 }
+
+// Returns the number of rows in the iterator, including the rows already
+// visited.
+func (r *Rows) Len() int {
+	return len(r.Rows)
+}
+
+// Returns the value of the column with the given name, or nil if the value
+// is null or the table has no such column.
+func (r *Row) Get(columnName string) Value {
+	idx := r.Table.ColumnIndex(columnName)
+	if idx == -1 || idx >= len(r.Values) {
+		return nil
+	}
+
+	return r.Values[idx]
+}
+
+// Returns the string value of the column with the given name, or an empty
+// string if the value is null or not a string.
+func (r *Row) GetString(columnName string) string {
+	str, _ := r.Get(columnName).(string)
+	return str
+}
+
+// Returns the integer value of the column with the given name. The second
+// return value is false if the value is null or not an integer.
+func (r *Row) GetInt(columnName string) (int, bool) {
+	num, ok := r.Get(columnName).(int)
+	return num, ok
+}
+
+// Returns true if the value of the column with the given name is null.
+func (r *Row) IsNull(columnName string) bool {
+	return r.Get(columnName) == nil
+}
+
+// Returns the values of the row's primary key columns.
+func (r *Row) Key() []Value {
+	indices := r.Table.PrimaryKeyIndices()
+	key := make([]Value, 0, len(indices))
+	for _, idx := range indices {
+		if idx < len(r.Values) {
+			key = append(key, r.Values[idx])
+		}
+	}
+
+	return key
+}
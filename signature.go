@@ -0,0 +1,383 @@
+package msi
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+)
+
+var (
+	oidSignedData              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSigningTime             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidCounterSignature        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 6}
+	oidTSTInfo                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidSpcIndirectDataContent  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidRFC3161CounterSignature = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 3, 1}
+
+	oidDigestMD5    = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 5}
+	oidDigestSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidDigestSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidDigestSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidDigestSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// The Authenticode signature of a package, read from the
+// \x05DigitalSignature stream. The signature is parsed but not verified.
+type DigitalSignature struct {
+	// Every certificate the signature holds.
+	Certificates []*x509.Certificate
+	// The signer's certificate followed by those of its issuers, as far as
+	// the signature holds them.
+	Chain []*x509.Certificate
+	// The algorithm of the package hash, or 0 if it is not known.
+	DigestAlgorithm crypto.Hash
+	// The hash of the package's streams, from the SpcIndirectDataContent.
+	Digest []byte
+	// The hash of the package's metadata from the
+	// \x05MsiDigitalSignatureEx stream, or nil if the package has none.
+	ExtendedDigest []byte
+	// The signer's signing time attribute or, failing that, the time of
+	// its timestamp. Zero if neither is present.
+	SigningTime time.Time
+	// Nil if the signature is not timestamped.
+	Timestamp *SignatureTimestamp
+}
+
+// A countersignature proving when a package was signed.
+type SignatureTimestamp struct {
+	Time time.Time
+	// True for an RFC 3161 timestamp token, false for a PKCS #9
+	// countersignature.
+	RFC3161         bool
+	DigestAlgorithm crypto.Hash
+	// The timestamping authority's certificate followed by those of its
+	// issuers.
+	Chain []*x509.Certificate
+}
+
+// Returns the common name of the signer's certificate.
+func (s *DigitalSignature) Publisher() string {
+	if len(s.Chain) == 0 {
+		return ""
+	}
+
+	return s.Chain[0].Subject.CommonName
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	// Keeps the [0] tag, so Bytes holds the encoded content.
+	Content asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   []pkcs7Attribute `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes []pkcs7Attribute `asn1:"optional,tag:1"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type spcIndirectDataContent struct {
+	Data          spcAttributeTypeAndOptionalValue
+	MessageDigest digestInfo
+}
+
+type spcAttributeTypeAndOptionalValue struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"optional"`
+}
+
+type digestInfo struct {
+	DigestAlgorithm pkix.AlgorithmIdentifier
+	Digest          []byte
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint digestInfo
+	SerialNumber   *big.Int
+	GenTime        time.Time     `asn1:"generalized"`
+	Accuracy       asn1.RawValue `asn1:"optional"`
+	Ordering       bool          `asn1:"optional"`
+	Nonce          *big.Int      `asn1:"optional"`
+	TSA            asn1.RawValue `asn1:"explicit,optional,tag:0"`
+	Extensions     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// Reads the package's Authenticode signature. Returns nil if the package
+// is not signed.
+func (p *MSIPackage) DigitalSignature() (*DigitalSignature, error) {
+	if !p.hasStream(DIGITAL_SIGNATURE_STREAM_NAME) {
+		return nil, nil
+	}
+
+	stream, err := p.openStream(DIGITAL_SIGNATURE_STREAM_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := ParseDigitalSignature(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.hasStream(MSI_DIGITAL_SIGNATURE_EX_STREAM_NAME) {
+		stream, err := p.openStream(MSI_DIGITAL_SIGNATURE_EX_STREAM_NAME)
+		if err != nil {
+			return nil, err
+		}
+
+		signature.ExtendedDigest, err = io.ReadAll(stream)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return signature, nil
+}
+
+// Parses a PKCS #7 SignedData holding an Authenticode signature.
+func ParseDigitalSignature(data []byte) (*DigitalSignature, error) {
+	signedData, certificates, err := parseSignedData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if !signedData.ContentInfo.ContentType.Equal(oidSpcIndirectDataContent) {
+		return nil, fmt.Errorf("signature content has type %v, not SpcIndirectDataContent", signedData.ContentInfo.ContentType)
+	}
+
+	var content spcIndirectDataContent
+	_, err = asn1.Unmarshal(signedData.ContentInfo.Content.Bytes, &content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SpcIndirectDataContent: %v", err)
+	}
+
+	if len(signedData.SignerInfos) != 1 {
+		return nil, fmt.Errorf("signature has %d signers, but should have 1", len(signedData.SignerInfos))
+	}
+	signer := signedData.SignerInfos[0]
+
+	signature := &DigitalSignature{
+		Certificates:    certificates,
+		Chain:           certificateChain(certificates, signer.IssuerAndSerialNumber),
+		DigestAlgorithm: digestAlgorithm(content.MessageDigest.DigestAlgorithm.Algorithm),
+		Digest:          content.MessageDigest.Digest,
+	}
+
+	signature.SigningTime, err = signingTime(signer.AuthenticatedAttributes)
+	if err != nil {
+		return nil, err
+	}
+
+	signature.Timestamp, err = parseTimestamp(signer.UnauthenticatedAttributes, certificates)
+	if err != nil {
+		return nil, err
+	}
+
+	if signature.SigningTime.IsZero() && signature.Timestamp != nil {
+		signature.SigningTime = signature.Timestamp.Time
+	}
+
+	return signature, nil
+}
+
+// Parses a ContentInfo holding a SignedData and the certificates it holds.
+func parseSignedData(data []byte) (*pkcs7SignedData, []*x509.Certificate, error) {
+	var contentInfo pkcs7ContentInfo
+	_, err := asn1.Unmarshal(data, &contentInfo)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid PKCS #7 content info: %v", err)
+	}
+
+	if !contentInfo.ContentType.Equal(oidSignedData) {
+		return nil, nil, fmt.Errorf("PKCS #7 content has type %v, not SignedData", contentInfo.ContentType)
+	}
+
+	var signedData pkcs7SignedData
+	_, err = asn1.Unmarshal(contentInfo.Content.Bytes, &signedData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid PKCS #7 signed data: %v", err)
+	}
+
+	certificates := make([]*x509.Certificate, 0)
+	if len(signedData.Certificates.Bytes) > 0 {
+		certificates, err = x509.ParseCertificates(signedData.Certificates.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &signedData, certificates, nil
+}
+
+// Returns the certificate with the given issuer and serial number followed
+// by the certificates of its issuers.
+func certificateChain(certificates []*x509.Certificate, id pkcs7IssuerAndSerial) []*x509.Certificate {
+	chain := make([]*x509.Certificate, 0)
+
+	var current *x509.Certificate
+	for _, certificate := range certificates {
+		if certificate.SerialNumber.Cmp(id.SerialNumber) == 0 && string(certificate.RawIssuer) == string(id.Issuer.FullBytes) {
+			current = certificate
+			break
+		}
+	}
+
+	for current != nil && len(chain) <= len(certificates) {
+		chain = append(chain, current)
+		if string(current.RawIssuer) == string(current.RawSubject) {
+			break
+		}
+
+		var issuer *x509.Certificate
+		for _, certificate := range certificates {
+			if string(certificate.RawSubject) == string(current.RawIssuer) && certificate != current {
+				issuer = certificate
+				break
+			}
+		}
+		current = issuer
+	}
+
+	return chain
+}
+
+func digestAlgorithm(oid asn1.ObjectIdentifier) crypto.Hash {
+	switch {
+	case oid.Equal(oidDigestMD5):
+		return crypto.MD5
+	case oid.Equal(oidDigestSHA1):
+		return crypto.SHA1
+	case oid.Equal(oidDigestSHA256):
+		return crypto.SHA256
+	case oid.Equal(oidDigestSHA384):
+		return crypto.SHA384
+	case oid.Equal(oidDigestSHA512):
+		return crypto.SHA512
+	default:
+		return 0
+	}
+}
+
+// Returns the value of the signing time attribute, or the zero time if
+// there is none.
+func signingTime(attributes []pkcs7Attribute) (time.Time, error) {
+	for _, attribute := range attributes {
+		if !attribute.Type.Equal(oidSigningTime) || len(attribute.Values) == 0 {
+			continue
+		}
+
+		var t time.Time
+		_, err := asn1.Unmarshal(attribute.Values[0].FullBytes, &t)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid signing time: %v", err)
+		}
+
+		return t, nil
+	}
+
+	return time.Time{}, nil
+}
+
+// Reads the timestamp among the signer's unauthenticated attributes: an
+// RFC 3161 token, which holds its own certificates, or a PKCS #9
+// countersignature, whose certificates are the signature's.
+func parseTimestamp(attributes []pkcs7Attribute, certificates []*x509.Certificate) (*SignatureTimestamp, error) {
+	for _, attribute := range attributes {
+		if len(attribute.Values) == 0 {
+			continue
+		}
+
+		switch {
+		case attribute.Type.Equal(oidRFC3161CounterSignature):
+			return parseRFC3161Timestamp(attribute.Values[0].FullBytes)
+		case attribute.Type.Equal(oidCounterSignature):
+			var counterSigner pkcs7SignerInfo
+			_, err := asn1.Unmarshal(attribute.Values[0].FullBytes, &counterSigner)
+			if err != nil {
+				return nil, fmt.Errorf("invalid countersignature: %v", err)
+			}
+
+			t, err := signingTime(counterSigner.AuthenticatedAttributes)
+			if err != nil {
+				return nil, err
+			}
+
+			return &SignatureTimestamp{
+				Time:            t,
+				DigestAlgorithm: digestAlgorithm(counterSigner.DigestAlgorithm.Algorithm),
+				Chain:           certificateChain(certificates, counterSigner.IssuerAndSerialNumber),
+			}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func parseRFC3161Timestamp(data []byte) (*SignatureTimestamp, error) {
+	signedData, certificates, err := parseSignedData(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp token: %v", err)
+	}
+
+	if !signedData.ContentInfo.ContentType.Equal(oidTSTInfo) {
+		return nil, fmt.Errorf("timestamp token content has type %v, not TSTInfo", signedData.ContentInfo.ContentType)
+	}
+
+	var encoded []byte
+	_, err = asn1.Unmarshal(signedData.ContentInfo.Content.Bytes, &encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp token content: %v", err)
+	}
+
+	var info tstInfo
+	_, err = asn1.Unmarshal(encoded, &info)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSTInfo: %v", err)
+	}
+
+	timestamp := &SignatureTimestamp{
+		Time:            info.GenTime,
+		RFC3161:         true,
+		DigestAlgorithm: digestAlgorithm(info.MessageImprint.DigestAlgorithm.Algorithm),
+	}
+	if len(signedData.SignerInfos) > 0 {
+		timestamp.Chain = certificateChain(certificates, signedData.SignerInfos[0].IssuerAndSerialNumber)
+	}
+
+	return timestamp, nil
+}
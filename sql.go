@@ -0,0 +1,1440 @@
+package msi
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A parsed statement of the Windows Installer SQL dialect.
+type Query struct {
+	sql       string
+	statement sqlStatement
+	numParams int
+}
+
+// The result of a statement. For SELECT, Table describes the selected
+// columns and Next iterates over the selected rows; for other statements,
+// RowsAffected is the number of rows inserted, updated or deleted.
+type QueryResult struct {
+	Table        *Table
+	Rows         [][]Value
+	RowsAffected int
+
+	nextRowIndex int
+}
+
+// Returns the next selected row, or nil once every row has been visited.
+func (r *QueryResult) Next() *Row {
+	if r.nextRowIndex >= len(r.Rows) {
+		return nil
+	}
+
+	row := NewRow(r.Table, r.Rows[r.nextRowIndex])
+	r.nextRowIndex++
+
+	return row
+}
+
+// Returns the names of the selected columns.
+func (r *QueryResult) Columns() []string {
+	if r.Table == nil {
+		return nil
+	}
+
+	names := make([]string, len(r.Table.Columns))
+	for i, column := range r.Table.Columns {
+		names[i] = column.Name
+	}
+
+	return names
+}
+
+// Parses a SELECT, INSERT, UPDATE, DELETE, CREATE TABLE, ALTER TABLE or
+// DROP TABLE statement. Values may be given as ? parameters, bound when the
+// query is executed.
+func ParseQuery(sql string) (*Query, error) {
+	tokens, err := tokenizeSQL(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &sqlParser{sql: sql, tokens: tokens}
+	statement, err := parser.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+
+	if !parser.peekKind(sqlTokenEOF) {
+		return nil, parser.errorf("unexpected %s", parser.peek().text)
+	}
+
+	return &Query{sql: sql, statement: statement, numParams: parser.numParams}, nil
+}
+
+func (q *Query) String() string {
+	return q.sql
+}
+
+// Returns the number of ? parameters in the query.
+func (q *Query) NumParams() int {
+	return q.numParams
+}
+
+// Returns true if the query is a SELECT, which returns rows.
+func (q *Query) IsSelect() bool {
+	_, ok := q.statement.(*sqlSelect)
+	return ok
+}
+
+// Parses and executes a statement.
+func (p *MSIPackage) ExecuteSQL(sql string, params ...Value) (*QueryResult, error) {
+	query, err := ParseQuery(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Execute(query, params...)
+}
+
+// Executes a parsed statement, binding the given values to its ?
+// parameters in order. HOLD and FREE are accepted and do nothing, since
+// tables are never unloaded.
+func (p *MSIPackage) Execute(query *Query, params ...Value) (*QueryResult, error) {
+	if len(params) != query.numParams {
+		return nil, fmt.Errorf("query has %d parameters, but %d values were given", query.numParams, len(params))
+	}
+
+	bound := make([]Value, len(params))
+	for i, param := range params {
+		bound[i] = normalizeValue(param)
+		if str, ok := bound[i].(string); ok && str == "" {
+			bound[i] = nil
+		}
+	}
+
+	return query.statement.execute(p, bound)
+}
+
+type sqlStatement interface {
+	execute(p *MSIPackage, params []Value) (*QueryResult, error)
+}
+
+type sqlTokenKind int
+
+const (
+	sqlTokenIdentifier sqlTokenKind = iota
+	sqlTokenString
+	sqlTokenInteger
+	sqlTokenSymbol
+	sqlTokenParam
+	sqlTokenEOF
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	// Set for identifiers in backquotes, which are never keywords.
+	quoted bool
+	pos    int
+}
+
+func tokenizeSQL(sql string) ([]*sqlToken, error) {
+	tokens := make([]*sqlToken, 0)
+	for i := 0; i < len(sql); {
+		ch := sql[i]
+		start := i
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			i++
+		case ch == '`':
+			end := strings.IndexByte(sql[i+1:], '`')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated identifier at %d", start)
+			}
+			tokens = append(tokens, &sqlToken{kind: sqlTokenIdentifier, text: sql[i+1 : i+1+end], quoted: true, pos: start})
+			i += end + 2
+		case ch == '\'':
+			str := strings.Builder{}
+			i++
+			for {
+				if i >= len(sql) {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				if sql[i] == '\'' {
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						str.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				str.WriteByte(sql[i])
+				i++
+			}
+			tokens = append(tokens, &sqlToken{kind: sqlTokenString, text: str.String(), pos: start})
+		case (ch >= '0' && ch <= '9') || (ch == '-' && i+1 < len(sql) && sql[i+1] >= '0' && sql[i+1] <= '9'):
+			i++
+			for i < len(sql) && sql[i] >= '0' && sql[i] <= '9' {
+				i++
+			}
+			tokens = append(tokens, &sqlToken{kind: sqlTokenInteger, text: sql[start:i], pos: start})
+		case ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z'):
+			for i < len(sql) && (sql[i] == '_' || (sql[i] >= 'a' && sql[i] <= 'z') ||
+				(sql[i] >= 'A' && sql[i] <= 'Z') || (sql[i] >= '0' && sql[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, &sqlToken{kind: sqlTokenIdentifier, text: sql[start:i], pos: start})
+		case ch == '?':
+			tokens = append(tokens, &sqlToken{kind: sqlTokenParam, text: "?", pos: start})
+			i++
+		case ch == '<' || ch == '>':
+			i++
+			if i < len(sql) && (sql[i] == '=' || (ch == '<' && sql[i] == '>')) {
+				i++
+			}
+			tokens = append(tokens, &sqlToken{kind: sqlTokenSymbol, text: sql[start:i], pos: start})
+		case strings.IndexByte("(),*=.", ch) != -1:
+			tokens = append(tokens, &sqlToken{kind: sqlTokenSymbol, text: string(ch), pos: start})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q at %d", ch, start)
+		}
+	}
+	tokens = append(tokens, &sqlToken{kind: sqlTokenEOF, text: "end of query", pos: len(sql)})
+
+	return tokens, nil
+}
+
+type sqlParser struct {
+	sql       string
+	tokens    []*sqlToken
+	pos       int
+	numParams int
+}
+
+func (p *sqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("query %q: %s at %d", p.sql, fmt.Sprintf(format, args...), p.peek().pos)
+}
+
+func (p *sqlParser) peek() *sqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *sqlParser) next() *sqlToken {
+	token := p.tokens[p.pos]
+	if token.kind != sqlTokenEOF {
+		p.pos++
+	}
+
+	return token
+}
+
+func (p *sqlParser) peekKind(kind sqlTokenKind) bool {
+	return p.peek().kind == kind
+}
+
+func (p *sqlParser) peekKeyword(keyword string) bool {
+	token := p.peek()
+	return token.kind == sqlTokenIdentifier && !token.quoted && strings.EqualFold(token.text, keyword)
+}
+
+func (p *sqlParser) peekSymbol(symbol string) bool {
+	token := p.peek()
+	return token.kind == sqlTokenSymbol && token.text == symbol
+}
+
+func (p *sqlParser) acceptKeyword(keyword string) bool {
+	if p.peekKeyword(keyword) {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *sqlParser) acceptSymbol(symbol string) bool {
+	if p.peekSymbol(symbol) {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *sqlParser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		return p.errorf("expected %s but found %s", keyword, p.peek().text)
+	}
+
+	return nil
+}
+
+func (p *sqlParser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return p.errorf("expected %s but found %s", symbol, p.peek().text)
+	}
+
+	return nil
+}
+
+func (p *sqlParser) parseIdentifier() (string, error) {
+	token := p.peek()
+	if token.kind != sqlTokenIdentifier {
+		return "", p.errorf("expected a name but found %s", token.text)
+	}
+	p.pos++
+
+	return token.text, nil
+}
+
+func (p *sqlParser) parseStatement() (sqlStatement, error) {
+	switch {
+	case p.acceptKeyword("SELECT"):
+		return p.parseSelect()
+	case p.acceptKeyword("INSERT"):
+		return p.parseInsert()
+	case p.acceptKeyword("UPDATE"):
+		return p.parseUpdate()
+	case p.acceptKeyword("DELETE"):
+		return p.parseDelete()
+	case p.acceptKeyword("CREATE"):
+		return p.parseCreate()
+	case p.acceptKeyword("ALTER"):
+		return p.parseAlter()
+	case p.acceptKeyword("DROP"):
+		err := p.expectKeyword("TABLE")
+		if err != nil {
+			return nil, err
+		}
+		name, err := p.parseIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlDropTable{table: name}, nil
+	default:
+		return nil, p.errorf("unsupported statement %s", p.peek().text)
+	}
+}
+
+// A column, optionally qualified by its table.
+type sqlColumnName struct {
+	table  string
+	column string
+}
+
+func (c *sqlColumnName) String() string {
+	if c.table == "" {
+		return c.column
+	}
+
+	return c.table + "." + c.column
+}
+
+func (p *sqlParser) parseColumnName() (*sqlColumnName, error) {
+	name, err := p.parseIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.acceptSymbol(".") {
+		column, err := p.parseIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlColumnName{table: name, column: column}, nil
+	}
+
+	return &sqlColumnName{column: name}, nil
+}
+
+func (p *sqlParser) parseColumnNames() ([]*sqlColumnName, error) {
+	names := make([]*sqlColumnName, 0)
+	for {
+		name, err := p.parseColumnName()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.acceptSymbol(",") {
+			return names, nil
+		}
+	}
+}
+
+func (p *sqlParser) parseIdentifiers() ([]string, error) {
+	names := make([]string, 0)
+	for {
+		name, err := p.parseIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.acceptSymbol(",") {
+			return names, nil
+		}
+	}
+}
+
+type sqlOperandKind int
+
+const (
+	sqlOperandColumn sqlOperandKind = iota
+	sqlOperandLiteral
+	sqlOperandParam
+)
+
+// A column, literal or parameter in a WHERE clause or a list of values.
+type sqlOperand struct {
+	kind   sqlOperandKind
+	column *sqlColumnName
+	value  Value
+	param  int
+}
+
+func (p *sqlParser) parseOperand(allowColumns bool) (*sqlOperand, error) {
+	token := p.peek()
+	switch token.kind {
+	case sqlTokenString:
+		p.pos++
+		var value Value = token.text
+		if token.text == "" {
+			value = nil
+		}
+		return &sqlOperand{kind: sqlOperandLiteral, value: value}, nil
+	case sqlTokenInteger:
+		p.pos++
+		num, err := strconv.ParseInt(token.text, 10, 32)
+		if err != nil {
+			return nil, p.errorf("invalid integer %s", token.text)
+		}
+		return &sqlOperand{kind: sqlOperandLiteral, value: int(num)}, nil
+	case sqlTokenParam:
+		p.pos++
+		p.numParams++
+		return &sqlOperand{kind: sqlOperandParam, param: p.numParams - 1}, nil
+	case sqlTokenIdentifier:
+		if !token.quoted && strings.EqualFold(token.text, "NULL") {
+			p.pos++
+			return &sqlOperand{kind: sqlOperandLiteral}, nil
+		}
+		if !allowColumns {
+			return nil, p.errorf("expected a value but found %s", token.text)
+		}
+		column, err := p.parseColumnName()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlOperand{kind: sqlOperandColumn, column: column}, nil
+	default:
+		return nil, p.errorf("expected a value but found %s", token.text)
+	}
+}
+
+type sqlExpr interface{}
+
+type sqlLogical struct {
+	and         bool
+	left, right sqlExpr
+}
+
+type sqlComparison struct {
+	op          string
+	left, right *sqlOperand
+}
+
+type sqlIsNull struct {
+	operand *sqlOperand
+	not     bool
+}
+
+func (p *sqlParser) parseOr() (sqlExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlLogical{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *sqlParser) parseAnd() (sqlExpr, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.acceptKeyword("AND") {
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlLogical{and: true, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *sqlParser) parseComparison() (sqlExpr, error) {
+	if p.acceptSymbol("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expectSymbol(")")
+	}
+
+	left, err := p.parseOperand(true)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.acceptKeyword("IS") {
+		not := p.acceptKeyword("NOT")
+		err = p.expectKeyword("NULL")
+		if err != nil {
+			return nil, err
+		}
+		return &sqlIsNull{operand: left, not: not}, nil
+	}
+
+	token := p.peek()
+	switch {
+	case token.kind == sqlTokenSymbol && (token.text == "=" || token.text == "<>" || token.text == "<" ||
+		token.text == ">" || token.text == "<=" || token.text == ">="):
+		p.pos++
+	default:
+		return nil, p.errorf("expected a comparison but found %s", token.text)
+	}
+
+	right, err := p.parseOperand(true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlComparison{op: token.text, left: left, right: right}, nil
+}
+
+// Where a column of a query is found: the index of its table in the FROM
+// list and its index in that table.
+type sqlColumnRef struct {
+	table  int
+	column int
+}
+
+// Binds the column names used by a statement to the tables it reads.
+type sqlScope struct {
+	tables []*Table
+	refs   map[*sqlColumnName]sqlColumnRef
+}
+
+func (s *sqlScope) resolve(name *sqlColumnName) (sqlColumnRef, error) {
+	if ref, ok := s.refs[name]; ok {
+		return ref, nil
+	}
+
+	found := sqlColumnRef{table: -1}
+	for i, table := range s.tables {
+		if name.table != "" && name.table != table.Name {
+			continue
+		}
+		idx := table.ColumnIndex(name.column)
+		if idx == -1 {
+			continue
+		}
+		if found.table != -1 {
+			return found, fmt.Errorf("column %s is ambiguous", name)
+		}
+		found = sqlColumnRef{table: i, column: idx}
+	}
+
+	if found.table == -1 {
+		return found, fmt.Errorf("unknown column %s", name)
+	}
+	s.refs[name] = found
+
+	return found, nil
+}
+
+// Resolves every column of the expression and returns the highest index
+// of the tables it uses, or -1 if it uses none.
+func (s *sqlScope) resolveExpr(expr sqlExpr) (int, error) {
+	maxTable := -1
+	operand := func(o *sqlOperand) error {
+		if o.kind != sqlOperandColumn {
+			return nil
+		}
+		ref, err := s.resolve(o.column)
+		if err != nil {
+			return err
+		}
+		if ref.table > maxTable {
+			maxTable = ref.table
+		}
+		return nil
+	}
+
+	switch e := expr.(type) {
+	case *sqlLogical:
+		left, err := s.resolveExpr(e.left)
+		if err != nil {
+			return 0, err
+		}
+		right, err := s.resolveExpr(e.right)
+		if err != nil {
+			return 0, err
+		}
+		if left > right {
+			return left, nil
+		}
+		return right, nil
+	case *sqlComparison:
+		if err := operand(e.left); err != nil {
+			return 0, err
+		}
+		if err := operand(e.right); err != nil {
+			return 0, err
+		}
+	case *sqlIsNull:
+		if err := operand(e.operand); err != nil {
+			return 0, err
+		}
+	}
+
+	return maxTable, nil
+}
+
+func (s *sqlScope) value(o *sqlOperand, rows [][]Value, params []Value) Value {
+	if o.kind == sqlOperandColumn {
+		ref := s.refs[o.column]
+		return rows[ref.table][ref.column]
+	}
+
+	return o.constant(params)
+}
+
+// Returns the value of a literal or parameter.
+func (o *sqlOperand) constant(params []Value) Value {
+	if o.kind == sqlOperandParam {
+		return params[o.param]
+	}
+
+	return o.value
+}
+
+// Evaluates a WHERE clause. Comparisons with null, and between an integer
+// and a string, are false.
+func (s *sqlScope) evaluate(expr sqlExpr, rows [][]Value, params []Value) bool {
+	switch e := expr.(type) {
+	case *sqlLogical:
+		if e.and {
+			return s.evaluate(e.left, rows, params) && s.evaluate(e.right, rows, params)
+		}
+		return s.evaluate(e.left, rows, params) || s.evaluate(e.right, rows, params)
+	case *sqlIsNull:
+		isNull := s.value(e.operand, rows, params) == nil
+		return isNull != e.not
+	case *sqlComparison:
+		left := s.value(e.left, rows, params)
+		right := s.value(e.right, rows, params)
+		cmp, ok := compareSQLValues(left, right)
+		if !ok {
+			return false
+		}
+		switch e.op {
+		case "=":
+			return cmp == 0
+		case "<>":
+			return cmp != 0
+		case "<":
+			return cmp < 0
+		case ">":
+			return cmp > 0
+		case "<=":
+			return cmp <= 0
+		case ">=":
+			return cmp >= 0
+		}
+	}
+
+	return false
+}
+
+func compareSQLValues(left Value, right Value) (int, bool) {
+	switch l := left.(type) {
+	case int:
+		r, ok := right.(int)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case l < r:
+			return -1, true
+		case l > r:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(l, r), true
+	}
+
+	return 0, false
+}
+
+// Orders values for ORDER BY: nulls first, then integers, then strings.
+func orderSQLValues(left Value, right Value) int {
+	if cmp, ok := compareSQLValues(left, right); ok {
+		return cmp
+	}
+
+	rank := func(v Value) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int:
+			return 1
+		default:
+			return 2
+		}
+	}
+
+	return rank(left) - rank(right)
+}
+
+// Splits a WHERE clause into the expressions joined by its top-level ANDs.
+func splitConjuncts(expr sqlExpr) []sqlExpr {
+	if expr == nil {
+		return nil
+	}
+
+	if logical, ok := expr.(*sqlLogical); ok && logical.and {
+		return append(splitConjuncts(logical.left), splitConjuncts(logical.right)...)
+	}
+
+	return []sqlExpr{expr}
+}
+
+func (p *MSIPackage) tablesByName(names []string) ([]*Table, error) {
+	tables := make([]*Table, len(names))
+	for i, name := range names {
+		tables[i] = p.Table(name)
+		if tables[i] == nil {
+			return nil, fmt.Errorf("table %s does not exist", name)
+		}
+	}
+
+	return tables, nil
+}
+
+func (p *MSIPackage) tableValues(table *Table) ([][]Value, error) {
+	rows, err := p.SelectRows(table.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]Value, 0, rows.Len())
+	for row := rows.Next(); row != nil; row = rows.Next() {
+		values = append(values, row.Values)
+	}
+
+	return values, nil
+}
+
+type sqlSelect struct {
+	distinct bool
+	// Nil for SELECT *.
+	columns []*sqlColumnName
+	tables  []string
+	where   sqlExpr
+	orderBy []*sqlColumnName
+}
+
+func (p *sqlParser) parseSelect() (sqlStatement, error) {
+	statement := &sqlSelect{}
+	statement.distinct = p.acceptKeyword("DISTINCT")
+
+	if !p.acceptSymbol("*") {
+		columns, err := p.parseColumnNames()
+		if err != nil {
+			return nil, err
+		}
+		statement.columns = columns
+	}
+
+	err := p.expectKeyword("FROM")
+	if err != nil {
+		return nil, err
+	}
+
+	statement.tables, err = p.parseIdentifiers()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.acceptKeyword("WHERE") {
+		statement.where, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("ORDER") {
+		err = p.expectKeyword("BY")
+		if err != nil {
+			return nil, err
+		}
+		statement.orderBy, err = p.parseColumnNames()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return statement, nil
+}
+
+// Joins the tables with nested loops. Each part of the WHERE clause is
+// checked as soon as the tables it uses are bound, and a table compared for
+// equality with one bound before it is looked up through a hash index.
+func (s *sqlSelect) execute(p *MSIPackage, params []Value) (*QueryResult, error) {
+	tables, err := p.tablesByName(s.tables)
+	if err != nil {
+		return nil, err
+	}
+	scope := &sqlScope{tables: tables, refs: make(map[*sqlColumnName]sqlColumnRef)}
+
+	conjuncts := splitConjuncts(s.where)
+	checks := make([][]sqlExpr, len(tables))
+	lookups := make([]*sqlComparison, len(tables))
+	for _, conjunct := range conjuncts {
+		maxTable, err := scope.resolveExpr(conjunct)
+		if err != nil {
+			return nil, err
+		}
+		if maxTable < 0 {
+			maxTable = 0
+		}
+		checks[maxTable] = append(checks[maxTable], conjunct)
+
+		if comparison, ok := conjunct.(*sqlComparison); ok && comparison.op == "=" && lookups[maxTable] == nil {
+			if lookupColumn(scope, comparison, maxTable) != nil {
+				lookups[maxTable] = comparison
+			}
+		}
+	}
+
+	columns := make([]*sqlColumnName, 0)
+	if s.columns == nil {
+		for _, table := range tables {
+			for _, column := range table.Columns {
+				columns = append(columns, &sqlColumnName{table: table.Name, column: column.Name})
+			}
+		}
+	} else {
+		columns = s.columns
+	}
+	selected := make([]sqlColumnRef, len(columns))
+	for i, column := range columns {
+		selected[i], err = scope.resolve(column)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ordered := make([]sqlColumnRef, len(s.orderBy))
+	for i, column := range s.orderBy {
+		ordered[i], err = scope.resolve(column)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	values := make([][][]Value, len(tables))
+	for i, table := range tables {
+		values[i], err = p.tableValues(table)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	indexes := make([]map[Value][]int, len(tables))
+	matches := make([][][]Value, 0)
+	current := make([][]Value, len(tables))
+	var join func(k int)
+	join = func(k int) {
+		if k == len(tables) {
+			matches = append(matches, append([][]Value(nil), current...))
+			return
+		}
+
+		candidates := values[k]
+		if lookup := lookups[k]; lookup != nil {
+			column := lookupColumn(scope, lookup, k)
+			other := lookup.left
+			if other == column {
+				other = lookup.right
+			}
+			if indexes[k] == nil {
+				indexes[k] = make(map[Value][]int)
+				ref := scope.refs[column.column]
+				for i, row := range values[k] {
+					if row[ref.column] != nil {
+						indexes[k][row[ref.column]] = append(indexes[k][row[ref.column]], i)
+					}
+				}
+			}
+			key := scope.value(other, current, params)
+			candidates = make([][]Value, 0)
+			if key != nil {
+				for _, i := range indexes[k][key] {
+					candidates = append(candidates, values[k][i])
+				}
+			}
+		}
+
+	rows:
+		for _, row := range candidates {
+			current[k] = row
+			for _, check := range checks[k] {
+				if !scope.evaluate(check, current, params) {
+					continue rows
+				}
+			}
+			join(k + 1)
+		}
+	}
+	join(0)
+
+	if len(ordered) > 0 {
+		sort.SliceStable(matches, func(i, j int) bool {
+			for _, ref := range ordered {
+				cmp := orderSQLValues(matches[i][ref.table][ref.column], matches[j][ref.table][ref.column])
+				if cmp != 0 {
+					return cmp < 0
+				}
+			}
+			return false
+		})
+	}
+
+	result := &QueryResult{
+		Table: selectedTable(tables, columns, selected),
+		Rows:  make([][]Value, 0, len(matches)),
+	}
+	seen := make(map[string]struct{})
+	for _, match := range matches {
+		row := make([]Value, len(selected))
+		for i, ref := range selected {
+			row[i] = match[ref.table][ref.column]
+		}
+		if s.distinct {
+			key := fmt.Sprintf("%#v", row)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+
+	return result, nil
+}
+
+// Returns the operand of an equality that is a column of table k, if the
+// other operand only depends on tables bound before it.
+func lookupColumn(scope *sqlScope, comparison *sqlComparison, k int) *sqlOperand {
+	isColumnOf := func(o *sqlOperand, table int) bool {
+		return o.kind == sqlOperandColumn && scope.refs[o.column].table == table
+	}
+	isBound := func(o *sqlOperand) bool {
+		return o.kind != sqlOperandColumn || scope.refs[o.column].table < k
+	}
+
+	if isColumnOf(comparison.left, k) && isBound(comparison.right) {
+		return comparison.left
+	}
+	if isColumnOf(comparison.right, k) && isBound(comparison.left) {
+		return comparison.right
+	}
+
+	return nil
+}
+
+// Describes the selected columns as a table. Columns are named after the
+// table columns they come from, qualified by table name when two selected
+// columns share a name.
+func selectedTable(tables []*Table, names []*sqlColumnName, refs []sqlColumnRef) *Table {
+	counts := make(map[string]int)
+	for _, name := range names {
+		counts[name.column]++
+	}
+
+	columns := make([]*Column, len(refs))
+	tableNames := make([]string, 0)
+	seenTables := make(map[int]struct{})
+	for i, ref := range refs {
+		source := tables[ref.table]
+		column := *source.Columns[ref.column]
+		if counts[column.Name] > 1 {
+			column.Name = source.Name + "." + column.Name
+		}
+		columns[i] = &column
+
+		if _, ok := seenTables[ref.table]; !ok {
+			seenTables[ref.table] = struct{}{}
+			tableNames = append(tableNames, source.Name)
+		}
+	}
+
+	return NewTable(strings.Join(tableNames, ","), columns, false)
+}
+
+type sqlInsert struct {
+	table     string
+	columns   []string
+	values    []*sqlOperand
+	temporary bool
+}
+
+func (p *sqlParser) parseInsert() (sqlStatement, error) {
+	err := p.expectKeyword("INTO")
+	if err != nil {
+		return nil, err
+	}
+
+	statement := &sqlInsert{}
+	statement.table, err = p.parseIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expectSymbol("(")
+	if err != nil {
+		return nil, err
+	}
+	statement.columns, err = p.parseIdentifiers()
+	if err != nil {
+		return nil, err
+	}
+	err = p.expectSymbol(")")
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expectKeyword("VALUES")
+	if err != nil {
+		return nil, err
+	}
+	err = p.expectSymbol("(")
+	if err != nil {
+		return nil, err
+	}
+	for {
+		value, err := p.parseOperand(false)
+		if err != nil {
+			return nil, err
+		}
+		statement.values = append(statement.values, value)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	err = p.expectSymbol(")")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(statement.columns) != len(statement.values) {
+		return nil, p.errorf("%d columns but %d values", len(statement.columns), len(statement.values))
+	}
+
+	statement.temporary = p.acceptKeyword("TEMPORARY")
+
+	return statement, nil
+}
+
+func (s *sqlInsert) execute(p *MSIPackage, params []Value) (*QueryResult, error) {
+	if s.temporary {
+		return nil, fmt.Errorf("temporary rows are not supported")
+	}
+
+	table := p.Table(s.table)
+	if table == nil {
+		return nil, fmt.Errorf("table %s does not exist", s.table)
+	}
+
+	row := make([]Value, len(table.Columns))
+	for i, name := range s.columns {
+		idx := table.ColumnIndex(name)
+		if idx == -1 {
+			return nil, fmt.Errorf("table %s has no column %s", s.table, name)
+		}
+		row[idx] = s.values[i].constant(params)
+	}
+
+	err := p.InsertRows(s.table, [][]Value{row})
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueryResult{RowsAffected: 1}, nil
+}
+
+type sqlUpdate struct {
+	table   string
+	columns []string
+	values  []*sqlOperand
+	where   sqlExpr
+}
+
+func (p *sqlParser) parseUpdate() (sqlStatement, error) {
+	statement := &sqlUpdate{}
+	var err error
+	statement.table, err = p.parseIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expectKeyword("SET")
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		column, err := p.parseColumnName()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectSymbol("=")
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.parseOperand(false)
+		if err != nil {
+			return nil, err
+		}
+		statement.columns = append(statement.columns, column.column)
+		statement.values = append(statement.values, value)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if p.acceptKeyword("WHERE") {
+		statement.where, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return statement, nil
+}
+
+func (s *sqlUpdate) execute(p *MSIPackage, params []Value) (*QueryResult, error) {
+	where, err := p.sqlRowFilter(s.table, s.where, params)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]Value)
+	for i, column := range s.columns {
+		values[column] = s.values[i].constant(params)
+	}
+
+	count, err := p.UpdateRows(s.table, values, where)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueryResult{RowsAffected: count}, nil
+}
+
+type sqlDelete struct {
+	table string
+	where sqlExpr
+}
+
+func (p *sqlParser) parseDelete() (sqlStatement, error) {
+	err := p.expectKeyword("FROM")
+	if err != nil {
+		return nil, err
+	}
+
+	statement := &sqlDelete{}
+	statement.table, err = p.parseIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.acceptKeyword("WHERE") {
+		statement.where, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return statement, nil
+}
+
+func (s *sqlDelete) execute(p *MSIPackage, params []Value) (*QueryResult, error) {
+	where, err := p.sqlRowFilter(s.table, s.where, params)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := p.DeleteRows(s.table, where)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueryResult{RowsAffected: count}, nil
+}
+
+// Turns the WHERE clause of an UPDATE or DELETE into a row predicate.
+func (p *MSIPackage) sqlRowFilter(tableName string, where sqlExpr, params []Value) (func(*Row) bool, error) {
+	table := p.Table(tableName)
+	if table == nil {
+		return nil, fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	if where == nil {
+		return nil, nil
+	}
+
+	scope := &sqlScope{tables: []*Table{table}, refs: make(map[*sqlColumnName]sqlColumnRef)}
+	_, err := scope.resolveExpr(where)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(row *Row) bool {
+		return scope.evaluate(where, [][]Value{row.Values}, params)
+	}, nil
+}
+
+type sqlCreateTable struct {
+	table   string
+	columns []*Column
+}
+
+func (p *sqlParser) parseCreate() (sqlStatement, error) {
+	err := p.expectKeyword("TABLE")
+	if err != nil {
+		return nil, err
+	}
+
+	statement := &sqlCreateTable{}
+	statement.table, err = p.parseIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expectSymbol("(")
+	if err != nil {
+		return nil, err
+	}
+
+	var primaryKey []string
+	for {
+		if p.acceptKeyword("PRIMARY") {
+			err = p.expectKeyword("KEY")
+			if err != nil {
+				return nil, err
+			}
+			primaryKey, err = p.parseIdentifiers()
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		column, err := p.parseColumnDefinition()
+		if err != nil {
+			return nil, err
+		}
+		statement.columns = append(statement.columns, column)
+
+		// The PRIMARY KEY clause may follow the last column without a comma.
+		if !p.acceptSymbol(",") && !p.peekKeyword("PRIMARY") {
+			break
+		}
+	}
+
+	err = p.expectSymbol(")")
+	if err != nil {
+		return nil, err
+	}
+	p.acceptKeyword("HOLD")
+
+	for _, name := range primaryKey {
+		found := false
+		for _, column := range statement.columns {
+			if column.Name == name {
+				column.IsPrimarykey = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, p.errorf("primary key column %s is not defined", name)
+		}
+	}
+
+	return statement, nil
+}
+
+// Parses "name type [NOT NULL] [TEMPORARY] [LOCALIZABLE]". Columns that are
+// not NOT NULL are nullable.
+func (p *sqlParser) parseColumnDefinition() (*Column, error) {
+	name, err := p.parseIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	builder := NewColumnBuilder(name)
+	typeName, err := p.parseIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	var makeColumn func() *Column
+	switch strings.ToUpper(typeName) {
+	case "CHAR", "CHARACTER":
+		size := 0
+		if p.acceptSymbol("(") {
+			token := p.next()
+			if token.kind != sqlTokenInteger {
+				return nil, p.errorf("expected a column size but found %s", token.text)
+			}
+			size, err = strconv.Atoi(token.text)
+			if err != nil || size < 0 || size > 255 {
+				return nil, p.errorf("invalid column size %s", token.text)
+			}
+			err = p.expectSymbol(")")
+			if err != nil {
+				return nil, err
+			}
+		}
+		makeColumn = func() *Column { return builder.String(size) }
+	case "LONGCHAR":
+		makeColumn = func() *Column { return builder.String(0) }
+	case "SHORT", "INT", "INTEGER":
+		makeColumn = builder.Int16
+	case "LONG":
+		makeColumn = builder.Int32
+	case "OBJECT":
+		makeColumn = builder.Binary
+	default:
+		return nil, p.errorf("unknown column type %s", typeName)
+	}
+
+	nullable := true
+	for {
+		switch {
+		case p.acceptKeyword("NOT"):
+			err = p.expectKeyword("NULL")
+			if err != nil {
+				return nil, err
+			}
+			nullable = false
+		case p.acceptKeyword("TEMPORARY"):
+			return nil, p.errorf("temporary columns are not supported")
+		case p.acceptKeyword("LOCALIZABLE"):
+			builder.SetLocalizable()
+		default:
+			if nullable {
+				builder.SetNullable()
+			}
+			return makeColumn(), nil
+		}
+	}
+}
+
+func (s *sqlCreateTable) execute(p *MSIPackage, params []Value) (*QueryResult, error) {
+	columns := make([]*Column, len(s.columns))
+	for i, column := range s.columns {
+		copied := *column
+		columns[i] = &copied
+	}
+
+	err := p.CreateTable(s.table, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueryResult{}, nil
+}
+
+type sqlAlterTable struct {
+	table string
+	// Nil for HOLD and FREE.
+	column *Column
+}
+
+func (p *sqlParser) parseAlter() (sqlStatement, error) {
+	err := p.expectKeyword("TABLE")
+	if err != nil {
+		return nil, err
+	}
+
+	statement := &sqlAlterTable{}
+	statement.table, err = p.parseIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.acceptKeyword("HOLD"), p.acceptKeyword("FREE"):
+		return statement, nil
+	case p.acceptKeyword("ADD"):
+		statement.column, err = p.parseColumnDefinition()
+		if err != nil {
+			return nil, err
+		}
+		p.acceptKeyword("HOLD")
+		return statement, nil
+	default:
+		return nil, p.errorf("expected ADD, HOLD or FREE but found %s", p.peek().text)
+	}
+}
+
+func (s *sqlAlterTable) execute(p *MSIPackage, params []Value) (*QueryResult, error) {
+	if !p.HasTable(s.table) {
+		return nil, fmt.Errorf("table %s does not exist", s.table)
+	}
+
+	if s.column == nil {
+		return &QueryResult{}, nil
+	}
+
+	column := *s.column
+	err := p.AddColumn(s.table, &column)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueryResult{}, nil
+}
+
+type sqlDropTable struct {
+	table string
+}
+
+func (s *sqlDropTable) execute(p *MSIPackage, params []Value) (*QueryResult, error) {
+	err := p.DropTable(s.table)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueryResult{}, nil
+}
@@ -0,0 +1,385 @@
+package msi
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Creates a package on disk with Feature and FeatureComponents tables.
+func newSQLTestPackage(t *testing.T) *MSIPackage {
+	t.Helper()
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "test.msi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+
+	p, err := Create(file, PackageTypeInstaller)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statements := []string{
+		"CREATE TABLE `Feature` (`Feature` CHAR(38) NOT NULL, `Title` CHAR(64) LOCALIZABLE, `Level` SHORT NOT NULL PRIMARY KEY `Feature`)",
+		"CREATE TABLE `FeatureComponents` (`Feature_` CHAR(38) NOT NULL, `Component_` CHAR(72) NOT NULL PRIMARY KEY `Feature_`, `Component_`)",
+		"INSERT INTO `Feature` (`Feature`, `Title`, `Level`) VALUES ('Main', 'Main Feature', 1)",
+		"INSERT INTO `Feature` (`Feature`, `Title`, `Level`) VALUES ('Docs', 'Documentation', 3)",
+		"INSERT INTO `Feature` (`Feature`, `Level`) VALUES ('Extras', 1)",
+		"INSERT INTO `FeatureComponents` (`Feature_`, `Component_`) VALUES ('Main', 'Core')",
+		"INSERT INTO `FeatureComponents` (`Feature_`, `Component_`) VALUES ('Main', 'Shell')",
+		"INSERT INTO `FeatureComponents` (`Feature_`, `Component_`) VALUES ('Docs', 'Manual')",
+		"INSERT INTO `FeatureComponents` (`Feature_`, `Component_`) VALUES ('Extras', 'Core')",
+	}
+	for _, sql := range statements {
+		_, err = p.ExecuteSQL(sql)
+		if err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+
+	return p
+}
+
+func selectRows(t *testing.T, p *MSIPackage, sql string, params ...Value) ([]string, [][]Value) {
+	t.Helper()
+
+	result, err := p.ExecuteSQL(sql, params...)
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+
+	rows := make([][]Value, 0)
+	for row := result.Next(); row != nil; row = result.Next() {
+		rows = append(rows, row.Values)
+	}
+
+	return result.Columns(), rows
+}
+
+func TestSQLSelect(t *testing.T) {
+	tests := []struct {
+		name        string
+		sql         string
+		params      []Value
+		wantColumns []string
+		wantRows    [][]Value
+	}{
+		{
+			name:        "all columns",
+			sql:         "SELECT * FROM `Feature` ORDER BY `Feature`",
+			wantColumns: []string{"Feature", "Title", "Level"},
+			wantRows:    [][]Value{{"Docs", "Documentation", 3}, {"Extras", nil, 1}, {"Main", "Main Feature", 1}},
+		},
+		{
+			name:        "where string",
+			sql:         "SELECT `Title` FROM `Feature` WHERE `Feature` = 'Docs'",
+			wantColumns: []string{"Title"},
+			wantRows:    [][]Value{{"Documentation"}},
+		},
+		{
+			name:        "where integer and or",
+			sql:         "SELECT `Feature` FROM `Feature` WHERE `Level` > 1 OR `Feature` = 'Main' AND `Level` = 1 ORDER BY `Feature`",
+			wantColumns: []string{"Feature"},
+			wantRows:    [][]Value{{"Docs"}, {"Main"}},
+		},
+		{
+			name:        "where is null",
+			sql:         "SELECT `Feature` FROM `Feature` WHERE `Title` IS NULL",
+			wantColumns: []string{"Feature"},
+			wantRows:    [][]Value{{"Extras"}},
+		},
+		{
+			name:        "where is not null",
+			sql:         "SELECT `Feature` FROM `Feature` WHERE `Title` IS NOT NULL ORDER BY `Feature`",
+			wantColumns: []string{"Feature"},
+			wantRows:    [][]Value{{"Docs"}, {"Main"}},
+		},
+		{
+			name:        "null never compares equal",
+			sql:         "SELECT `Feature` FROM `Feature` WHERE `Title` = ''",
+			wantColumns: []string{"Feature"},
+			wantRows:    [][]Value{},
+		},
+		{
+			name:        "string parameter",
+			sql:         "SELECT `Level` FROM `Feature` WHERE `Feature` = ?",
+			params:      []Value{"Docs"},
+			wantColumns: []string{"Level"},
+			wantRows:    [][]Value{{3}},
+		},
+		{
+			name:        "integer parameters",
+			sql:         "SELECT `Feature` FROM `Feature` WHERE `Level` >= ? AND `Level` < ? ORDER BY `Feature`",
+			params:      []Value{int16(1), int32(3)},
+			wantColumns: []string{"Feature"},
+			wantRows:    [][]Value{{"Extras"}, {"Main"}},
+		},
+		{
+			name:        "order by several columns",
+			sql:         "SELECT `Feature`, `Level` FROM `Feature` ORDER BY `Level`, `Feature`",
+			wantColumns: []string{"Feature", "Level"},
+			wantRows:    [][]Value{{"Extras", 1}, {"Main", 1}, {"Docs", 3}},
+		},
+		{
+			name:        "order by puts nulls first",
+			sql:         "SELECT `Feature` FROM `Feature` ORDER BY `Title`",
+			wantColumns: []string{"Feature"},
+			wantRows:    [][]Value{{"Extras"}, {"Docs"}, {"Main"}},
+		},
+		{
+			name:        "distinct",
+			sql:         "SELECT DISTINCT `Level` FROM `Feature` ORDER BY `Level`",
+			wantColumns: []string{"Level"},
+			wantRows:    [][]Value{{1}, {3}},
+		},
+		{
+			name:        "join",
+			sql:         "SELECT `Feature`.`Title`, `Component_` FROM `Feature`, `FeatureComponents` WHERE `Feature`.`Feature` = `FeatureComponents`.`Feature_` AND `Level` = 1 ORDER BY `Component_`, `Feature`.`Title`",
+			wantColumns: []string{"Title", "Component_"},
+			wantRows:    [][]Value{{nil, "Core"}, {"Main Feature", "Core"}, {"Main Feature", "Shell"}},
+		},
+		{
+			name:        "join with parameter",
+			sql:         "SELECT DISTINCT `Feature_` FROM `FeatureComponents`, `Feature` WHERE `Component_` = ? AND `Feature_` = `Feature` AND `Level` = 1 ORDER BY `Feature_`",
+			params:      []Value{"Core"},
+			wantColumns: []string{"Feature_"},
+			wantRows:    [][]Value{{"Extras"}, {"Main"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSQLTestPackage(t)
+
+			columns, rows := selectRows(t, p, tt.sql, tt.params...)
+			if !reflect.DeepEqual(columns, tt.wantColumns) {
+				t.Errorf("got columns %v, want %v", columns, tt.wantColumns)
+			}
+			if !reflect.DeepEqual(rows, tt.wantRows) {
+				t.Errorf("got rows %v, want %v", rows, tt.wantRows)
+			}
+		})
+	}
+}
+
+func TestSQLModify(t *testing.T) {
+	tests := []struct {
+		name         string
+		sql          string
+		params       []Value
+		wantAffected int
+		query        string
+		wantRows     [][]Value
+	}{
+		{
+			name:         "insert",
+			sql:          "INSERT INTO `Feature` (`Feature`, `Title`, `Level`) VALUES ('Tools', 'It''s tools', 2)",
+			wantAffected: 1,
+			query:        "SELECT `Title`, `Level` FROM `Feature` WHERE `Feature` = 'Tools'",
+			wantRows:     [][]Value{{"It's tools", 2}},
+		},
+		{
+			name:         "insert parameters",
+			sql:          "INSERT INTO `Feature` (`Level`, `Feature`, `Title`) VALUES (?, ?, ?)",
+			params:       []Value{-1, "Tools", ""},
+			wantAffected: 1,
+			query:        "SELECT `Title`, `Level` FROM `Feature` WHERE `Feature` = 'Tools'",
+			wantRows:     [][]Value{{nil, -1}},
+		},
+		{
+			name:         "update",
+			sql:          "UPDATE `Feature` SET `Level` = 2, `Title` = 'Optional' WHERE `Level` = 1",
+			wantAffected: 2,
+			query:        "SELECT `Feature`, `Title`, `Level` FROM `Feature` ORDER BY `Feature`",
+			wantRows:     [][]Value{{"Docs", "Documentation", 3}, {"Extras", "Optional", 2}, {"Main", "Optional", 2}},
+		},
+		{
+			name:         "update parameters",
+			sql:          "UPDATE `Feature` SET `Title` = ? WHERE `Feature` = ?",
+			params:       []Value{nil, "Main"},
+			wantAffected: 1,
+			query:        "SELECT `Feature` FROM `Feature` WHERE `Title` IS NULL ORDER BY `Feature`",
+			wantRows:     [][]Value{{"Extras"}, {"Main"}},
+		},
+		{
+			name:         "update without where",
+			sql:          "UPDATE `Feature` SET `Level` = 0",
+			wantAffected: 3,
+			query:        "SELECT DISTINCT `Level` FROM `Feature`",
+			wantRows:     [][]Value{{0}},
+		},
+		{
+			name:         "delete",
+			sql:          "DELETE FROM `FeatureComponents` WHERE `Component_` = 'Core'",
+			wantAffected: 2,
+			query:        "SELECT `Feature_`, `Component_` FROM `FeatureComponents` ORDER BY `Component_`",
+			wantRows:     [][]Value{{"Docs", "Manual"}, {"Main", "Shell"}},
+		},
+		{
+			name:         "delete parameters",
+			sql:          "DELETE FROM `FeatureComponents` WHERE `Feature_` = ? AND `Component_` <> ?",
+			params:       []Value{"Main", "Shell"},
+			wantAffected: 1,
+			query:        "SELECT `Component_` FROM `FeatureComponents` WHERE `Feature_` = 'Main'",
+			wantRows:     [][]Value{{"Shell"}},
+		},
+		{
+			name:         "delete without where",
+			sql:          "DELETE FROM `FeatureComponents`",
+			wantAffected: 4,
+			query:        "SELECT * FROM `FeatureComponents`",
+			wantRows:     [][]Value{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSQLTestPackage(t)
+
+			result, err := p.ExecuteSQL(tt.sql, tt.params...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.RowsAffected != tt.wantAffected {
+				t.Errorf("got %d rows affected, want %d", result.RowsAffected, tt.wantAffected)
+			}
+
+			_, rows := selectRows(t, p, tt.query)
+			if !reflect.DeepEqual(rows, tt.wantRows) {
+				t.Errorf("got rows %v, want %v", rows, tt.wantRows)
+			}
+		})
+	}
+}
+
+func TestSQLSchema(t *testing.T) {
+	p := newSQLTestPackage(t)
+
+	_, err := p.ExecuteSQL("CREATE TABLE `Shortcut` (`Shortcut` CHAR(72) NOT NULL, `Directory_` CHAR(72) NOT NULL, `Name` CHAR(128) NOT NULL LOCALIZABLE, `Target` LONGCHAR, `Icon` OBJECT, `Show` SHORT, `Size` LONG NOT NULL PRIMARY KEY `Shortcut`, `Directory_`) HOLD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type column struct {
+		Name        string
+		Type        ColumnType
+		Size        int
+		Nullable    bool
+		PrimaryKey  bool
+		Localizable bool
+	}
+	columns := func(name string) []column {
+		table := p.Table(name)
+		if table == nil {
+			t.Fatalf("table %s does not exist", name)
+		}
+		columns := make([]column, len(table.Columns))
+		for i, c := range table.Columns {
+			columns[i] = column{c.Name, c.ColumnType, c.ColumnStringSize, c.IsNullable, c.IsPrimarykey, c.IsLocalizable}
+		}
+		return columns
+	}
+
+	want := []column{
+		{"Shortcut", ColumnTypeStr, 72, false, true, false},
+		{"Directory_", ColumnTypeStr, 72, false, true, false},
+		{"Name", ColumnTypeStr, 128, false, false, true},
+		{"Target", ColumnTypeStr, 0, true, false, false},
+		{"Icon", ColumnTypeStr, 0, true, false, false},
+		{"Show", ColumnTypeInt16, 0, true, false, false},
+		{"Size", ColumnTypeInt32, 0, false, false, false},
+	}
+	if got := columns("Shortcut"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got columns %+v, want %+v", got, want)
+	}
+
+	_, err = p.ExecuteSQL("ALTER TABLE `Feature` ADD `Display` SHORT HOLD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := columns("Feature")
+	if last := got[len(got)-1]; last != (column{"Display", ColumnTypeInt16, 0, true, false, false}) {
+		t.Errorf("got added column %+v", last)
+	}
+	_, rows := selectRows(t, p, "SELECT `Feature`, `Display` FROM `Feature` WHERE `Feature` = 'Main'")
+	if !reflect.DeepEqual(rows, [][]Value{{"Main", nil}}) {
+		t.Errorf("got rows %v after adding a column", rows)
+	}
+
+	for _, sql := range []string{"ALTER TABLE `Feature` HOLD", "ALTER TABLE `Feature` FREE"} {
+		_, err = p.ExecuteSQL(sql)
+		if err != nil {
+			t.Errorf("%s: %v", sql, err)
+		}
+	}
+
+	_, err = p.ExecuteSQL("DROP TABLE `FeatureComponents`")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.HasTable("FeatureComponents") {
+		t.Errorf("table FeatureComponents still exists after DROP TABLE")
+	}
+}
+
+func TestSQLErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		params  []Value
+		wantErr string
+	}{
+		{"empty", "", nil, "unsupported statement"},
+		{"unsupported statement", "TRUNCATE `Feature`", nil, "unsupported statement TRUNCATE"},
+		{"unterminated string", "SELECT * FROM `Feature` WHERE `Feature` = 'Main", nil, "unterminated string"},
+		{"unterminated identifier", "SELECT * FROM `Feature", nil, "unterminated identifier"},
+		{"unexpected character", "SELECT * FROM `Feature` WHERE `Level` = 1;", nil, "unexpected character"},
+		{"missing from", "SELECT `Feature`", nil, "expected FROM"},
+		{"trailing tokens", "SELECT * FROM `Feature` `Title`", nil, "unexpected Title"},
+		{"missing comparison", "SELECT * FROM `Feature` WHERE `Level`", nil, "expected a comparison"},
+		{"order without by", "SELECT * FROM `Feature` ORDER `Feature`", nil, "expected BY"},
+		{"unknown table", "SELECT * FROM `Missing`", nil, "table Missing does not exist"},
+		{"unknown column", "SELECT `Missing` FROM `Feature`", nil, "unknown column Missing"},
+		{"unknown order column", "SELECT * FROM `Feature` ORDER BY `Missing`", nil, "unknown column Missing"},
+		{"ambiguous column", "SELECT `Feature` FROM `Feature`, `Feature`", nil, "ambiguous"},
+		{"too few parameters", "SELECT * FROM `Feature` WHERE `Feature` = ?", nil, "1 parameters, but 0 values"},
+		{"too many parameters", "SELECT * FROM `Feature`", []Value{"Main"}, "0 parameters, but 1 values"},
+		{"insert count mismatch", "INSERT INTO `Feature` (`Feature`, `Level`) VALUES ('Tools')", nil, "2 columns but 1 values"},
+		{"insert unknown table", "INSERT INTO `Missing` (`Feature`) VALUES ('Tools')", nil, "table Missing does not exist"},
+		{"insert unknown column", "INSERT INTO `Feature` (`Feature`, `Missing`) VALUES ('Tools', 1)", nil, "has no column Missing"},
+		{"insert duplicate key", "INSERT INTO `Feature` (`Feature`, `Level`) VALUES ('Main', 2)", nil, "already exists"},
+		{"insert null into not null", "INSERT INTO `Feature` (`Feature`) VALUES ('Tools')", nil, "not a valid value"},
+		{"insert temporary", "INSERT INTO `Feature` (`Feature`, `Level`) VALUES ('Tools', 1) TEMPORARY", nil, "temporary rows"},
+		{"insert column in values", "INSERT INTO `Feature` (`Feature`, `Level`) VALUES (`Title`, 1)", nil, "expected a value"},
+		{"update unknown table", "UPDATE `Missing` SET `Level` = 1", nil, "table Missing does not exist"},
+		{"update unknown column", "UPDATE `Feature` SET `Missing` = 1", nil, "has no column Missing"},
+		{"update missing set", "UPDATE `Feature` `Level` = 1", nil, "expected SET"},
+		{"delete unknown table", "DELETE FROM `Missing`", nil, "table Missing does not exist"},
+		{"delete unknown column", "DELETE FROM `Feature` WHERE `Missing` = 1", nil, "unknown column Missing"},
+		{"create existing table", "CREATE TABLE `Feature` (`Feature` CHAR(38) NOT NULL PRIMARY KEY `Feature`)", nil, "already exists"},
+		{"create unknown type", "CREATE TABLE `T` (`A` TEXT PRIMARY KEY `A`)", nil, "unknown column type"},
+		{"create invalid size", "CREATE TABLE `T` (`A` CHAR(256) PRIMARY KEY `A`)", nil, "invalid column size"},
+		{"create undefined key", "CREATE TABLE `T` (`A` CHAR(72) PRIMARY KEY `B`)", nil, "primary key column B"},
+		{"create temporary column", "CREATE TABLE `T` (`A` CHAR(72) TEMPORARY PRIMARY KEY `A`)", nil, "temporary columns"},
+		{"alter unknown table", "ALTER TABLE `Missing` ADD `A` SHORT", nil, "table Missing does not exist"},
+		{"alter existing column", "ALTER TABLE `Feature` ADD `Level` SHORT", nil, "already has a column"},
+		{"alter unknown action", "ALTER TABLE `Feature` DROP `Level`", nil, "expected ADD, HOLD or FREE"},
+		{"drop unknown table", "DROP TABLE `Missing`", nil, "table Missing does not exist"},
+		{"drop without table", "DROP `Feature`", nil, "expected TABLE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSQLTestPackage(t)
+
+			_, err := p.ExecuteSQL(tt.sql, tt.params...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
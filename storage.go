@@ -0,0 +1,145 @@
+package msi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/asalih/go-mscfb"
+)
+
+// Iterates the storages of a package, which the _Storages table lists:
+// nested installations run by custom actions of type 7, 23 and 39, and the
+// transforms embedded in patches or in the package itself.
+type Storages struct {
+	Entries *mscfb.Entries
+}
+
+func NewStorages(entries *mscfb.Entries) *Storages {
+	return &Storages{
+		Entries: entries,
+	}
+}
+
+func (s *Storages) Next() string {
+	for {
+		entry := s.Entries.Next()
+		if entry == nil {
+			return ""
+		}
+
+		if entry.ObjType == mscfb.ObjStorage {
+			return entry.Name
+		}
+	}
+}
+
+// Returns the storages at the root of the package, as last flushed.
+func (p *MSIPackage) Storages() *Storages {
+	return NewStorages(p.CompoundFile.Directory.RootStorageEntries())
+}
+
+// Opens a nested installation from one of the package's storages. The
+// storage is copied out of the package, so the returned package is
+// read-only and reflects the package as last flushed.
+func (p *MSIPackage) OpenStorage(name string) (*MSIPackage, error) {
+	id, err := p.storageID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dirEntry := p.CompoundFile.Directory.DirEntries[id]
+	if PackageTypeFromCLSID(dirEntry.CLSID) == PackageTypeTransform {
+		return nil, fmt.Errorf("storage %s is a transform; use OpenStorageTransform", name)
+	}
+
+	writer := newCompoundWriter(dirEntry.CLSID)
+	err = p.copyStorage(writer, dirEntry.Child, []string{name}, []string{}, make(map[uint32]struct{}))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	_, err = writer.WriteTo(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return Open(bytes.NewReader(buf.Bytes()))
+}
+
+// Opens a transform embedded in one of the package's storages.
+func (p *MSIPackage) OpenStorageTransform(name string) (*Transform, error) {
+	_, err := p.storageID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return openTransformStorage(p.CompoundFile, name)
+}
+
+func (p *MSIPackage) storageID(name string) (uint32, error) {
+	dir := p.CompoundFile.Directory
+	id, err := dir.StreamIDForNameChain([]string{name})
+	if err != nil || dir.DirEntries[id].ObjType != mscfb.ObjStorage {
+		return 0, fmt.Errorf("storage %s does not exist", name)
+	}
+
+	return id, nil
+}
+
+// Copies the entries of a storage into the writer, at the same place below
+// destNames as they are below srcNames in the package. Entries already in
+// visited are rejected, as the sibling and child links of a corrupt file
+// can form cycles.
+func (p *MSIPackage) copyStorage(writer *compoundWriter, id uint32, srcNames []string, destNames []string, visited map[uint32]struct{}) error {
+	if id == mscfb.NO_STREAM {
+		return nil
+	}
+
+	if int(id) >= len(p.CompoundFile.Directory.DirEntries) {
+		return fmt.Errorf("invalid directory entry: %d", id)
+	}
+	if _, ok := visited[id]; ok {
+		return fmt.Errorf("directory entry %d is linked more than once", id)
+	}
+	visited[id] = struct{}{}
+
+	dirEntry := p.CompoundFile.Directory.DirEntries[id]
+	err := p.copyStorage(writer, dirEntry.LeftSibling, srcNames, destNames, visited)
+	if err != nil {
+		return err
+	}
+
+	err = p.copyStorage(writer, dirEntry.RightSibling, srcNames, destNames, visited)
+	if err != nil {
+		return err
+	}
+
+	entrySrcNames := append(append([]string{}, srcNames...), dirEntry.Name)
+	entryDestNames := append(append([]string{}, destNames...), dirEntry.Name)
+
+	switch dirEntry.ObjType {
+	case mscfb.ObjStorage:
+		err = writer.AddStorage(mscfb.PathFromNameChain(entryDestNames), dirEntry.CLSID)
+		if err != nil {
+			return err
+		}
+
+		return p.copyStorage(writer, dirEntry.Child, entrySrcNames, entryDestNames, visited)
+	case mscfb.ObjStream:
+		stream, err := p.CompoundFile.OpenStream(mscfb.PathFromNameChain(entrySrcNames))
+		if err != nil {
+			return err
+		}
+
+		data, err := io.ReadAll(stream)
+		if err != nil {
+			return err
+		}
+
+		return writer.AddStream(mscfb.PathFromNameChain(entryDestNames), data)
+	}
+
+	return nil
+}
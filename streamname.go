@@ -8,6 +8,7 @@ const (
 	DIGITAL_SIGNATURE_STREAM_NAME        = "\x05DigitalSignature"
 	MSI_DIGITAL_SIGNATURE_EX_STREAM_NAME = "\x05MsiDigitalSignatureEx"
 	SUMMARY_INFO_STREAM_NAME             = "\x05SummaryInformation"
+	DOC_SUMMARY_INFO_STREAM_NAME         = "\x05DocumentSummaryInformation"
 
 	TABLE_PREFIX = "\xE4\xA1\x80"
 )
@@ -92,7 +93,7 @@ func NameIsValid(name string, isTable bool) bool {
 }
 
 func hasTablePrefix(name string) bool {
-	return name[:len(TABLE_PREFIX)] == TABLE_PREFIX
+	return strings.HasPrefix(name, TABLE_PREFIX)
 }
 
 func toB64(ch rune) (uint32, bool) {
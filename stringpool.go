@@ -1,6 +1,7 @@
 package msi
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -24,6 +25,17 @@ type StringPool struct {
 	Strings        []poolStrings
 	LongStringRefs bool
 	IsModified     bool
+
+	lookup    map[string]int
+	freeSlots []int
+}
+
+func NewStringPool(codePage CodePage) *StringPool {
+	return &StringPool{
+		CodePage:   codePage,
+		Strings:    make([]poolStrings, 0),
+		IsModified: true,
+	}
 }
 
 type StringRef struct {
@@ -34,7 +46,7 @@ func (s *StringRef) Index() int64 {
 	return int64(s.Num - 1)
 }
 
-func (s *StringRef) Read(reader *mscfb.Stream, longStringRefs bool) (StringRef, error) {
+func (s *StringRef) Read(reader io.Reader, longStringRefs bool) (StringRef, error) {
 	var numRef uint16
 	err := binary.Read(reader, binary.LittleEndian, &numRef)
 	if err != nil {
@@ -55,6 +67,19 @@ func (s *StringRef) Read(reader *mscfb.Stream, longStringRefs bool) (StringRef,
 	return StringRef{Num: num}, nil
 }
 
+func (s *StringRef) Write(writer io.Writer, longStringRefs bool) error {
+	err := binary.Write(writer, binary.LittleEndian, uint16(s.Num&0xffff))
+	if err != nil {
+		return err
+	}
+
+	if longStringRefs {
+		return binary.Write(writer, binary.LittleEndian, uint8((s.Num>>16)&0xff))
+	}
+
+	return nil
+}
+
 type stringPoolLRC struct {
 	Length    uint32
 	RefCounts uint16
@@ -79,7 +104,7 @@ func (pool *StringPoolBuilder) ReadFromPool(stream *mscfb.Stream) error {
 	lsr := (codepage & LONG_STRING_REFS_BIT) != 0
 	codepage = (codepage & ^LONG_STRING_REFS_BIT)
 	codePageID := CodePageFromID(int(codepage))
-	if codePageID == -1 {
+	if codePageID == -1 || codePageID == Utf16 {
 		return fmt.Errorf("invalid codepage: %v", codePageID)
 	}
 
@@ -187,3 +212,186 @@ func (s *StringPool) Get(ref StringRef) string {
 
 	return ""
 }
+
+// Adds a reference to the given string, inserting it into the pool if
+// needed, and returns the reference.
+func (s *StringPool) Incref(str string) (StringRef, error) {
+	return s.Insert(str, 1)
+}
+
+// Adds the given number of references to the string and returns its
+// reference. New strings take the first free slot in the pool; once the pool
+// holds more than 0xffff strings it switches to three-byte string refs.
+func (s *StringPool) Insert(str string, refCount uint16) (StringRef, error) {
+	if str == "" {
+		return StringRef{}, fmt.Errorf("empty strings cannot be stored in the string pool")
+	}
+
+	if refCount == 0 {
+		return StringRef{}, fmt.Errorf("invalid reference count: %d", refCount)
+	}
+
+	s.buildLookup()
+
+	if index, ok := s.lookup[str]; ok {
+		if int(s.Strings[index].RefCount)+int(refCount) > 0xffff {
+			return StringRef{}, fmt.Errorf("too many references to string: %s", str)
+		}
+
+		s.Strings[index].RefCount += refCount
+		s.IsModified = true
+		return StringRef{Num: int32(index + 1)}, nil
+	}
+
+	_, err := s.CodePage.Encode(str)
+	if err != nil {
+		return StringRef{}, fmt.Errorf("string %q cannot be encoded with code page %d: %w", str, s.CodePage.ID(), err)
+	}
+
+	var index int
+	if n := len(s.freeSlots); n > 0 {
+		index = s.freeSlots[n-1]
+		s.freeSlots = s.freeSlots[:n-1]
+		s.Strings[index] = poolStrings{Value: str, RefCount: refCount}
+	} else {
+		if len(s.Strings) >= int(MAX_STRING_REF) {
+			return StringRef{}, fmt.Errorf("too many strings in pool")
+		}
+
+		s.Strings = append(s.Strings, poolStrings{Value: str, RefCount: refCount})
+		index = len(s.Strings) - 1
+		if len(s.Strings) > 0xffff {
+			s.LongStringRefs = true
+		}
+	}
+
+	s.lookup[str] = index
+	s.IsModified = true
+
+	return StringRef{Num: int32(index + 1)}, nil
+}
+
+// Removes a reference to the given string. A string without references is
+// removed from the pool, and its slot is reused by the next new string.
+func (s *StringPool) Decref(ref StringRef) error {
+	index := ref.Index()
+	if index < 0 || index >= int64(len(s.Strings)) {
+		return fmt.Errorf("invalid string reference: %d", ref.Num)
+	}
+
+	if s.Strings[index].RefCount == 0 {
+		return fmt.Errorf("string reference %d has no references", ref.Num)
+	}
+
+	s.buildLookup()
+
+	s.Strings[index].RefCount--
+	if s.Strings[index].RefCount == 0 {
+		if s.lookup[s.Strings[index].Value] == int(index) {
+			delete(s.lookup, s.Strings[index].Value)
+		}
+
+		s.Strings[index].Value = ""
+		s.freeSlots = append(s.freeSlots, int(index))
+	}
+	s.IsModified = true
+
+	return nil
+}
+
+// Changes the code page used to encode the pool's strings. Every string in
+// the pool must be representable in the new code page.
+func (s *StringPool) SetCodePage(codePage CodePage) error {
+	if codePage == Utf16 {
+		return fmt.Errorf("string pools cannot use code page %d", codePage.ID())
+	}
+
+	for _, str := range s.Strings {
+		if str.RefCount == 0 {
+			continue
+		}
+
+		_, err := codePage.Encode(str.Value)
+		if err != nil {
+			return fmt.Errorf("string %q cannot be encoded with code page %d: %w", str.Value, codePage.ID(), err)
+		}
+	}
+
+	s.CodePage = codePage
+	s.IsModified = true
+
+	return nil
+}
+
+// Returns the number of slots in the pool, including free ones.
+func (s *StringPool) Len() int {
+	return len(s.Strings)
+}
+
+// Indexes the pool's strings and free slots on first use. Free slots are
+// stacked so that the lowest one is reused first.
+func (s *StringPool) buildLookup() {
+	if s.lookup != nil {
+		return
+	}
+
+	s.lookup = make(map[string]int, len(s.Strings))
+	s.freeSlots = make([]int, 0)
+	for i := len(s.Strings) - 1; i >= 0; i-- {
+		if s.Strings[i].RefCount == 0 {
+			s.freeSlots = append(s.freeSlots, i)
+			continue
+		}
+
+		s.lookup[s.Strings[i].Value] = i
+	}
+}
+
+// Writes the _StringPool stream: the code page followed by the length and
+// reference count of every string.
+func (s *StringPool) WritePool(w io.Writer) error {
+	codePage := uint32(s.CodePage.ID())
+	if s.LongStringRefs {
+		codePage |= LONG_STRING_REFS_BIT
+	}
+
+	buf := new(bytes.Buffer)
+	writeLE(buf, codePage)
+	for _, str := range s.Strings {
+		length := 0
+		if str.RefCount > 0 {
+			encoded, err := s.CodePage.Encode(str.Value)
+			if err != nil {
+				return err
+			}
+			length = len(encoded)
+		}
+
+		if length > 0xffff {
+			writeLE(buf, uint16(0), uint16(length>>16))
+		}
+		writeLE(buf, uint16(length), str.RefCount)
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Writes the _StringData stream: the encoded bytes of every string.
+func (s *StringPool) WriteData(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	for _, str := range s.Strings {
+		if str.RefCount == 0 {
+			continue
+		}
+
+		encoded, err := s.CodePage.Encode(str.Value)
+		if err != nil {
+			return err
+		}
+		buf.Write(encoded)
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,122 @@
+package msi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newStringPoolTestPackage(t *testing.T) (*MSIPackage, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.msi")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+
+	p, err := Create(file, PackageTypeInstaller)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.CreateTable("Strings", []*Column{
+		NewColumnBuilder("Key").SetPrimaryKey().IDString(72),
+		NewColumnBuilder("Value").SetNullable().TextString(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p, path
+}
+
+func stringIndex(p *MSIPackage, str string) int {
+	for i, s := range p.StringPool.Strings {
+		if s.RefCount > 0 && s.Value == str {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func TestStringPoolLongStringRefs(t *testing.T) {
+	p, path := newStringPoolTestPackage(t)
+
+	// Together with the table and column names, this is more strings than
+	// two-byte refs can address.
+	rows := make([][]Value, 0x10000)
+	for i := range rows {
+		rows[i] = []Value{fmt.Sprintf("Key%05d", i), nil}
+	}
+	rows[0][1] = "first"
+	rows[len(rows)-1][1] = "last"
+	err := p.InsertRows("Strings", rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.StringPool.LongStringRefs {
+		t.Fatalf("pool with %d strings does not use long string refs", p.StringPool.Len())
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestPackage(t, path)
+	if !reopened.StringPool.LongStringRefs {
+		t.Errorf("reopened pool with %d strings does not use long string refs", reopened.StringPool.Len())
+	}
+	if got := tableRows(t, reopened, "Strings"); !reflect.DeepEqual(got, rows) {
+		t.Errorf("got %d rows that differ from the %d inserted", len(got), len(rows))
+	}
+	if got, want := tableRows(t, reopened, COLUMNS_TABLE_NAME), tableRows(t, p, COLUMNS_TABLE_NAME); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s rows %v, want %v", COLUMNS_TABLE_NAME, got, want)
+	}
+}
+
+func TestStringPoolReusesFreedSlots(t *testing.T) {
+	p, path := newStringPoolTestPackage(t)
+
+	err := p.InsertRows("Strings", [][]Value{
+		{"a", "first"},
+		{"b", "second"},
+		{"c", "third"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	freed := map[int]bool{stringIndex(p, "b"): true, stringIndex(p, "second"): true}
+	_, err = p.DeleteRows("Strings", func(row *Row) bool { return row.GetString("Key") == "b" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index := stringIndex(p, "second"); index != -1 {
+		t.Fatalf("string %q of the deleted row is still in slot %d", "second", index)
+	}
+
+	// The two new strings take the slots of the two deleted ones.
+	size := p.StringPool.Len()
+	err = p.InsertRows("Strings", [][]Value{{"d", "replacement"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reused := map[int]bool{stringIndex(p, "d"): true, stringIndex(p, "replacement"): true}
+	if !reflect.DeepEqual(reused, freed) {
+		t.Errorf("new strings went to slots %v, want freed slots %v", reused, freed)
+	}
+	if p.StringPool.Len() != size {
+		t.Errorf("pool grew from %d to %d slots", size, p.StringPool.Len())
+	}
+
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]Value{{"a", "first"}, {"c", "third"}, {"d", "replacement"}}
+	if got := tableRows(t, openTestPackage(t, path), "Strings"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got rows %v, want %v", got, want)
+	}
+}
@@ -3,16 +3,63 @@ package msi
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/asalih/go-mscfb"
+	"github.com/google/uuid"
 )
 
 type SummaryInfo struct {
 	Properties *PropertySet
+	IsModified bool
 }
 
 const defaultOsVersion = 10
 
+const (
+	PROPERTY_TITLE                uint32 = 2
+	PROPERTY_SUBJECT              uint32 = 3
+	PROPERTY_AUTHOR               uint32 = 4
+	PROPERTY_KEYWORDS             uint32 = 5
+	PROPERTY_COMMENTS             uint32 = 6
+	PROPERTY_TEMPLATE             uint32 = 7
+	PROPERTY_LAST_SAVED_BY        uint32 = 8
+	PROPERTY_REVISION_NUMBER      uint32 = 9
+	PROPERTY_LAST_PRINTED         uint32 = 11
+	PROPERTY_CREATION_TIME        uint32 = 12
+	PROPERTY_LAST_SAVE_TIME       uint32 = 13
+	PROPERTY_PAGE_COUNT           uint32 = 14
+	PROPERTY_WORD_COUNT           uint32 = 15
+	PROPERTY_CHARACTER_COUNT      uint32 = 16
+	PROPERTY_CREATING_APPLICATION uint32 = 18
+	PROPERTY_SECURITY             uint32 = 19
+)
+
+// Flags stored in the Word Count property, describing the source image.
+type SourceFlags int32
+
+const (
+	// Files use short filenames.
+	SourceFlagShortNames SourceFlags = 0x1
+	// Files are compressed in cabinets.
+	SourceFlagCompressed SourceFlags = 0x2
+	// The source is an administrative image.
+	SourceFlagAdminImage SourceFlags = 0x4
+	// Elevated privileges are not required to install.
+	SourceFlagNoElevation SourceFlags = 0x8
+)
+
+// The value of the Security property.
+type Security int32
+
+const (
+	SecurityNone                Security = 0
+	SecurityReadOnlyRecommended Security = 2
+	SecurityReadOnlyEnforced    Security = 4
+)
+
 var fmtIdSummaryInfo = []byte("\xe0\x85\x9f\xf2\xf9\x4f\x68\x10\xab\x91\x08\x00\x2b\x27\xb3\xd9")
 
 func NewSummary() *SummaryInfo {
@@ -24,7 +71,7 @@ func NewSummary() *SummaryInfo {
 	}
 }
 
-func (s *SummaryInfo) ReadSummaryInfo(reader *mscfb.Stream) (*SummaryInfo, error) {
+func (s *SummaryInfo) ReadSummaryInfo(reader io.ReadSeeker) (*SummaryInfo, error) {
 	propertySet, err := ReadPropertySet(reader)
 	if err != nil {
 		return nil, err
@@ -38,3 +85,372 @@ func (s *SummaryInfo) ReadSummaryInfo(reader *mscfb.Stream) (*SummaryInfo, error
 
 	return s, nil
 }
+
+func (s *SummaryInfo) WriteSummaryInfo(writer io.Writer) error {
+	return WritePropertySet(writer, s.Properties)
+}
+
+// Returns the code page used to encode the summary information strings.
+func (s *SummaryInfo) CodePage() CodePage {
+	return s.Properties.CodePage
+}
+
+func (s *SummaryInfo) SetCodePage(codePage CodePage) {
+	s.Properties.CodePage = codePage
+	s.IsModified = true
+}
+
+// Returns the title of the package (e.g. "Installation Database").
+func (s *SummaryInfo) Title() string {
+	return s.stringProperty(PROPERTY_TITLE)
+}
+
+func (s *SummaryInfo) SetTitle(title string) {
+	s.SetProperty(PROPERTY_TITLE, PropertyValueFromLpStr(title))
+}
+
+// Returns the subject of the package, usually the product name.
+func (s *SummaryInfo) Subject() string {
+	return s.stringProperty(PROPERTY_SUBJECT)
+}
+
+func (s *SummaryInfo) SetSubject(subject string) {
+	s.SetProperty(PROPERTY_SUBJECT, PropertyValueFromLpStr(subject))
+}
+
+// Returns the author of the package, usually the manufacturer.
+func (s *SummaryInfo) Author() string {
+	return s.stringProperty(PROPERTY_AUTHOR)
+}
+
+func (s *SummaryInfo) SetAuthor(author string) {
+	s.SetProperty(PROPERTY_AUTHOR, PropertyValueFromLpStr(author))
+}
+
+func (s *SummaryInfo) Keywords() string {
+	return s.stringProperty(PROPERTY_KEYWORDS)
+}
+
+func (s *SummaryInfo) SetKeywords(keywords string) {
+	s.SetProperty(PROPERTY_KEYWORDS, PropertyValueFromLpStr(keywords))
+}
+
+func (s *SummaryInfo) Comments() string {
+	return s.stringProperty(PROPERTY_COMMENTS)
+}
+
+func (s *SummaryInfo) SetComments(comments string) {
+	s.SetProperty(PROPERTY_COMMENTS, PropertyValueFromLpStr(comments))
+}
+
+// Returns the raw Template property, which lists the supported platform
+// and languages (e.g. "x64;1033").
+func (s *SummaryInfo) Template() string {
+	return s.stringProperty(PROPERTY_TEMPLATE)
+}
+
+func (s *SummaryInfo) SetTemplate(template string) {
+	s.SetProperty(PROPERTY_TEMPLATE, PropertyValueFromLpStr(template))
+}
+
+// Returns the platform part of the Template property.
+func (s *SummaryInfo) Platform() string {
+	platform, _, _ := splitTemplate(s.Template())
+	return platform
+}
+
+// Returns the architecture named in the Template property, or -1 if the
+// platform is not recognized. A missing platform means Intel.
+func (s *SummaryInfo) Architecture() Architecture {
+	return ArchitectureFromString(s.Platform())
+}
+
+// Replaces the platform in the Template property, keeping the languages.
+func (s *SummaryInfo) SetArchitecture(architecture Architecture) error {
+	if architecture < ArchitectureIntel || architecture > ArchitectureArm {
+		return fmt.Errorf("invalid architecture: %d", architecture)
+	}
+
+	_, languages, _ := splitTemplate(s.Template())
+	s.SetTemplate(architecture.String() + ";" + languages)
+
+	return nil
+}
+
+// Returns the languages listed in the Template property.
+func (s *SummaryInfo) Languages() ([]Language, error) {
+	_, languages, ok := splitTemplate(s.Template())
+	if !ok {
+		return nil, fmt.Errorf("template %q has no language list", s.Template())
+	}
+
+	return parseLanguages(languages)
+}
+
+// Replaces the languages in the Template property, keeping the platform.
+func (s *SummaryInfo) SetLanguages(languages []Language) error {
+	if len(languages) == 0 {
+		return fmt.Errorf("at least one language is required")
+	}
+
+	platform, _, _ := splitTemplate(s.Template())
+	s.SetTemplate(platform + ";" + formatLanguages(languages))
+
+	return nil
+}
+
+// Checks that the Template property names a known platform followed by a
+// list of distinct LCIDs.
+func (s *SummaryInfo) ValidateTemplate() error {
+	_, _, err := ParseTemplate(s.Template())
+	return err
+}
+
+// Parses a Template property value such as "x64;1033,1031" into its
+// architecture and languages.
+func ParseTemplate(template string) (Architecture, []Language, error) {
+	platform, languageList, ok := splitTemplate(template)
+	if !ok {
+		return -1, nil, fmt.Errorf("template %q has no language list", template)
+	}
+
+	architecture := ArchitectureFromString(platform)
+	if architecture == -1 {
+		return -1, nil, fmt.Errorf("template %q has unknown platform %q", template, platform)
+	}
+
+	languages, err := parseLanguages(languageList)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	if len(languages) == 0 {
+		return -1, nil, fmt.Errorf("template %q has no languages", template)
+	}
+
+	seen := make(map[Language]struct{})
+	for _, language := range languages {
+		if _, ok := seen[language]; ok {
+			return -1, nil, fmt.Errorf("template %q lists language %d more than once", template, language)
+		}
+		seen[language] = struct{}{}
+	}
+
+	return architecture, languages, nil
+}
+
+func (s *SummaryInfo) LastSavedBy() string {
+	return s.stringProperty(PROPERTY_LAST_SAVED_BY)
+}
+
+func (s *SummaryInfo) SetLastSavedBy(lastSavedBy string) {
+	s.SetProperty(PROPERTY_LAST_SAVED_BY, PropertyValueFromLpStr(lastSavedBy))
+}
+
+// Returns the raw Revision Number property. For installers this is the
+// package code; patches and transforms store a list of product codes.
+func (s *SummaryInfo) RevisionNumber() string {
+	return s.stringProperty(PROPERTY_REVISION_NUMBER)
+}
+
+func (s *SummaryInfo) SetRevisionNumber(revisionNumber string) {
+	s.SetProperty(PROPERTY_REVISION_NUMBER, PropertyValueFromLpStr(revisionNumber))
+}
+
+// Parses the package code stored in the Revision Number property.
+func (s *SummaryInfo) PackageCode() (uuid.UUID, error) {
+	revisionNumber := s.RevisionNumber()
+	if len(revisionNumber) < 38 {
+		return uuid.Nil, fmt.Errorf("invalid package code: %q", revisionNumber)
+	}
+
+	return uuid.Parse(revisionNumber[:38])
+}
+
+// Stores the package code as an uppercase, braced GUID.
+func (s *SummaryInfo) SetPackageCode(packageCode uuid.UUID) {
+	s.SetRevisionNumber(formatGUID(packageCode))
+}
+
+// Returns the name of the application that created the package.
+func (s *SummaryInfo) CreatingApplication() string {
+	return s.stringProperty(PROPERTY_CREATING_APPLICATION)
+}
+
+func (s *SummaryInfo) SetCreatingApplication(creatingApplication string) {
+	s.SetProperty(PROPERTY_CREATING_APPLICATION, PropertyValueFromLpStr(creatingApplication))
+}
+
+// Returns the time the package was created, or the zero time if unset.
+func (s *SummaryInfo) CreationTime() time.Time {
+	return s.timeProperty(PROPERTY_CREATION_TIME)
+}
+
+func (s *SummaryInfo) SetCreationTime(t time.Time) {
+	s.SetProperty(PROPERTY_CREATION_TIME, PropertyValueFromFileTime(FileTimeFromTime(t)))
+}
+
+// Returns the time the package was last saved, or the zero time if unset.
+func (s *SummaryInfo) LastSaveTime() time.Time {
+	return s.timeProperty(PROPERTY_LAST_SAVE_TIME)
+}
+
+func (s *SummaryInfo) SetLastSaveTime(t time.Time) {
+	s.SetProperty(PROPERTY_LAST_SAVE_TIME, PropertyValueFromFileTime(FileTimeFromTime(t)))
+}
+
+// Returns the time the package was last printed, or the zero time if
+// unset. Installers store the creation time of an administrative image
+// here.
+func (s *SummaryInfo) LastPrinted() time.Time {
+	return s.timeProperty(PROPERTY_LAST_PRINTED)
+}
+
+func (s *SummaryInfo) SetLastPrinted(t time.Time) {
+	s.SetProperty(PROPERTY_LAST_PRINTED, PropertyValueFromFileTime(FileTimeFromTime(t)))
+}
+
+// Returns the Page Count property, which holds the minimum installer
+// version (schema) required by the package, e.g. 500 for version 5.0.
+func (s *SummaryInfo) PageCount() int32 {
+	value, _ := s.intProperty(PROPERTY_PAGE_COUNT)
+	return value
+}
+
+func (s *SummaryInfo) SetPageCount(pageCount int32) {
+	s.SetProperty(PROPERTY_PAGE_COUNT, PropertyValueFromI4(pageCount))
+}
+
+// Returns the source image flags stored in the Word Count property.
+func (s *SummaryInfo) WordCount() SourceFlags {
+	value, _ := s.intProperty(PROPERTY_WORD_COUNT)
+	return SourceFlags(value)
+}
+
+func (s *SummaryInfo) SetWordCount(flags SourceFlags) {
+	s.SetProperty(PROPERTY_WORD_COUNT, PropertyValueFromI4(int32(flags)))
+}
+
+// Returns the Character Count property. Transforms store their validation
+// and error condition flags here.
+func (s *SummaryInfo) CharacterCount() int32 {
+	value, _ := s.intProperty(PROPERTY_CHARACTER_COUNT)
+	return value
+}
+
+func (s *SummaryInfo) SetCharacterCount(characterCount int32) {
+	s.SetProperty(PROPERTY_CHARACTER_COUNT, PropertyValueFromI4(characterCount))
+}
+
+func (s *SummaryInfo) Security() Security {
+	value, _ := s.intProperty(PROPERTY_SECURITY)
+	return Security(value)
+}
+
+func (s *SummaryInfo) SetSecurity(security Security) {
+	s.SetProperty(PROPERTY_SECURITY, PropertyValueFromI4(int32(security)))
+}
+
+// Returns the raw value of the given property, or nil if it is unset.
+func (s *SummaryInfo) Property(name uint32) *PropertyValue {
+	return s.Properties.Properties[name]
+}
+
+func (s *SummaryInfo) SetProperty(name uint32, value *PropertyValue) {
+	s.Properties.Properties[name] = value
+	s.IsModified = true
+}
+
+func (s *SummaryInfo) RemoveProperty(name uint32) {
+	if _, ok := s.Properties.Properties[name]; ok {
+		delete(s.Properties.Properties, name)
+		s.IsModified = true
+	}
+}
+
+func (s *SummaryInfo) stringProperty(name uint32) string {
+	value := s.Property(name)
+	if value == nil {
+		return ""
+	}
+
+	switch value.vt {
+	case VT_LPSTR:
+		return value.LpStr
+	case VT_LPWSTR:
+		return value.LpWStr
+	}
+
+	return ""
+}
+
+func (s *SummaryInfo) intProperty(name uint32) (int32, bool) {
+	value := s.Property(name)
+	if value == nil {
+		return 0, false
+	}
+
+	switch value.vt {
+	case VT_I1:
+		return int32(value.I1), true
+	case VT_I2:
+		return int32(value.I2), true
+	case VT_I4:
+		return value.I4, true
+	case VT_UI4:
+		return int32(value.UI4), true
+	}
+
+	return 0, false
+}
+
+func (s *SummaryInfo) timeProperty(name uint32) time.Time {
+	value := s.Property(name)
+	if value == nil || value.vt != VT_FILETIME || value.FileTime == 0 {
+		return time.Time{}
+	}
+
+	return TimeFromFileTime(value.FileTime)
+}
+
+// Splits a Template property into its platform and language parts. The
+// second return value is false if there is no separator.
+func splitTemplate(template string) (string, string, bool) {
+	idx := strings.Index(template, ";")
+	if idx == -1 {
+		return template, "", false
+	}
+
+	return template[:idx], template[idx+1:], true
+}
+
+func parseLanguages(list string) ([]Language, error) {
+	languages := make([]Language, 0)
+	if strings.TrimSpace(list) == "" {
+		return languages, nil
+	}
+
+	for _, part := range strings.Split(list, ",") {
+		lcid, err := strconv.ParseUint(strings.TrimSpace(part), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid language id %q", part)
+		}
+		languages = append(languages, Language(lcid))
+	}
+
+	return languages, nil
+}
+
+func formatLanguages(languages []Language) string {
+	parts := make([]string, len(languages))
+	for i, language := range languages {
+		parts[i] = strconv.Itoa(int(language))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// Formats a GUID the way MSI stores them: uppercase and in braces.
+func formatGUID(guid uuid.UUID) string {
+	return "{" + strings.ToUpper(guid.String()) + "}"
+}
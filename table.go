@@ -1,9 +1,8 @@
 package msi
 
 import (
+	"bytes"
 	"io"
-
-	"github.com/asalih/go-mscfb"
 )
 
 type Table struct {
@@ -20,11 +19,45 @@ func NewTable(name string, columns []*Column, longStringRefs bool) *Table {
 	}
 }
 
+// Returns true if the given string is a valid table name: an identifier
+// short enough to be used as a stream name.
+func IsValidTableName(name string) bool {
+	return isIdentifier(name) && NameIsValid(name, true)
+}
+
 func (t *Table) StreamName() string {
 	return NameEncode(t.Name, true)
 }
 
-func (t *Table) ReadRows(stream *mscfb.Stream) ([][]*ValueRef, error) {
+// Returns the index of the column with the given name, or -1 if the table
+// has no such column.
+func (t *Table) ColumnIndex(name string) int {
+	for i, column := range t.Columns {
+		if column.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Returns true if the table has a column with the given name.
+func (t *Table) HasColumn(name string) bool {
+	return t.ColumnIndex(name) != -1
+}
+
+// Returns the column with the given name, or nil if the table has no such
+// column.
+func (t *Table) Column(name string) *Column {
+	idx := t.ColumnIndex(name)
+	if idx == -1 {
+		return nil
+	}
+
+	return t.Columns[idx]
+}
+
+func (t *Table) ReadRows(stream io.ReadSeeker) ([][]*ValueRef, error) {
 	dataLength, err := stream.Seek(0, io.SeekEnd)
 	if err != nil {
 		return nil, err
@@ -66,3 +99,53 @@ func (t *Table) ReadRows(stream *mscfb.Stream) ([][]*ValueRef, error) {
 
 	return rows, nil
 }
+
+// Returns the indices of the table's primary key columns.
+func (t *Table) PrimaryKeyIndices() []int {
+	indices := make([]int, 0)
+	for i, column := range t.Columns {
+		if column.IsPrimarykey {
+			indices = append(indices, i)
+		}
+	}
+
+	return indices
+}
+
+// Writes the rows column by column, the layout used by table streams.
+func (t *Table) WriteRows(w io.Writer, rows [][]*ValueRef) error {
+	buf := new(bytes.Buffer)
+	for i, column := range t.Columns {
+		for _, row := range rows {
+			err := column.ColumnType.WriteValue(buf, row[i], t.LongStringRefs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Returns true if the string consists only of ASCII letters, digits,
+// underscores and periods, and starts with a letter or underscore.
+func isIdentifier(str string) bool {
+	if str == "" {
+		return false
+	}
+
+	for i, ch := range str {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch == '_':
+		case (ch >= '0' && ch <= '9') || ch == '.':
+			if i == 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,533 @@
+package msi
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Creates a new table with the given columns and registers it in the
+// _Tables, _Columns and, if the package has one, _Validation tables.
+func (p *MSIPackage) CreateTable(tableName string, columns []*Column) error {
+	if !IsValidTableName(tableName) {
+		return fmt.Errorf("invalid table name: %s", tableName)
+	}
+
+	if p.HasTable(tableName) {
+		return fmt.Errorf("table %s already exists", tableName)
+	}
+
+	if len(columns) == 0 {
+		return fmt.Errorf("table %s has no columns", tableName)
+	}
+
+	if uint32(len(columns)) > MAX_NUM_TABLE_COLUMNS {
+		return fmt.Errorf("table %s has %d columns, but the maximum is %d", tableName, len(columns), MAX_NUM_TABLE_COLUMNS)
+	}
+
+	hasPrimaryKey := false
+	columnNames := make(map[string]struct{})
+	for _, column := range columns {
+		if !isIdentifier(column.Name) {
+			return fmt.Errorf("invalid column name: %s", column.Name)
+		}
+
+		if _, ok := columnNames[column.Name]; ok {
+			return fmt.Errorf("table %s has duplicate column %s", tableName, column.Name)
+		}
+		columnNames[column.Name] = struct{}{}
+
+		if column.IsPrimarykey {
+			hasPrimaryKey = true
+		}
+	}
+
+	if !hasPrimaryKey {
+		return fmt.Errorf("table %s has no primary key columns", tableName)
+	}
+
+	columnRows := make([][]Value, len(columns))
+	for i, column := range columns {
+		columnRows[i] = []Value{tableName, i + 1, column.Name, int(column.BitField())}
+	}
+	tableRows := [][]Value{{tableName}}
+	validationRows := makeValidationRows(tableName, columns)
+
+	// Check every row up front so that a failure leaves the package
+	// untouched.
+	err := p.checkInsertRows(COLUMNS_TABLE_NAME, columnRows)
+	if err != nil {
+		return err
+	}
+	err = p.checkInsertRows(TABLES_TABLE_NAME, tableRows)
+	if err != nil {
+		return err
+	}
+	if p.HasTable(VALIDATION_TABLE_NAME) {
+		err = p.checkInsertRows(VALIDATION_TABLE_NAME, validationRows)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = p.InsertRows(COLUMNS_TABLE_NAME, columnRows)
+	if err != nil {
+		return err
+	}
+
+	err = p.InsertRows(TABLES_TABLE_NAME, tableRows)
+	if err != nil {
+		return err
+	}
+
+	p.Tables[tableName] = NewTable(tableName, columns, p.StringPool.LongStringRefs)
+
+	if p.HasTable(VALIDATION_TABLE_NAME) {
+		return p.InsertRows(VALIDATION_TABLE_NAME, validationRows)
+	}
+
+	return nil
+}
+
+// Removes the table with the given name, along with its rows and its
+// entries in the _Tables, _Columns and _Validation tables.
+func (p *MSIPackage) DropTable(tableName string) error {
+	if tableName == TABLES_TABLE_NAME || tableName == COLUMNS_TABLE_NAME {
+		return fmt.Errorf("cannot drop special table %s", tableName)
+	}
+
+	table := p.Table(tableName)
+	if table == nil {
+		return fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	_, err := p.DeleteRows(tableName, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.DeleteRows(COLUMNS_TABLE_NAME, func(row *Row) bool {
+		return row.GetString("Table") == tableName
+	})
+	if err != nil {
+		return err
+	}
+
+	if tableName != VALIDATION_TABLE_NAME && p.HasTable(VALIDATION_TABLE_NAME) {
+		_, err = p.DeleteRows(VALIDATION_TABLE_NAME, func(row *Row) bool {
+			return row.GetString("Table") == tableName
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = p.DeleteRows(TABLES_TABLE_NAME, func(row *Row) bool {
+		return row.GetString("Name") == tableName
+	})
+	if err != nil {
+		return err
+	}
+
+	p.removeStream(table.StreamName())
+	delete(p.Tables, tableName)
+
+	return nil
+}
+
+// Adds a column to the end of an existing table and registers it in the
+// _Columns and, if the package has one, _Validation tables. Existing rows
+// get a null value, so the column must be nullable unless the table is
+// empty.
+func (p *MSIPackage) AddColumn(tableName string, column *Column) error {
+	if tableName == TABLES_TABLE_NAME || tableName == COLUMNS_TABLE_NAME {
+		return fmt.Errorf("cannot add columns to special table %s", tableName)
+	}
+
+	table := p.Table(tableName)
+	if table == nil {
+		return fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	if !isIdentifier(column.Name) {
+		return fmt.Errorf("invalid column name: %s", column.Name)
+	}
+
+	if table.HasColumn(column.Name) {
+		return fmt.Errorf("table %s already has a column %s", tableName, column.Name)
+	}
+
+	if uint32(len(table.Columns)+1) > MAX_NUM_TABLE_COLUMNS {
+		return fmt.Errorf("table %s already has the maximum of %d columns", tableName, MAX_NUM_TABLE_COLUMNS)
+	}
+
+	if column.IsPrimarykey {
+		return fmt.Errorf("cannot add primary key column %s to existing table %s", column.Name, tableName)
+	}
+
+	rows, err := p.readTableRows(table)
+	if err != nil {
+		return err
+	}
+
+	if len(rows) > 0 && !column.IsNullable {
+		return fmt.Errorf("column %s must be nullable, since table %s has rows", column.Name, tableName)
+	}
+
+	columnRows := [][]Value{{tableName, len(table.Columns) + 1, column.Name, int(column.BitField())}}
+	validationRows := makeValidationRows(tableName, []*Column{column})
+
+	err = p.checkInsertRows(COLUMNS_TABLE_NAME, columnRows)
+	if err != nil {
+		return err
+	}
+	if p.HasTable(VALIDATION_TABLE_NAME) {
+		err = p.checkInsertRows(VALIDATION_TABLE_NAME, validationRows)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = p.InsertRows(COLUMNS_TABLE_NAME, columnRows)
+	if err != nil {
+		return err
+	}
+
+	table.Columns = append(append(make([]*Column, 0, len(table.Columns)+1), table.Columns...), column)
+	for i := range rows {
+		rows[i] = append(rows[i], &ValueRef{IsNull: true})
+	}
+	err = p.writeTableRows(table, rows)
+	if err != nil {
+		return err
+	}
+
+	if p.HasTable(VALIDATION_TABLE_NAME) {
+		return p.InsertRows(VALIDATION_TABLE_NAME, validationRows)
+	}
+
+	return nil
+}
+
+// Inserts the given rows into the table. Each row must hold a valid value
+// for every column, and must not duplicate the primary key of another row.
+func (p *MSIPackage) InsertRows(tableName string, rows [][]Value) error {
+	err := p.checkInsertRows(tableName, rows)
+	if err != nil {
+		return err
+	}
+
+	table := p.Table(tableName)
+	existing, err := p.readTableRows(table)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		refs := make([]*ValueRef, len(row))
+		for i, value := range row {
+			refs[i], err = NewValueRef(normalizeValue(value), p.StringPool)
+			if err != nil {
+				return err
+			}
+		}
+		existing = append(existing, refs)
+	}
+
+	return p.writeTableRows(table, existing)
+}
+
+// Sets the given column values on every row matching the predicate, or on
+// every row if the predicate is nil, and returns the number of rows updated.
+func (p *MSIPackage) UpdateRows(tableName string, values map[string]Value, where func(*Row) bool) (int, error) {
+	table := p.Table(tableName)
+	if table == nil {
+		return 0, fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	updates := make(map[int]Value)
+	updatesKey := false
+	for columnName, value := range values {
+		idx := table.ColumnIndex(columnName)
+		if idx == -1 {
+			return 0, fmt.Errorf("table %s has no column %s", tableName, columnName)
+		}
+
+		value = normalizeValue(value)
+		if str, ok := value.(string); ok && str == "" {
+			value = nil
+		}
+
+		if !table.Columns[idx].IsValidValue(value) {
+			return 0, fmt.Errorf("%v is not a valid value for column %s.%s", value, tableName, columnName)
+		}
+
+		updates[idx] = value
+		if table.Columns[idx].IsPrimarykey {
+			updatesKey = true
+		}
+	}
+
+	rows, err := p.readTableRows(table)
+	if err != nil {
+		return 0, err
+	}
+
+	matched := make([]int, 0)
+	updated := make([][]Value, 0)
+	keys := make(map[string]struct{})
+	for i, refs := range rows {
+		row := p.resolveRow(table, refs)
+		if where == nil || where(row) {
+			matched = append(matched, i)
+			for idx, value := range updates {
+				row.Values[idx] = value
+			}
+			updated = append(updated, row.Values)
+		}
+
+		if updatesKey {
+			key := rowKey(table, row.Values)
+			if _, ok := keys[key]; ok {
+				return 0, fmt.Errorf("update would create duplicate primary key in table %s", tableName)
+			}
+			keys[key] = struct{}{}
+		}
+	}
+
+	if len(matched) == 0 {
+		return 0, nil
+	}
+
+	if p.StrictForeignKeys {
+		err = p.checkForeignKeyValues(table, updated)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, i := range matched {
+		for idx, value := range updates {
+			err = rows[i][idx].Remove(p.StringPool)
+			if err != nil {
+				return 0, err
+			}
+
+			rows[i][idx], err = NewValueRef(value, p.StringPool)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(matched), p.writeTableRows(table, rows)
+}
+
+// Deletes every row matching the predicate, or every row if the predicate
+// is nil, and returns the number of rows deleted.
+func (p *MSIPackage) DeleteRows(tableName string, where func(*Row) bool) (int, error) {
+	table := p.Table(tableName)
+	if table == nil {
+		return 0, fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	rows, err := p.readTableRows(table)
+	if err != nil {
+		return 0, err
+	}
+
+	kept := make([][]*ValueRef, 0, len(rows))
+	deleted := 0
+	for _, refs := range rows {
+		if where != nil && !where(p.resolveRow(table, refs)) {
+			kept = append(kept, refs)
+			continue
+		}
+
+		for _, ref := range refs {
+			err = ref.Remove(p.StringPool)
+			if err != nil {
+				return 0, err
+			}
+		}
+		deleted++
+	}
+
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	return deleted, p.writeTableRows(table, kept)
+}
+
+// Checks that the rows can be inserted into the table without modifying
+// the package.
+func (p *MSIPackage) checkInsertRows(tableName string, rows [][]Value) error {
+	table := p.Table(tableName)
+	if table == nil {
+		return fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	existing, err := p.readTableRows(table)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]struct{})
+	for _, refs := range existing {
+		keys[rowKey(table, p.resolveRow(table, refs).Values)] = struct{}{}
+	}
+
+	checked := make([][]Value, 0, len(rows))
+	for _, row := range rows {
+		if len(row) != len(table.Columns) {
+			return fmt.Errorf("table %s has %d columns, but row has %d values", tableName, len(table.Columns), len(row))
+		}
+
+		normalized := make([]Value, len(row))
+		for i, value := range row {
+			value = normalizeValue(value)
+			if str, ok := value.(string); ok && str == "" {
+				value = nil
+			}
+
+			column := table.Columns[i]
+			if !column.IsValidValue(value) {
+				return fmt.Errorf("%v is not a valid value for column %s.%s", value, tableName, column.Name)
+			}
+			normalized[i] = value
+		}
+
+		key := rowKey(table, normalized)
+		if _, ok := keys[key]; ok {
+			return fmt.Errorf("row with primary key %s already exists in table %s", key, tableName)
+		}
+		keys[key] = struct{}{}
+		checked = append(checked, normalized)
+	}
+
+	if p.StrictForeignKeys {
+		return p.checkForeignKeyValues(table, checked)
+	}
+
+	return nil
+}
+
+// Sorts the rows by primary key and stages the table stream for the next
+// Flush.
+func (p *MSIPackage) writeTableRows(table *Table, rows [][]*ValueRef) error {
+	err := p.syncLongStringRefs(table)
+	if err != nil {
+		return err
+	}
+
+	keyIndices := table.PrimaryKeyIndices()
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, idx := range keyIndices {
+			if cmp := rows[i][idx].Compare(rows[j][idx]); cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+
+	buf := new(bytes.Buffer)
+	err = table.WriteRows(buf, rows)
+	if err != nil {
+		return err
+	}
+
+	p.writeStream(table.StreamName(), buf.Bytes())
+
+	return nil
+}
+
+// Once the string pool has switched to long string refs, rewrites every
+// table stream still using two-byte refs. The given table's rows are
+// already in memory and are left to the caller.
+func (p *MSIPackage) syncLongStringRefs(current *Table) error {
+	if !p.StringPool.LongStringRefs {
+		return nil
+	}
+
+	for _, table := range p.Tables {
+		if table.LongStringRefs {
+			continue
+		}
+
+		if table != current && p.hasStream(table.StreamName()) {
+			rows, err := p.readTableRows(table)
+			if err != nil {
+				return err
+			}
+
+			table.LongStringRefs = true
+			buf := new(bytes.Buffer)
+			err = table.WriteRows(buf, rows)
+			if err != nil {
+				return err
+			}
+			p.writeStream(table.StreamName(), buf.Bytes())
+		}
+
+		table.LongStringRefs = true
+	}
+
+	return nil
+}
+
+func (p *MSIPackage) resolveRow(table *Table, refs []*ValueRef) *Row {
+	values := make([]Value, len(refs))
+	for i, ref := range refs {
+		values[i] = ref.ToValue(p.StringPool)
+	}
+
+	return NewRow(table, values)
+}
+
+// Returns a string that uniquely identifies the primary key of a row.
+func rowKey(table *Table, values []Value) string {
+	parts := make([]string, 0)
+	for _, idx := range table.PrimaryKeyIndices() {
+		parts = append(parts, fmt.Sprintf("%#v", values[idx]))
+	}
+
+	return strings.Join(parts, "/")
+}
+
+func makeValidationRows(tableName string, columns []*Column) [][]Value {
+	rows := make([][]Value, len(columns))
+	for i, column := range columns {
+		nullable := "N"
+		if column.IsNullable {
+			nullable = "Y"
+		}
+
+		var minValue, maxValue Value
+		if column.ValueRange != nil {
+			minValue = int(column.ValueRange.Min)
+			maxValue = int(column.ValueRange.Max)
+		}
+
+		var keyTable, keyColumn Value
+		if column.ForeignKey.TableName != "" {
+			keyTable = column.ForeignKey.TableName
+			keyColumn = int(column.ForeignKey.ColumnIndex)
+		}
+
+		var category Value
+		if column.ColumnType == ColumnTypeStr {
+			category = column.Category.String()
+		}
+
+		var enumValues Value
+		if len(column.EnumValues) > 0 {
+			enumValues = strings.Join(column.EnumValues, ";")
+		}
+
+		rows[i] = []Value{tableName, column.Name, nullable, minValue, maxValue, keyTable, keyColumn, category, enumValues, nil}
+	}
+
+	return rows
+}
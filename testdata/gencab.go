@@ -0,0 +1,421 @@
+//go:build ignore
+
+// Generates the golden cabinets in testdata/cabinet, one per compression
+// type, along with the files they hold. Run from the repository root:
+//
+//	go run testdata/gencab.go
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	compressionNone  = 0
+	compressionMSZIP = 1
+	compressionLZX   = 3
+
+	lzxWindowBits = 16
+	frameSize     = 32768
+)
+
+type file struct {
+	name string
+	data []byte
+}
+
+type block struct {
+	data []byte
+	size int
+}
+
+func main() {
+	files := []file{
+		{"readme.txt", readme()},
+		{"data.bin", testData(50000)},
+		{"empty.txt", nil},
+	}
+
+	dir := filepath.Join("testdata", "cabinet")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var all []byte
+	for _, f := range files {
+		err = os.WriteFile(filepath.Join(dir, f.name), f.data, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		all = append(all, f.data...)
+	}
+
+	cabs := map[string][]byte{
+		"stored.cab": buildCab(compressionNone, storedBlocks(all), files),
+		"mszip.cab":  buildCab(compressionMSZIP, mszipBlocks(all), files),
+		"lzx.cab":    buildCab(compressionLZX|lzxWindowBits<<8, lzxBlocks(all), files),
+	}
+	for name, data := range cabs {
+		err = os.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func readme() []byte {
+	line := "Windows Installer packages keep their files in cabinets, compressed with MSZIP or LZX.\n"
+	return []byte(strings.Repeat(line, 20))
+}
+
+// Text with some random bytes mixed in, so that the encoders find both
+// matches and literals.
+func testData(n int) []byte {
+	r := rand.New(rand.NewSource(1))
+	words := []string{"alpha ", "beta ", "gamma ", "delta\n", "\xe8\x00\x01", "epsilon ", "zeta "}
+	var b bytes.Buffer
+	for b.Len() < n {
+		if r.Intn(10) == 0 {
+			b.WriteByte(byte(r.Intn(256)))
+		} else {
+			b.WriteString(words[r.Intn(len(words))])
+		}
+	}
+	return b.Bytes()[:n]
+}
+
+// Writes a cabinet with a single folder holding the files in order.
+func buildCab(compression uint16, blocks []block, files []file) []byte {
+	const headerSize = 36
+	const folderSize = 8
+
+	filesBuf := new(bytes.Buffer)
+	offset := uint32(0)
+	for _, f := range files {
+		binary.Write(filesBuf, binary.LittleEndian, uint32(len(f.data)))
+		binary.Write(filesBuf, binary.LittleEndian, offset)
+		// Folder index, DOS date (2020-01-01), DOS time (12:00) and the
+		// archive attribute.
+		binary.Write(filesBuf, binary.LittleEndian, []uint16{0, 0x5021, 0x6000, 0x20})
+		filesBuf.WriteString(f.name + "\x00")
+		offset += uint32(len(f.data))
+	}
+
+	dataBuf := new(bytes.Buffer)
+	for _, b := range blocks {
+		sizes := make([]byte, 4)
+		binary.LittleEndian.PutUint16(sizes[0:], uint16(len(b.data)))
+		binary.LittleEndian.PutUint16(sizes[2:], uint16(b.size))
+		binary.Write(dataBuf, binary.LittleEndian, checksum(sizes, checksum(b.data, 0)))
+		dataBuf.Write(sizes)
+		dataBuf.Write(b.data)
+	}
+
+	filesOffset := headerSize + folderSize
+	dataOffset := filesOffset + filesBuf.Len()
+	total := dataOffset + dataBuf.Len()
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("MSCF")
+	binary.Write(buf, binary.LittleEndian, []uint32{0, uint32(total), 0, uint32(filesOffset), 0})
+	buf.Write([]byte{3, 1})
+	binary.Write(buf, binary.LittleEndian, []uint16{1, uint16(len(files)), 0, 0x1234, 0})
+	binary.Write(buf, binary.LittleEndian, uint32(dataOffset))
+	binary.Write(buf, binary.LittleEndian, []uint16{uint16(len(blocks)), compression})
+	buf.Write(filesBuf.Bytes())
+	buf.Write(dataBuf.Bytes())
+
+	return buf.Bytes()
+}
+
+// The CFDATA checksum: the data XORed as little-endian 32-bit words, with
+// the trailing bytes taken most significant first.
+func checksum(data []byte, seed uint32) uint32 {
+	sum := seed
+	for len(data) >= 4 {
+		sum ^= binary.LittleEndian.Uint32(data)
+		data = data[4:]
+	}
+
+	var rest uint32
+	for _, b := range data {
+		rest = rest<<8 | uint32(b)
+	}
+
+	return sum ^ rest
+}
+
+func frames(data []byte) [][]byte {
+	var out [][]byte
+	for len(data) > frameSize {
+		out = append(out, data[:frameSize])
+		data = data[frameSize:]
+	}
+	return append(out, data)
+}
+
+func storedBlocks(data []byte) []block {
+	var blocks []block
+	for _, frame := range frames(data) {
+		blocks = append(blocks, block{frame, len(frame)})
+	}
+	return blocks
+}
+
+// Each MSZIP block is "CK" and a deflate stream, whose dictionary is the
+// data of the previous blocks.
+func mszipBlocks(data []byte) []block {
+	var blocks []block
+	var dict []byte
+	for _, frame := range frames(data) {
+		buf := new(bytes.Buffer)
+		buf.WriteString("CK")
+		w, err := flate.NewWriterDict(buf, flate.BestCompression, dict)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(frame)
+		w.Close()
+
+		blocks = append(blocks, block{buf.Bytes(), len(frame)})
+		dict = frame
+	}
+	return blocks
+}
+
+// Writes bits most significant first into 16-bit little-endian words, as
+// LZX reads them.
+type bitWriter struct {
+	out   []byte
+	acc   uint32
+	nbits uint
+}
+
+func (w *bitWriter) put(value uint32, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		w.acc = w.acc<<1 | (value>>uint(i))&1
+		w.nbits++
+		if w.nbits == 16 {
+			w.out = append(w.out, byte(w.acc), byte(w.acc>>8))
+			w.acc = 0
+			w.nbits = 0
+		}
+	}
+}
+
+func (w *bitWriter) align() {
+	if w.nbits > 0 {
+		w.put(0, 16-w.nbits)
+	}
+}
+
+// Returns the canonical Huffman codes for the given code lengths.
+func canonicalCodes(lengths []uint8) []uint32 {
+	symbols := make([]int, 0, len(lengths))
+	for symbol, length := range lengths {
+		if length > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.SliceStable(symbols, func(i, j int) bool { return lengths[symbols[i]] < lengths[symbols[j]] })
+
+	codes := make([]uint32, len(lengths))
+	code := uint32(0)
+	prevLength := uint8(0)
+	for i, symbol := range symbols {
+		if i > 0 {
+			code++
+		}
+		code <<= lengths[symbol] - prevLength
+		prevLength = lengths[symbol]
+		codes[symbol] = code
+	}
+	return codes
+}
+
+// Writes a range of tree lengths as deltas from the previous block's,
+// using a pretree in which every code is 5 bits long.
+func writeLengths(w *bitWriter, prev []uint8, lengths []uint8) {
+	pretree := make([]uint8, 20)
+	for i := range pretree {
+		pretree[i] = 5
+		w.put(5, 4)
+	}
+	codes := canonicalCodes(pretree)
+	for i := range lengths {
+		w.put(codes[(int(prev[i])-int(lengths[i])+17)%17], 5)
+	}
+}
+
+type lzxSlots struct {
+	base  []uint32
+	extra []uint8
+}
+
+func newLZXSlots(count int) *lzxSlots {
+	s := &lzxSlots{base: make([]uint32, count), extra: make([]uint8, count)}
+	for i := 0; i < count; i++ {
+		if i >= 4 {
+			s.extra[i] = uint8(i/2 - 1)
+			if s.extra[i] > 17 {
+				s.extra[i] = 17
+			}
+		}
+		if i > 0 {
+			s.base[i] = s.base[i-1] + 1<<s.extra[i-1]
+		}
+	}
+	return s
+}
+
+// Returns the position slot of a formatted offset and the offset's
+// remainder within it.
+func (s *lzxSlots) find(formatted uint32) (int, uint32) {
+	for slot := len(s.base) - 1; slot >= 3; slot-- {
+		if s.base[slot] <= formatted {
+			return slot, formatted - s.base[slot]
+		}
+	}
+	log.Fatalf("no position slot for %d", formatted)
+	return 0, 0
+}
+
+// Encodes the data as a verbatim block, an uncompressed block and another
+// verbatim block, with the output split into 32K frames.
+func lzxBlocks(data []byte) []block {
+	const slotCount = 32
+	slots := newLZXSlots(slotCount)
+
+	mainLengths := make([]uint8, 256+slotCount*8)
+	for i := range mainLengths {
+		mainLengths[i] = 10
+	}
+	lengthLengths := make([]uint8, 249)
+	for i := range lengthLengths {
+		lengthLengths[i] = 8
+	}
+	mainCodes := canonicalCodes(mainLengths)
+	lengthCodes := canonicalCodes(lengthLengths)
+	prevMain := make([]uint8, len(mainLengths))
+	prevLength := make([]uint8, len(lengthLengths))
+
+	var blocks []block
+	w := &bitWriter{}
+	pos, frameStart := 0, 0
+	frameEnd := func() int { return frameStart + frameSize }
+	endFrame := func() {
+		w.align()
+		blocks = append(blocks, block{w.out, pos - frameStart})
+		w.out = nil
+		frameStart = pos
+	}
+
+	// No Intel E8 call translation.
+	w.put(0, 1)
+	r0, r1, r2 := uint32(1), uint32(1), uint32(1)
+
+	third := len(data) / 3
+	parts := [][2]int{{0, third}, {third, third + 7001}, {third + 7001, len(data)}}
+	for i, part := range parts {
+		size := part[1] - part[0]
+		if i == 1 {
+			w.put(3, 3)
+			w.put(uint32(size>>8), 16)
+			w.put(uint32(size&0xff), 8)
+			// The header is padded to the next word, which is a whole word
+			// if it is already aligned.
+			if w.nbits == 0 {
+				w.put(0, 16)
+			} else {
+				w.align()
+			}
+			repeats := make([]byte, 12)
+			binary.LittleEndian.PutUint32(repeats[0:], r0)
+			binary.LittleEndian.PutUint32(repeats[4:], r1)
+			binary.LittleEndian.PutUint32(repeats[8:], r2)
+			w.out = append(w.out, repeats...)
+
+			for pos < part[1] {
+				end := minInt(part[1], frameEnd())
+				w.out = append(w.out, data[pos:end]...)
+				pos = end
+				if pos == frameEnd() {
+					endFrame()
+				}
+			}
+			if size%2 == 1 {
+				w.out = append(w.out, 0)
+			}
+			continue
+		}
+
+		w.put(1, 3)
+		w.put(uint32(size>>8), 16)
+		w.put(uint32(size&0xff), 8)
+		writeLengths(w, prevMain[:256], mainLengths[:256])
+		writeLengths(w, prevMain[256:], mainLengths[256:])
+		writeLengths(w, prevLength, lengthLengths)
+		copy(prevMain, mainLengths)
+		copy(prevLength, lengthLengths)
+
+		for pos < part[1] {
+			maxLength := minInt(257, minInt(part[1]-pos, frameEnd()-pos))
+			bestLength, bestOffset := 0, 0
+			for offset := 1; offset <= 3000 && offset <= pos; offset++ {
+				length := 0
+				for length < maxLength && data[pos+length] == data[pos-offset+length] {
+					length++
+				}
+				if length > bestLength {
+					bestLength, bestOffset = length, offset
+				}
+			}
+
+			if bestLength < 3 {
+				w.put(mainCodes[data[pos]], 10)
+				pos++
+			} else {
+				slot, remainder := 0, uint32(0)
+				if uint32(bestOffset) != r0 {
+					slot, remainder = slots.find(uint32(bestOffset) + 2)
+					r2, r1, r0 = r1, r0, uint32(bestOffset)
+				}
+
+				header := minInt(bestLength-2, 7)
+				w.put(mainCodes[256+slot*8+header], 10)
+				if header == 7 {
+					w.put(lengthCodes[bestLength-2-7], 8)
+				}
+				if slot >= 3 && slots.extra[slot] > 0 {
+					w.put(remainder, uint(slots.extra[slot]))
+				}
+				pos += bestLength
+			}
+
+			if pos == frameEnd() {
+				endFrame()
+			}
+		}
+	}
+	if pos > frameStart {
+		endFrame()
+	}
+
+	return blocks
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
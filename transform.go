@@ -0,0 +1,854 @@
+package msi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/asalih/go-mscfb"
+)
+
+// Errors ApplyTransform can report while applying a transform. Each flag
+// passed to ApplyTransform suppresses the corresponding error. Transforms
+// store the conditions their author meant to suppress in the low word of
+// the Character Count summary property.
+type TransformErrorCondition int32
+
+const (
+	// Adding a row that already exists. When suppressed, the row is
+	// replaced.
+	TransformErrorAddExistingRow TransformErrorCondition = 0x1
+	// Deleting a row that does not exist.
+	TransformErrorDeleteMissingRow TransformErrorCondition = 0x2
+	// Adding a table that already exists.
+	TransformErrorAddExistingTable TransformErrorCondition = 0x4
+	// Deleting a table that does not exist.
+	TransformErrorDeleteMissingTable TransformErrorCondition = 0x8
+	// Updating a row that does not exist.
+	TransformErrorUpdateMissingRow TransformErrorCondition = 0x10
+	// The transform and package code pages differ and neither is neutral.
+	TransformErrorChangeCodePage TransformErrorCondition = 0x20
+	// Requests a _TransformView table instead of applying the transform,
+	// which is not supported.
+	TransformErrorViewTransform TransformErrorCondition = 0x100
+)
+
+// Checks a transform makes of the package it is applied to, stored in the
+// high word of the Character Count summary property.
+type TransformValidation int32
+
+const (
+	// The ProductLanguage property must match the transform's language.
+	TransformValidateLanguage TransformValidation = 0x1
+	// The ProductCode property must match the target product code.
+	TransformValidateProduct TransformValidation = 0x2
+	// The platform in the Template summary property must match.
+	TransformValidatePlatform TransformValidation = 0x4
+	// Compare only the major field of the ProductVersion property.
+	TransformValidateMajorVersion TransformValidation = 0x8
+	// Compare the major and minor fields of the ProductVersion property.
+	TransformValidateMinorVersion TransformValidation = 0x10
+	// Compare the major, minor and update fields of the ProductVersion
+	// property.
+	TransformValidateUpdateVersion TransformValidation = 0x20
+	// The package's version must be less than the target version.
+	TransformValidateNewLessBaseVersion TransformValidation = 0x40
+	// The package's version must be less than or equal to the target
+	// version.
+	TransformValidateNewLessEqualBaseVersion TransformValidation = 0x80
+	// The package's version must equal the target version. This is the
+	// comparison used when none is given.
+	TransformValidateNewEqualBaseVersion TransformValidation = 0x100
+	// The package's version must be greater than or equal to the target
+	// version.
+	TransformValidateNewGreaterEqualBaseVersion TransformValidation = 0x200
+	// The package's version must be greater than the target version.
+	TransformValidateNewGreaterBaseVersion TransformValidation = 0x400
+	// The UpgradeCode property must match the transform's upgrade code.
+	TransformValidateUpgradeCode TransformValidation = 0x800
+)
+
+// The kind of change a transform makes to a row.
+type TransformOperation int
+
+const (
+	// Adds the row. Every column is given.
+	TransformOperationInsert TransformOperation = iota
+	// Sets some of the columns of the row with the same key.
+	TransformOperationUpdate
+	// Deletes the row with the same key. Only key columns are given.
+	TransformOperationDelete
+)
+
+func (o TransformOperation) String() string {
+	switch o {
+	case TransformOperationInsert:
+		return "Insert"
+	case TransformOperationUpdate:
+		return "Update"
+	case TransformOperationDelete:
+		return "Delete"
+	default:
+		return "Unknown"
+	}
+}
+
+// A change to one row of a table.
+type TransformRow struct {
+	Operation TransformOperation
+	// One value per column of the table. Values of columns the change does
+	// not give are nil. Binary columns hold the name of the stream with
+	// their data.
+	Values []Value
+	// The indices of the columns the change gives, including the key
+	// columns.
+	Columns []int
+}
+
+// The products a transform applies to and produces, as listed in its
+// Revision Number summary property.
+type TransformProducts struct {
+	TargetProductCode   string
+	TargetVersion       string
+	UpgradedProductCode string
+	UpgradedVersion     string
+	UpgradeCode         string
+}
+
+// A transform (.mst): a set of changes to the tables of a package. Table
+// streams of a transform hold only the changed rows, each prefixed by a
+// mask saying whether it is inserted, updated or deleted, and refer to the
+// transform's own string pool.
+type Transform struct {
+	CompoundFile *mscfb.CompoundFile
+	SummaryInfo  *SummaryInfo
+	StringPool   *StringPool
+
+	// The storage holding the transform, or empty for the root storage.
+	storage string
+}
+
+func OpenTransform(rdr io.ReadSeeker) (*Transform, error) {
+	cf, err := mscfb.Open(rdr, mscfb.ValidationPermissive)
+	if err != nil {
+		return nil, err
+	}
+
+	if PackageTypeFromCLSID(cf.RootEntry().CLSID) != PackageTypeTransform {
+		return nil, fmt.Errorf("package is not a transform")
+	}
+
+	return openTransformStorage(cf, "")
+}
+
+// Reads a transform stored in a storage of a compound file, as patches
+// embed them, or in the root storage if storage is empty.
+func openTransformStorage(cf *mscfb.CompoundFile, storage string) (*Transform, error) {
+	summaryInfo, err := readSummaryInfo(cf, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	stringPool, err := readStringPool(cf, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transform{
+		CompoundFile: cf,
+		SummaryInfo:  summaryInfo,
+		StringPool:   stringPool,
+		storage:      storage,
+	}, nil
+}
+
+// Returns the errors the transform's author meant to suppress.
+func (t *Transform) ErrorConditions() TransformErrorCondition {
+	return TransformErrorCondition(t.SummaryInfo.CharacterCount() & 0xffff)
+}
+
+// Returns the checks the transform makes of the package it is applied to.
+func (t *Transform) Validation() TransformValidation {
+	return TransformValidation(uint32(t.SummaryInfo.CharacterCount()) >> 16)
+}
+
+// Parses the Revision Number summary property, which has the form
+// "{target}version;{upgraded}version;{upgrade code}".
+func (t *Transform) Products() *TransformProducts {
+	parts := strings.SplitN(t.SummaryInfo.RevisionNumber(), ";", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+
+	products := &TransformProducts{UpgradeCode: parts[2]}
+	products.TargetProductCode, products.TargetVersion = splitProductCode(parts[0])
+	products.UpgradedProductCode, products.UpgradedVersion = splitProductCode(parts[1])
+
+	return products
+}
+
+func splitProductCode(str string) (string, string) {
+	if strings.HasPrefix(str, "{") {
+		if end := strings.Index(str, "}"); end != -1 {
+			return str[:end+1], str[end+1:]
+		}
+	}
+
+	return "", str
+}
+
+// Returns the names of the tables the transform changes, in order. The
+// _Tables and _Columns tables are included if the transform adds or
+// removes tables or columns.
+func (t *Transform) Tables() []string {
+	names := make([]string, 0)
+	entries := storageEntries(t.CompoundFile, t.storage)
+	for entry := entries.Next(); entry != nil; entry = entries.Next() {
+		if !entry.IsStream() {
+			continue
+		}
+
+		name, isTable := NameDecode(entry.Name)
+		if !isTable || name == STRING_POOL_TABLE_NAME || name == STRING_DATA_TABLE_NAME {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Decodes the changes the transform makes to the given table, whose
+// columns must be those the table has once the transform's _Columns
+// changes are applied. Only the first 16 columns can be set by an update.
+func (t *Transform) TableChanges(table *Table) ([]*TransformRow, error) {
+	changes := make([]*TransformRow, 0)
+	streamName := storageStreamPath(t.storage, table.StreamName())
+	if !streamExists(t.CompoundFile, streamName) {
+		return changes, nil
+	}
+
+	stream, err := t.CompoundFile.OpenStream(streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	rdr := bytes.NewReader(data)
+	for rdr.Len() > 0 {
+		var mask uint16
+		err = binary.Read(rdr, binary.LittleEndian, &mask)
+		if err != nil {
+			return nil, fmt.Errorf("transform of table %s is truncated", table.Name)
+		}
+
+		change := &TransformRow{
+			Values:  make([]Value, len(table.Columns)),
+			Columns: make([]int, 0, len(table.Columns)),
+		}
+
+		numColumns := len(table.Columns)
+		switch {
+		case mask&1 != 0:
+			change.Operation = TransformOperationInsert
+			numColumns = int(mask >> 8)
+			if numColumns > len(table.Columns) {
+				return nil, fmt.Errorf("transform of table %s has a row with %d columns, but the table has %d", table.Name, numColumns, len(table.Columns))
+			}
+		case mask == 0:
+			change.Operation = TransformOperationDelete
+		default:
+			change.Operation = TransformOperationUpdate
+		}
+
+		for i := 0; i < numColumns; i++ {
+			column := table.Columns[i]
+			switch change.Operation {
+			case TransformOperationDelete:
+				if !column.IsPrimarykey {
+					continue
+				}
+			case TransformOperationUpdate:
+				if !column.IsPrimarykey && (i >= 16 || mask&(1<<i) == 0) {
+					continue
+				}
+			}
+
+			value, err := t.readValue(rdr, column)
+			if err != nil {
+				return nil, fmt.Errorf("transform of table %s is truncated", table.Name)
+			}
+			change.Values[i] = value
+			change.Columns = append(change.Columns, i)
+		}
+
+		for _, i := range change.Columns {
+			if table.Columns[i].Category == CategoryBinary && change.Values[i] != nil {
+				change.Values[i] = binaryStreamName(table, change.Values)
+			}
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
+// Reads one value of a transform row. Binary columns only record whether
+// the row has data, which is read as a non-nil placeholder.
+func (t *Transform) readValue(rdr io.Reader, column *Column) (Value, error) {
+	if column.Category == CategoryBinary {
+		var present uint16
+		err := binary.Read(rdr, binary.LittleEndian, &present)
+		if err != nil || present == 0 {
+			return nil, err
+		}
+
+		return true, nil
+	}
+
+	ref, err := column.ColumnType.ReadValue(rdr, t.StringPool.LongStringRefs)
+	if err != nil {
+		return nil, err
+	}
+
+	return ref.ToValue(t.StringPool), nil
+}
+
+// Reads the data of a binary column value from the transform.
+func (t *Transform) streamData(name string) ([]byte, error) {
+	streamName := storageStreamPath(t.storage, NameEncode(name, false))
+	if !streamExists(t.CompoundFile, streamName) {
+		return nil, fmt.Errorf("transform has no stream %s", name)
+	}
+
+	stream, err := t.CompoundFile.OpenStream(streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(stream)
+}
+
+// Returns the name of the stream holding a binary value of the given row:
+// the table name followed by the row's key values, separated by periods.
+func binaryStreamName(table *Table, values []Value) string {
+	parts := []string{table.Name}
+	for _, idx := range table.PrimaryKeyIndices() {
+		parts = append(parts, fmt.Sprintf("%v", values[idx]))
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// Applies a transform to the package. The transform's validation flags are
+// checked first; errorConditions lists the errors to ignore while
+// applying it, such as t.ErrorConditions(). Foreign keys are not checked.
+// On error the package may be partly transformed, and should be reopened
+// to discard its pending changes.
+func (p *MSIPackage) ApplyTransform(t *Transform, errorConditions TransformErrorCondition) error {
+	if errorConditions&TransformErrorViewTransform != 0 {
+		return fmt.Errorf("viewing transforms is not supported")
+	}
+
+	err := p.checkTransformTarget(t)
+	if err != nil {
+		return err
+	}
+
+	return p.applyTransform(t, errorConditions)
+}
+
+// Applies a transform without checking its validation flags.
+func (p *MSIPackage) applyTransform(t *Transform, errorConditions TransformErrorCondition) error {
+	if t.StringPool.CodePage != p.StringPool.CodePage &&
+		t.StringPool.CodePage != CodePageDefault() && p.StringPool.CodePage != CodePageDefault() &&
+		errorConditions&TransformErrorChangeCodePage == 0 {
+		return fmt.Errorf("transform code page %d does not match package code page %d", t.StringPool.CodePage.ID(), p.StringPool.CodePage.ID())
+	}
+
+	dropped, err := p.applyTransformSchema(t, errorConditions)
+	if err != nil {
+		return err
+	}
+
+	reload := make(map[string]struct{})
+	for _, name := range t.Tables() {
+		if name == TABLES_TABLE_NAME || name == COLUMNS_TABLE_NAME {
+			continue
+		}
+		if _, ok := dropped[name]; ok {
+			continue
+		}
+
+		table := p.Table(name)
+		if table == nil {
+			return fmt.Errorf("transform changes table %s, which does not exist", name)
+		}
+
+		changes, err := t.TableChanges(table)
+		if err != nil {
+			return err
+		}
+
+		err = p.applyTableChanges(t, table, changes, errorConditions)
+		if err != nil {
+			return err
+		}
+
+		if name == VALIDATION_TABLE_NAME {
+			for _, change := range changes {
+				if tableName, ok := change.Values[0].(string); ok && p.HasTable(tableName) {
+					reload[tableName] = struct{}{}
+				}
+			}
+		}
+	}
+
+	for name := range reload {
+		if _, ok := dropped[name]; ok {
+			continue
+		}
+
+		err = p.loadTableColumns(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(dropped))
+	for name := range dropped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err = p.DropTable(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Checks the package against the transform's validation flags.
+func (p *MSIPackage) checkTransformTarget(t *Transform) error {
+	validation := t.Validation()
+	if validation == 0 {
+		return nil
+	}
+
+	properties, err := p.propertyValues()
+	if err != nil {
+		return err
+	}
+	products := t.Products()
+
+	if validation&TransformValidateLanguage != 0 {
+		languages, err := t.SummaryInfo.Languages()
+		if err != nil {
+			return err
+		}
+		if len(languages) > 0 && properties["ProductLanguage"] != strconv.Itoa(int(languages[0])) {
+			return fmt.Errorf("transform requires language %d, but the package has %q", languages[0], properties["ProductLanguage"])
+		}
+	}
+
+	if validation&TransformValidateProduct != 0 && !strings.EqualFold(properties["ProductCode"], products.TargetProductCode) {
+		return fmt.Errorf("transform requires product code %s, but the package has %q", products.TargetProductCode, properties["ProductCode"])
+	}
+
+	if validation&TransformValidatePlatform != 0 && p.SummaryInfo.Architecture() != t.SummaryInfo.Architecture() {
+		return fmt.Errorf("transform requires platform %q, but the package has %q", t.SummaryInfo.Platform(), p.SummaryInfo.Platform())
+	}
+
+	if validation&TransformValidateUpgradeCode != 0 && !strings.EqualFold(properties["UpgradeCode"], products.UpgradeCode) {
+		return fmt.Errorf("transform requires upgrade code %s, but the package has %q", products.UpgradeCode, properties["UpgradeCode"])
+	}
+
+	var fields int
+	switch {
+	case validation&TransformValidateMajorVersion != 0:
+		fields = 1
+	case validation&TransformValidateMinorVersion != 0:
+		fields = 2
+	case validation&TransformValidateUpdateVersion != 0:
+		fields = 3
+	}
+
+	relations := validation & (TransformValidateNewLessBaseVersion | TransformValidateNewLessEqualBaseVersion |
+		TransformValidateNewEqualBaseVersion | TransformValidateNewGreaterEqualBaseVersion | TransformValidateNewGreaterBaseVersion)
+	if fields == 0 && relations == 0 {
+		return nil
+	}
+	if fields == 0 {
+		fields = 4
+	}
+
+	cmp := compareVersions(properties["ProductVersion"], products.TargetVersion, fields)
+	var ok bool
+	switch {
+	case relations&TransformValidateNewLessBaseVersion != 0:
+		ok = cmp < 0
+	case relations&TransformValidateNewLessEqualBaseVersion != 0:
+		ok = cmp <= 0
+	case relations&TransformValidateNewGreaterEqualBaseVersion != 0:
+		ok = cmp >= 0
+	case relations&TransformValidateNewGreaterBaseVersion != 0:
+		ok = cmp > 0
+	default:
+		ok = cmp == 0
+	}
+	if !ok {
+		return fmt.Errorf("package version %q does not satisfy the transform's check against version %s", properties["ProductVersion"], products.TargetVersion)
+	}
+
+	return nil
+}
+
+// Compares the first fields of two dotted version strings. Missing or
+// invalid fields count as 0.
+func compareVersions(a string, b string, fields int) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < fields; i++ {
+		var aField, bField int
+		if i < len(aParts) {
+			aField, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bField, _ = strconv.Atoi(bParts[i])
+		}
+
+		if aField != bField {
+			if aField < bField {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// Applies the transform's _Tables and _Columns changes, creating the tables
+// and columns it adds. Returns the tables the transform deletes, which are
+// dropped once the other changes are applied.
+func (p *MSIPackage) applyTransformSchema(t *Transform, errorConditions TransformErrorCondition) (map[string]struct{}, error) {
+	tableChanges, err := t.TableChanges(makeTablesTable(t.StringPool.LongStringRefs))
+	if err != nil {
+		return nil, err
+	}
+
+	dropped := make(map[string]struct{})
+	added := make(map[string]struct{})
+	addedNames := make([]string, 0)
+	for _, change := range tableChanges {
+		name, _ := change.Values[0].(string)
+		switch change.Operation {
+		case TransformOperationDelete:
+			if !p.HasTable(name) {
+				if errorConditions&TransformErrorDeleteMissingTable == 0 {
+					return nil, fmt.Errorf("transform deletes table %s, which does not exist", name)
+				}
+				continue
+			}
+			dropped[name] = struct{}{}
+		case TransformOperationInsert:
+			if p.HasTable(name) {
+				if errorConditions&TransformErrorAddExistingTable == 0 {
+					return nil, fmt.Errorf("transform adds table %s, which already exists", name)
+				}
+				continue
+			}
+			if !IsValidTableName(name) {
+				return nil, fmt.Errorf("transform adds table with invalid name %q", name)
+			}
+			added[name] = struct{}{}
+			addedNames = append(addedNames, name)
+		}
+	}
+
+	columnChanges, err := t.TableChanges(makeColumnsTable(t.StringPool.LongStringRefs))
+	if err != nil {
+		return nil, err
+	}
+
+	// Transforms leave the number of a new column null; columns are
+	// numbered in the order they are listed.
+	nextNumber := make(map[string]int)
+	columnRows := make(map[string][][]Value)
+	for _, change := range columnChanges {
+		tableName, _ := change.Values[0].(string)
+		if _, ok := dropped[tableName]; ok {
+			continue
+		}
+
+		if change.Operation != TransformOperationInsert {
+			return nil, fmt.Errorf("transform removes or changes a column of table %s, which is not supported", tableName)
+		}
+
+		_, isAdded := added[tableName]
+		table := p.Table(tableName)
+		if table == nil && !isAdded {
+			return nil, fmt.Errorf("transform adds a column to table %s, which does not exist", tableName)
+		}
+
+		if _, ok := nextNumber[tableName]; !ok {
+			nextNumber[tableName] = 1
+			if table != nil {
+				nextNumber[tableName] = len(table.Columns) + 1
+			}
+		}
+
+		number, ok := change.Values[1].(int)
+		if !ok {
+			number = nextNumber[tableName]
+		}
+		if number < nextNumber[tableName] {
+			if errorConditions&TransformErrorAddExistingRow == 0 {
+				return nil, fmt.Errorf("transform adds column %d of table %s, which already exists", number, tableName)
+			}
+			continue
+		}
+		if number != nextNumber[tableName] {
+			return nil, fmt.Errorf("transform adds column %d of table %s out of order", number, tableName)
+		}
+		nextNumber[tableName]++
+
+		columnRows[tableName] = append(columnRows[tableName], []Value{tableName, number, change.Values[2], change.Values[3]})
+	}
+
+	for _, name := range addedNames {
+		if len(columnRows[name]) == 0 {
+			return nil, fmt.Errorf("transform adds table %s without columns", name)
+		}
+
+		err = p.InsertRows(TABLES_TABLE_NAME, [][]Value{{name}})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tableNames := make([]string, 0, len(columnRows))
+	for name := range columnRows {
+		tableNames = append(tableNames, name)
+	}
+	sort.Strings(tableNames)
+
+	for _, name := range tableNames {
+		var rows [][]*ValueRef
+		table := p.Table(name)
+		if table != nil {
+			rows, err = p.readTableRows(table)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = p.InsertRows(COLUMNS_TABLE_NAME, columnRows[name])
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.loadTableColumns(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rows) > 0 {
+			table = p.Table(name)
+			for i := range rows {
+				for len(rows[i]) < len(table.Columns) {
+					rows[i] = append(rows[i], &ValueRef{IsNull: true})
+				}
+			}
+
+			err = p.writeTableRows(table, rows)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return dropped, nil
+}
+
+// Applies the row changes of a transform to a table, reading and writing
+// its rows once.
+func (p *MSIPackage) applyTableChanges(t *Transform, table *Table, changes []*TransformRow, errorConditions TransformErrorCondition) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	rows, err := p.readTableRows(table)
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string]int)
+	for i, refs := range rows {
+		index[rowKey(table, p.resolveRow(table, refs).Values)] = i
+	}
+
+	for _, change := range changes {
+		key := rowKey(table, change.Values)
+		i, exists := index[key]
+
+		columns := change.Columns
+		switch change.Operation {
+		case TransformOperationInsert:
+			if !exists {
+				refs := make([]*ValueRef, len(table.Columns))
+				for j := range refs {
+					refs[j] = &ValueRef{IsNull: true}
+				}
+				rows = append(rows, refs)
+				i = len(rows) - 1
+				index[key] = i
+			} else if errorConditions&TransformErrorAddExistingRow == 0 {
+				return fmt.Errorf("transform adds row %s to table %s, which already exists", key, table.Name)
+			}
+			columns = make([]int, len(table.Columns))
+			for j := range columns {
+				columns[j] = j
+			}
+		case TransformOperationUpdate:
+			if !exists {
+				if errorConditions&TransformErrorUpdateMissingRow == 0 {
+					return fmt.Errorf("transform updates row %s of table %s, which does not exist", key, table.Name)
+				}
+				continue
+			}
+		case TransformOperationDelete:
+			if !exists {
+				if errorConditions&TransformErrorDeleteMissingRow == 0 {
+					return fmt.Errorf("transform deletes row %s of table %s, which does not exist", key, table.Name)
+				}
+				continue
+			}
+
+			for j, ref := range rows[i] {
+				if table.Columns[j].Category == CategoryBinary {
+					if name, ok := ref.ToValue(p.StringPool).(string); ok && p.hasStream(NameEncode(name, false)) {
+						p.removeStream(NameEncode(name, false))
+					}
+				}
+
+				err = ref.Remove(p.StringPool)
+				if err != nil {
+					return err
+				}
+			}
+			rows[i] = nil
+			delete(index, key)
+			continue
+		}
+
+		for _, j := range columns {
+			value := change.Values[j]
+			if table.Columns[j].Category == CategoryBinary && value != nil {
+				data, err := t.streamData(value.(string))
+				if err != nil {
+					return err
+				}
+				p.writeStream(NameEncode(value.(string), false), data)
+			}
+
+			err = rows[i][j].Remove(p.StringPool)
+			if err != nil {
+				return err
+			}
+
+			rows[i][j], err = NewValueRef(value, p.StringPool)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	kept := make([][]*ValueRef, 0, len(rows))
+	for _, refs := range rows {
+		if refs != nil {
+			kept = append(kept, refs)
+		}
+	}
+
+	return p.writeTableRows(table, kept)
+}
+
+// Builds the columns of a table from its _Columns rows and, if the package
+// has one, its _Validation rows, replacing the columns the package has for
+// it.
+func (p *MSIPackage) loadTableColumns(tableName string) error {
+	columnRows, err := iceRows(p, COLUMNS_TABLE_NAME)
+	if err != nil {
+		return err
+	}
+
+	specs := make([]*Row, 0)
+	for _, row := range columnRows {
+		if row.GetString("Table") == tableName {
+			specs = append(specs, row)
+		}
+	}
+	sort.SliceStable(specs, func(i, j int) bool {
+		a, _ := specs[i].GetInt("Number")
+		b, _ := specs[j].GetInt("Number")
+		return a < b
+	})
+	if len(specs) == 0 {
+		return fmt.Errorf("no columns for table %s", tableName)
+	}
+
+	validationRows, err := iceRows(p, VALIDATION_TABLE_NAME)
+	if err != nil {
+		return err
+	}
+	validation := make(map[string][]Value)
+	for _, row := range validationRows {
+		if row.GetString("Table") == tableName {
+			validation[row.GetString("Column")] = row.Values
+		}
+	}
+
+	columns := make([]*Column, 0, len(specs))
+	for i, spec := range specs {
+		if number, _ := spec.GetInt("Number"); number != i+1 {
+			return fmt.Errorf("table %s does not have a complete set of columns", tableName)
+		}
+
+		name := spec.GetString("Name")
+		builder := NewColumnBuilder(name)
+		if values, ok := validation[name]; ok {
+			err = builder.applyValidationRow(values)
+			if err != nil {
+				return err
+			}
+		}
+
+		bits, _ := spec.GetInt("Type")
+		column, err := builder.withBitFields(int32(bits))
+		if err != nil {
+			return err
+		}
+		columns = append(columns, column)
+	}
+
+	if table := p.Table(tableName); table != nil {
+		table.Columns = columns
+	} else {
+		p.Tables[tableName] = NewTable(tableName, columns, p.StringPool.LongStringRefs)
+	}
+
+	return nil
+}
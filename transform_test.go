@@ -0,0 +1,169 @@
+package msi
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Writes a copy of the package file at src to a new file in dir.
+func copyTestPackage(t *testing.T, src string, dir string, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestGenerateApplyTransform(t *testing.T) {
+	dir := t.TempDir()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The reference package.
+	referencePath := filepath.Join(dir, "reference.msi")
+	file, err := os.Create(referencePath)
+	must(err)
+	defer file.Close()
+
+	p, err := Create(file, PackageTypeInstaller)
+	must(err)
+
+	must(p.CreateTable("Property", []*Column{
+		NewColumnBuilder("Property").SetPrimaryKey().IDString(72),
+		NewColumnBuilder("Value").SetLocalizable().TextString(0),
+	}))
+	must(p.InsertRows("Property", [][]Value{
+		{"Keep", "unchanged"},
+		{"Update", "old"},
+		{"Delete", "gone"},
+	}))
+
+	// Changes to columns past the sixteenth cannot be given by an update.
+	wideColumns := []*Column{NewColumnBuilder("Key").SetPrimaryKey().IDString(72)}
+	for i := 1; i <= 17; i++ {
+		wideColumns = append(wideColumns, NewColumnBuilder(fmt.Sprintf("Col%d", i)).SetNullable().Int16())
+	}
+	must(p.CreateTable("Wide", wideColumns))
+	wideRow := func(key string, last int) []Value {
+		values := []Value{key}
+		for i := 1; i < 17; i++ {
+			values = append(values, i)
+		}
+		return append(values, last)
+	}
+	must(p.InsertRows("Wide", [][]Value{wideRow("early", 17), wideRow("late", 17)}))
+
+	must(p.CreateTable("Binary", []*Column{
+		NewColumnBuilder("Name").SetPrimaryKey().IDString(72),
+		NewColumnBuilder("Data").Binary(),
+	}))
+	must(p.InsertRows("Binary", [][]Value{{"icon", "Binary.icon"}}))
+	p.writeStream(NameEncode("Binary.icon", false), []byte{1, 2, 3})
+
+	must(p.CreateTable("Obsolete", []*Column{NewColumnBuilder("Key").SetPrimaryKey().IDString(72)}))
+	must(p.InsertRows("Obsolete", [][]Value{{"old"}}))
+	must(p.Flush())
+
+	// The modified package.
+	modifiedPath := copyTestPackage(t, referencePath, dir, "modified.msi")
+	modified := openTestPackage(t, modifiedPath)
+
+	_, err = modified.UpdateRows("Property", map[string]Value{"Value": "new"}, func(row *Row) bool {
+		return row.GetString("Property") == "Update"
+	})
+	must(err)
+	_, err = modified.DeleteRows("Property", func(row *Row) bool { return row.GetString("Property") == "Delete" })
+	must(err)
+	must(modified.InsertRows("Property", [][]Value{{"Insert", "added"}}))
+	must(modified.AddColumn("Property", NewColumnBuilder("Comment").SetNullable().TextString(0)))
+	_, err = modified.UpdateRows("Property", map[string]Value{"Comment": "commented"}, func(row *Row) bool {
+		return row.GetString("Property") == "Keep"
+	})
+	must(err)
+
+	_, err = modified.UpdateRows("Wide", map[string]Value{"Col3": 30}, func(row *Row) bool {
+		return row.GetString("Key") == "early"
+	})
+	must(err)
+	_, err = modified.UpdateRows("Wide", map[string]Value{"Col17": 170}, func(row *Row) bool {
+		return row.GetString("Key") == "late"
+	})
+	must(err)
+
+	modified.writeStream(NameEncode("Binary.icon", false), []byte{4, 5, 6, 7})
+	must(modified.InsertRows("Binary", [][]Value{{"logo", "Binary.logo"}}))
+	modified.writeStream(NameEncode("Binary.logo", false), []byte("logo data"))
+
+	must(modified.CreateTable("Added", []*Column{
+		NewColumnBuilder("Key").SetPrimaryKey().IDString(72),
+		NewColumnBuilder("Count").Int32(),
+		NewColumnBuilder("Data").SetNullable().Binary(),
+	}))
+	must(modified.InsertRows("Added", [][]Value{{"first", 1, "Added.first"}, {"second", 2, nil}}))
+	modified.writeStream(NameEncode("Added.first", false), []byte("added data"))
+
+	must(modified.DropTable("Obsolete"))
+	must(modified.Flush())
+	modified = openTestPackage(t, modifiedPath)
+
+	var buf bytes.Buffer
+	must(modified.GenerateTransform(openTestPackage(t, referencePath), &buf, 0, 0))
+
+	transform, err := OpenTransform(bytes.NewReader(buf.Bytes()))
+	must(err)
+
+	// The added table and column are listed in _Tables and _Columns, and the
+	// change to the wide table's last column deletes and adds its row again.
+	changed := make(map[string]bool)
+	for _, name := range transform.Tables() {
+		changed[name] = true
+	}
+	for _, name := range []string{TABLES_TABLE_NAME, COLUMNS_TABLE_NAME, "Property", "Wide", "Binary", "Added"} {
+		if !changed[name] {
+			t.Errorf("transform does not change table %s, got %v", name, transform.Tables())
+		}
+	}
+	wideChanges, err := transform.TableChanges(modified.Table("Wide"))
+	must(err)
+	operations := make(map[string][]TransformOperation)
+	for _, change := range wideChanges {
+		key := change.Values[0].(string)
+		operations[key] = append(operations[key], change.Operation)
+	}
+	wantOperations := map[string][]TransformOperation{
+		"early": {TransformOperationUpdate},
+		"late":  {TransformOperationDelete, TransformOperationInsert},
+	}
+	if !reflect.DeepEqual(operations, wantOperations) {
+		t.Errorf("got Wide changes %v, want %v", operations, wantOperations)
+	}
+
+	targetPath := copyTestPackage(t, referencePath, dir, "target.msi")
+	target := openTestPackage(t, targetPath)
+	must(target.ApplyTransform(transform, 0))
+	must(target.Flush())
+
+	streams := map[string][]byte{
+		"Binary.icon": {4, 5, 6, 7},
+		"Binary.logo": []byte("logo data"),
+		"Added.first": []byte("added data"),
+	}
+	comparePackages(t, openTestPackage(t, targetPath), modified, streams)
+}
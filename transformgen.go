@@ -0,0 +1,467 @@
+package msi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A row of a transform table stream before it is encoded. Values are nil
+// for the columns the row leaves out.
+type transformRecord struct {
+	mask   uint16
+	values []*ValueRef
+}
+
+// Collects the changes of a transform, which are only encoded once every
+// string is in the pool and the width of string refs is known.
+type transformGenerator struct {
+	pool    *StringPool
+	tables  map[string]*Table
+	records map[string][]*transformRecord
+	streams map[string][]byte
+}
+
+// Writes a transform that turns the reference package into this package,
+// as MsiDatabaseGenerateTransform does. The transform's summary
+// information names the reference package as its target and this package
+// as the upgraded product, and stores the given validation flags and error
+// conditions for ApplyTransform. Columns may be added to existing tables,
+// but not changed or removed.
+func (p *MSIPackage) GenerateTransform(reference *MSIPackage, w io.Writer, errorConditions TransformErrorCondition, validation TransformValidation) error {
+	g := &transformGenerator{
+		pool:    NewStringPool(p.StringPool.CodePage),
+		tables:  make(map[string]*Table),
+		records: make(map[string][]*transformRecord),
+		streams: make(map[string][]byte),
+	}
+
+	tablesTable := makeTablesTable(false)
+	columnsTable := makeColumnsTable(false)
+	g.tables[tablesTable.Name] = tablesTable
+	g.tables[columnsTable.Name] = columnsTable
+
+	for _, name := range sortedTableNames(reference) {
+		if !p.HasTable(name) {
+			err := g.add(tablesTable, 0, []Value{name})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range sortedTableNames(p) {
+		table := p.Table(name)
+		baseTable := reference.Table(name)
+
+		first := 0
+		if baseTable == nil {
+			err := g.add(tablesTable, insertMask(tablesTable), []Value{name})
+			if err != nil {
+				return err
+			}
+		} else {
+			err := checkTransformColumns(baseTable, table)
+			if err != nil {
+				return err
+			}
+			first = len(baseTable.Columns)
+		}
+
+		for i := first; i < len(table.Columns); i++ {
+			column := table.Columns[i]
+			err := g.add(columnsTable, insertMask(columnsTable), []Value{name, i + 1, column.Name, int(column.BitField())})
+			if err != nil {
+				return err
+			}
+		}
+
+		err := g.diffTable(reference, p, table)
+		if err != nil {
+			return err
+		}
+	}
+
+	summaryInfo := NewSummary()
+	summaryInfo.SetCodePage(p.SummaryInfo.CodePage())
+	summaryInfo.SetTitle(PackageTypeTransform.String())
+	summaryInfo.SetCreatingApplication(defaultCreatingApplication)
+	summaryInfo.SetCreationTime(time.Now())
+	summaryInfo.SetPageCount(p.SummaryInfo.PageCount())
+
+	summaryInfo.SetTemplate(transformTemplate(reference))
+	summaryInfo.SetLastSavedBy(transformTemplate(p))
+
+	revisionNumber, err := transformRevisionNumber(reference, p)
+	if err != nil {
+		return err
+	}
+	summaryInfo.SetRevisionNumber(revisionNumber)
+	summaryInfo.SetCharacterCount(int32(uint32(validation)<<16 | uint32(errorConditions)&0xffff))
+
+	return g.write(w, summaryInfo)
+}
+
+func sortedTableNames(p *MSIPackage) []string {
+	names := make([]string, 0, len(p.Tables))
+	for name := range p.Tables {
+		if name != TABLES_TABLE_NAME && name != COLUMNS_TABLE_NAME {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Returns the mask of a row that gives every column of the table.
+func insertMask(table *Table) uint16 {
+	return uint16(len(table.Columns))<<8 | 1
+}
+
+// Checks that the columns of the reference table are unchanged in the
+// modified table, which may only add columns.
+func checkTransformColumns(reference *Table, modified *Table) error {
+	if len(modified.Columns) < len(reference.Columns) {
+		return fmt.Errorf("table %s has fewer columns than in the reference package", modified.Name)
+	}
+
+	for i, column := range reference.Columns {
+		other := modified.Columns[i]
+		if column.Name != other.Name || column.ColumnType != other.ColumnType ||
+			column.IsPrimarykey != other.IsPrimarykey || (column.Category == CategoryBinary) != (other.Category == CategoryBinary) {
+			return fmt.Errorf("column %s.%s differs from the reference package", modified.Name, column.Name)
+		}
+	}
+
+	return nil
+}
+
+// Adds a row to the transform's stream for the table. Values of columns
+// left out by the mask must be nil.
+func (g *transformGenerator) add(table *Table, mask uint16, values []Value) error {
+	record := &transformRecord{
+		mask:   mask,
+		values: make([]*ValueRef, len(table.Columns)),
+	}
+
+	for i, column := range table.Columns {
+		if !recordHasColumn(table, mask, i) {
+			continue
+		}
+
+		if column.Category == CategoryBinary {
+			record.values[i] = &ValueRef{IsNull: values[i] == nil}
+			continue
+		}
+
+		ref, err := NewValueRef(values[i], g.pool)
+		if err != nil {
+			return err
+		}
+		record.values[i] = ref
+	}
+
+	g.tables[table.Name] = table
+	g.records[table.Name] = append(g.records[table.Name], record)
+
+	return nil
+}
+
+// Returns true if a row with the given mask gives the column, following
+// the rules TableChanges decodes.
+func recordHasColumn(table *Table, mask uint16, idx int) bool {
+	switch {
+	case mask&1 != 0:
+		return idx < int(mask>>8)
+	case table.Columns[idx].IsPrimarykey:
+		return true
+	default:
+		return idx < 16 && mask&(1<<idx) != 0
+	}
+}
+
+// Adds the row changes that turn the reference package's rows of the
+// table into the modified package's.
+func (g *transformGenerator) diffTable(reference *MSIPackage, modified *MSIPackage, table *Table) error {
+	rows, err := iceRows(modified, table.Name)
+	if err != nil {
+		return err
+	}
+
+	baseRows := make(map[string]*Row)
+	baseKeys := make([]string, 0)
+	if baseTable := reference.Table(table.Name); baseTable != nil {
+		base, err := iceRows(reference, table.Name)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range base {
+			values := make([]Value, len(table.Columns))
+			copy(values, row.Values)
+			row = NewRow(table, values)
+
+			key := rowKey(table, values)
+			baseRows[key] = row
+			baseKeys = append(baseKeys, key)
+		}
+	}
+
+	seen := make(map[string]struct{})
+	for _, row := range rows {
+		key := rowKey(table, row.Values)
+		seen[key] = struct{}{}
+
+		baseRow, ok := baseRows[key]
+		if !ok {
+			err = g.addRow(modified, table, insertMask(table), row.Values)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		changed := make([]int, 0)
+		for i, column := range table.Columns {
+			if column.IsPrimarykey {
+				continue
+			}
+
+			if column.Category == CategoryBinary {
+				baseData, err := binaryData(reference, table, baseRow.Values, i)
+				if err != nil {
+					return err
+				}
+				data, err := binaryData(modified, table, row.Values, i)
+				if err != nil {
+					return err
+				}
+				if (baseData == nil) != (data == nil) || !bytes.Equal(baseData, data) {
+					changed = append(changed, i)
+				}
+				continue
+			}
+
+			if baseRow.Values[i] != row.Values[i] {
+				changed = append(changed, i)
+			}
+		}
+
+		if len(changed) == 0 {
+			continue
+		}
+
+		var mask uint16
+		for _, i := range changed {
+			mask |= 1 << i
+		}
+
+		// A mask cannot reach columns past the sixteenth, and its low bit
+		// marks a full row rather than the first column; such rows are
+		// deleted and added again instead.
+		if changed[0] == 0 || changed[len(changed)-1] >= 16 {
+			err = g.add(table, 0, keyValues(table, row.Values))
+			if err != nil {
+				return err
+			}
+			mask = insertMask(table)
+		}
+
+		values := make([]Value, len(row.Values))
+		for i := range values {
+			if recordHasColumn(table, mask, i) {
+				values[i] = row.Values[i]
+			}
+		}
+
+		err = g.addRow(modified, table, mask, values)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range baseKeys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+
+		err = g.add(table, 0, keyValues(table, baseRows[key].Values))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Adds a row given in full or in part, along with the data of its binary
+// columns. Binary values without data are written as null.
+func (g *transformGenerator) addRow(p *MSIPackage, table *Table, mask uint16, values []Value) error {
+	values = append([]Value(nil), values...)
+	for i, column := range table.Columns {
+		if column.Category != CategoryBinary || !recordHasColumn(table, mask, i) {
+			continue
+		}
+
+		data, err := binaryData(p, table, values, i)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			values[i] = nil
+			continue
+		}
+
+		g.streams[binaryStreamName(table, values)] = data
+	}
+
+	return g.add(table, mask, values)
+}
+
+// Returns the values of the key columns, with the others set to nil.
+func keyValues(table *Table, values []Value) []Value {
+	key := make([]Value, len(values))
+	for _, idx := range table.PrimaryKeyIndices() {
+		key[idx] = values[idx]
+	}
+
+	return key
+}
+
+// Returns the data of a binary column, or nil if the value is null or the
+// package has no stream for it.
+func binaryData(p *MSIPackage, table *Table, values []Value, idx int) ([]byte, error) {
+	if values[idx] == nil {
+		return nil, nil
+	}
+
+	streamName := NameEncode(binaryStreamName(table, values), false)
+	if !p.hasStream(streamName) {
+		return nil, nil
+	}
+
+	stream, err := p.openStream(streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(stream)
+}
+
+// Returns the platform and language of a package in the form of the
+// Template summary property, taking the language from the ProductLanguage
+// property if the package has one.
+func transformTemplate(p *MSIPackage) string {
+	platform, languages, _ := splitTemplate(p.SummaryInfo.Template())
+
+	properties, err := p.propertyValues()
+	if err == nil && properties["ProductLanguage"] != "" {
+		languages = properties["ProductLanguage"]
+	}
+
+	return platform + ";" + languages
+}
+
+func transformRevisionNumber(reference *MSIPackage, modified *MSIPackage) (string, error) {
+	baseProperties, err := reference.propertyValues()
+	if err != nil {
+		return "", err
+	}
+
+	properties, err := modified.propertyValues()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		baseProperties["ProductCode"] + baseProperties["ProductVersion"],
+		properties["ProductCode"] + properties["ProductVersion"],
+		properties["UpgradeCode"],
+	}, ";"), nil
+}
+
+// Encodes the collected rows and writes the transform as a compound file.
+func (g *transformGenerator) write(w io.Writer, summaryInfo *SummaryInfo) error {
+	writer := newCompoundWriter(PackageTypeTransform.CLSID())
+
+	for name, records := range g.records {
+		table := g.tables[name]
+		buf := new(bytes.Buffer)
+		for _, record := range records {
+			err := binary.Write(buf, binary.LittleEndian, record.mask)
+			if err != nil {
+				return err
+			}
+
+			for i, column := range table.Columns {
+				ref := record.values[i]
+				if ref == nil {
+					continue
+				}
+
+				if column.Category == CategoryBinary {
+					var present uint16
+					if !ref.IsNull {
+						present = 1
+					}
+					err = binary.Write(buf, binary.LittleEndian, present)
+				} else {
+					err = column.ColumnType.WriteValue(buf, ref, g.pool.LongStringRefs)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err := writer.AddStream(streamPath(table.StreamName()), buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, data := range g.streams {
+		err := writer.AddStream(streamPath(NameEncode(name, false)), data)
+		if err != nil {
+			return err
+		}
+	}
+
+	poolBuf := new(bytes.Buffer)
+	err := g.pool.WritePool(poolBuf)
+	if err != nil {
+		return err
+	}
+
+	dataBuf := new(bytes.Buffer)
+	err = g.pool.WriteData(dataBuf)
+	if err != nil {
+		return err
+	}
+
+	summaryBuf := new(bytes.Buffer)
+	err = summaryInfo.WriteSummaryInfo(summaryBuf)
+	if err != nil {
+		return err
+	}
+
+	streams := map[string][]byte{
+		NameEncode(STRING_POOL_TABLE_NAME, true): poolBuf.Bytes(),
+		NameEncode(STRING_DATA_TABLE_NAME, true): dataBuf.Bytes(),
+		SUMMARY_INFO_STREAM_NAME:                 summaryBuf.Bytes(),
+	}
+	for name, data := range streams {
+		err = writer.AddStream(streamPath(name), data)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = writer.WriteTo(w)
+	return err
+}
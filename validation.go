@@ -0,0 +1,162 @@
+package msi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type ValidationErrorKind int
+
+const (
+	// A null value in a column that is not nullable.
+	ValidationErrorNull ValidationErrorKind = iota
+	// An integer in a string column, or the reverse.
+	ValidationErrorType
+	// An integer outside the column's type or range.
+	ValidationErrorRange
+	// A string longer than the column's size.
+	ValidationErrorStringSize
+	// A value not among the column's enum values.
+	ValidationErrorEnum
+	// A value that does not match the column's category.
+	ValidationErrorCategory
+)
+
+func (k ValidationErrorKind) String() string {
+	switch k {
+	case ValidationErrorNull:
+		return "Null"
+	case ValidationErrorType:
+		return "Type"
+	case ValidationErrorRange:
+		return "Range"
+	case ValidationErrorStringSize:
+		return "StringSize"
+	case ValidationErrorEnum:
+		return "Enum"
+	case ValidationErrorCategory:
+		return "Category"
+	default:
+		return ""
+	}
+}
+
+// A value that is not valid for its column. Table and Key, the primary key
+// values of the row, are only set when a whole table is validated.
+type ValidationError struct {
+	Table   string
+	Column  string
+	Key     []Value
+	Value   Value
+	Kind    ValidationErrorKind
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	location := e.Column
+	if e.Table != "" {
+		location = e.Table + "." + e.Column
+	}
+	if len(e.Key) > 0 {
+		parts := make([]string, len(e.Key))
+		for i, value := range e.Key {
+			parts[i] = fmt.Sprintf("%v", value)
+		}
+		location += " [" + strings.Join(parts, "/") + "]"
+	}
+
+	return fmt.Sprintf("%s: %s", location, e.Message)
+}
+
+// Checks a value against the column's type, nullability, size, range, enum
+// values and category, returning a *ValidationError if it is not valid.
+// Empty strings are treated as null, as they are stored.
+func (c *Column) ValidateValue(value Value) error {
+	value = normalizeValue(value)
+	if str, ok := value.(string); ok && str == "" {
+		value = nil
+	}
+
+	fail := func(kind ValidationErrorKind, format string, args ...interface{}) error {
+		return &ValidationError{
+			Column:  c.Name,
+			Value:   value,
+			Kind:    kind,
+			Message: fmt.Sprintf(format, args...),
+		}
+	}
+
+	var str string
+	switch v := value.(type) {
+	case nil:
+		if !c.IsNullable {
+			return fail(ValidationErrorNull, "null value in a column that is not nullable")
+		}
+		return nil
+	case int:
+		if c.ColumnType == ColumnTypeStr {
+			return fail(ValidationErrorType, "integer %d in a string column", v)
+		}
+		if (c.ColumnType == ColumnTypeInt16 && (v < -0x7fff || v > 0x7fff)) ||
+			(c.ColumnType == ColumnTypeInt32 && (v < -0x7fff_ffff || v > 0x7fff_ffff)) {
+			return fail(ValidationErrorRange, "%d does not fit the column type", v)
+		}
+		if c.ValueRange != nil && (v < int(c.ValueRange.Min) || v > int(c.ValueRange.Max)) {
+			return fail(ValidationErrorRange, "%d is outside the range %d to %d", v, c.ValueRange.Min, c.ValueRange.Max)
+		}
+		str = strconv.Itoa(v)
+	case string:
+		if c.ColumnType != ColumnTypeStr {
+			return fail(ValidationErrorType, "string %q in an integer column", v)
+		}
+		if c.ColumnStringSize > 0 && utf8.RuneCountInString(v) > c.ColumnStringSize {
+			return fail(ValidationErrorStringSize, "%q is longer than %d characters", v, c.ColumnStringSize)
+		}
+		str = v
+	default:
+		return fail(ValidationErrorType, "unsupported value type %T", value)
+	}
+
+	if !c.isEnumValue(str) {
+		return fail(ValidationErrorEnum, "%q is not one of %s", str, strings.Join(c.EnumValues, ";"))
+	}
+
+	if !c.Category.Validate(str) {
+		return fail(ValidationErrorCategory, "%q is not a valid %s value", str, c.Category)
+	}
+
+	return nil
+}
+
+// Validates every value of a table, returning the errors found in row
+// order.
+func (p *MSIPackage) ValidateTable(tableName string) ([]*ValidationError, error) {
+	table := p.Table(tableName)
+	if table == nil {
+		return nil, fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	rows, err := p.SelectRows(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	errors := make([]*ValidationError, 0)
+	for row := rows.Next(); row != nil; row = rows.Next() {
+		for i, column := range table.Columns {
+			err := column.ValidateValue(row.Values[i])
+			if err == nil {
+				continue
+			}
+
+			validationErr := err.(*ValidationError)
+			validationErr.Table = tableName
+			validationErr.Key = row.Key()
+			errors = append(errors, validationErr)
+		}
+	}
+
+	return errors, nil
+}
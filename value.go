@@ -1,5 +1,7 @@
 package msi
 
+import "fmt"
+
 type ValueRef struct {
 	IsNull bool
 	IsInt  bool
@@ -30,3 +32,79 @@ func (v *ValueRef) ToValue(pool *StringPool) Value {
 
 	return nil
 }
+
+// Creates a reference to the given value, adding a string pool reference
+// for string values. Empty strings are stored as null.
+func NewValueRef(value Value, pool *StringPool) (*ValueRef, error) {
+	switch v := value.(type) {
+	case nil:
+		return &ValueRef{IsNull: true}, nil
+	case int:
+		return &ValueRef{IsInt: true, Value: v}, nil
+	case string:
+		if v == "" {
+			return &ValueRef{IsNull: true}, nil
+		}
+
+		ref, err := pool.Incref(v)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ValueRef{IsStr: true, Value: ref}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported value type: %T", value)
+}
+
+// Releases the string pool reference held by a string value.
+func (v *ValueRef) Remove(pool *StringPool) error {
+	if !v.IsStr {
+		return nil
+	}
+
+	return pool.Decref(v.Value.(StringRef))
+}
+
+// Orders value references the way rows are sorted within a table stream:
+// nulls first, then by stored integer value or string pool index.
+func (v *ValueRef) Compare(other *ValueRef) int {
+	switch {
+	case v.IsNull || other.IsNull:
+		if v.IsNull && other.IsNull {
+			return 0
+		}
+		if v.IsNull {
+			return -1
+		}
+		return 1
+	case v.IsInt && other.IsInt:
+		return v.Value.(int) - other.Value.(int)
+	case v.IsStr && other.IsStr:
+		return int(v.Value.(StringRef).Num - other.Value.(StringRef).Num)
+	case v.IsInt:
+		return -1
+	}
+
+	return 1
+}
+
+// Normalizes the integer types accepted as values to int.
+func normalizeValue(value Value) Value {
+	switch v := value.(type) {
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	}
+
+	return value
+}